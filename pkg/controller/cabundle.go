@@ -0,0 +1,53 @@
+package clusterimageset
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// CA bundle configurations (in configmap)
+	CaBundleConfigMapRef = "caBundleConfigMapRef"
+	CaBundleConfigMapKey = "caBundleConfigMapKey"
+
+	// DefaultCaBundleConfigMapKey is the key of the trusted CA bundle that OpenShift injects in
+	// the configmaps labeled with config.openshift.io/inject-trusted-cabundle=true
+	DefaultCaBundleConfigMapKey = "ca-bundle.crt"
+)
+
+// getCABundle returns the trusted CA bundle held by the key of a configmap of the pod namespace.
+// It is read at every sync, so that the rotations of the bundle are picked up.
+func getCABundle(c client.Client, log logr.Logger, name, key string) (string, error) {
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: getPodNamespace()}, configMap)
+	if err != nil {
+		log.Info(fmt.Sprintf("unable to get CA bundle config map %v: %v", name, err.Error()))
+		return "", err
+	}
+
+	// OpenShift injects the bundle after the configmap is created
+	bundle := configMap.Data[key]
+	if strings.TrimSpace(bundle) == "" {
+		return "", fmt.Errorf("%s is missing in CA bundle config map %v", key, name)
+	}
+
+	return bundle, nil
+}
+
+// getCABundleConfigMapRef returns the name of the CA bundle configmap that a source configmap
+// references, it does not need the bundle to be readable.
+func getCABundleConfigMapRef(c client.Client, configMapName string) string {
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: configMapName, Namespace: getPodNamespace()}, configMap)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(configMap.Data[CaBundleConfigMapRef])
+}
@@ -1,27 +1,36 @@
 package clusterimageset
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/ghodss/yaml"
 	"github.com/stolostron/cluster-imageset-controller/test/integration/util"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/go-logr/logr"
+	configv1 "github.com/openshift/api/config/v1"
 	hivev1 "github.com/openshift/hive/apis/hive/v1"
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/util/csaupgrade"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
@@ -33,6 +42,7 @@ var (
 func init() {
 	utilruntime.Must(corev1.AddToScheme(scheme))
 	utilruntime.Must(hivev1.AddToScheme(scheme))
+	utilruntime.Must(configv1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -62,8 +72,17 @@ type ImagesetOptions struct {
 	MetricAddr                  string
 	ProbeAddr                   string
 	Interval                    int
+	MaxInterval                 int
 	ConfigMap                   string
 	Secret                      string
+	CacheDir                    string
+	StatusConfigMap             string
+	WebhookSecret               string
+	WebhookCertDir              string
+	StrictManifests             bool
+	ContinueOnError             bool
+	MaxFailedFilesPercent       int
+	ForceApply                  bool
 	LeaderElectionLeaseDuration time.Duration
 	LeaderElectionRenewDeadline time.Duration
 	LeaderElectionRetryPeriod   time.Duration
@@ -79,8 +98,29 @@ func (o *ImagesetOptions) AddFlags(cmd *cobra.Command) {
 	// This command only supports reading from config
 	flags.IntVar(&o.Interval, "sync-interval", 60,
 		"Interval in seconds when clusterImageSets are synced with the Git repository.")
-	flags.StringVar(&o.ConfigMap, "git-configmap", "cluster-image-set-git-repo", "Configuration info to access the clusterImageSet Git repository.")
-	flags.StringVar(&o.Secret, "git-secret", "cluster-image-set-git-repo", "Authentication info to access the clusterImageSet Git repository.")
+	flags.IntVar(&o.MaxInterval, "max-sync-interval", 900,
+		"Maximum interval in seconds between syncs, when the interval is lengthened after repeated sync failures.")
+	flags.StringVar(&o.ConfigMap, "git-configmap", DefaultGitConfigMap,
+		"Configuration info to access the clusterImageSet Git repository. "+
+			"A comma-separated list configures several Git repositories, in precedence order.")
+	flags.StringVar(&o.Secret, "git-secret", "cluster-image-set-git-repo",
+		"Authentication info to access the clusterImageSet Git repository, unless the configmap sets gitSecret.")
+	flags.StringVar(&o.CacheDir, "git-cache-dir", filepath.Join(os.TempDir(), DefaultCacheDirName),
+		"Directory where the local working copy of the clusterImageSet Git repository is kept between syncs.")
+	flags.StringVar(&o.StatusConfigMap, "status-configmap", DefaultStatusConfigMap,
+		"Configmap where the sync status of each source is recorded. An empty value disables the status.")
+	flags.StringVar(&o.WebhookSecret, "webhook-secret", "",
+		"Secret with the shared secret of the Git push webhooks. An empty value disables the webhook receiver.")
+	flags.StringVar(&o.WebhookCertDir, "webhook-cert-dir", "",
+		"Directory with the tls.crt and tls.key serving certificate of the webhook receiver.")
+	flags.BoolVar(&o.StrictManifests, "strict-manifests", false,
+		"Reject the clusterImageSet files with unknown or duplicate fields.")
+	flags.BoolVar(&o.ContinueOnError, "continue-on-error", false,
+		"Apply the valid clusterImageSets of a source when some of its files fail, and report the failed files.")
+	flags.IntVar(&o.MaxFailedFilesPercent, "max-failed-files-percent", DefaultMaxFailedFilesPercent,
+		"Percentage of the files of a source that may fail before its sync is aborted, with --continue-on-error.")
+	flags.BoolVar(&o.ForceApply, "force-apply", false,
+		"Take over the clusterImageSet fields set by other field managers, instead of failing on the apply conflicts.")
 	flags.StringVar(&o.MetricAddr, "metrics-bind-address", ":8387", "The address the metric endpoint binds to.")
 	flags.StringVar(&o.ProbeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.DurationVar(
@@ -114,6 +154,14 @@ func (o *ImagesetOptions) AddFlags(cmd *cobra.Command) {
 func (o *ImagesetOptions) runControllerManager(ctx context.Context, mgr manager.Manager) error {
 	flag.Parse()
 
+	// The webhook server only starts with a serving certificate, fail before anything starts
+	if o.WebhookSecret != "" {
+		if err := checkWebhookCertDir(o.WebhookCertDir); err != nil {
+			o.Log.Error(err, "invalid webhook receiver configuration")
+			return err
+		}
+	}
+
 	config := ctrl.GetConfigOrDie()
 	if mgr == nil {
 		var err error
@@ -121,11 +169,14 @@ func (o *ImagesetOptions) runControllerManager(ctx context.Context, mgr manager.
 			Scheme:                 scheme,
 			MetricsBindAddress:     o.MetricAddr,
 			Port:                   9443,
+			CertDir:                o.WebhookCertDir,
 			HealthProbeBindAddress: o.ProbeAddr,
-			LeaderElection:         false,
-			LeaseDuration:          &o.LeaderElectionLeaseDuration,
-			RenewDeadline:          &o.LeaderElectionRenewDeadline,
-			RetryPeriod:            &o.LeaderElectionRetryPeriod,
+			// Only the source configmaps and secrets are watched, in the controller namespace
+			Cache:          cache.Options{Namespaces: []string{getPodNamespace()}},
+			LeaderElection: false,
+			LeaseDuration:  &o.LeaderElectionLeaseDuration,
+			RenewDeadline:  &o.LeaderElectionRenewDeadline,
+			RetryPeriod:    &o.LeaderElectionRetryPeriod,
 		})
 
 		if err != nil {
@@ -141,6 +192,16 @@ func (o *ImagesetOptions) runControllerManager(ctx context.Context, mgr manager.
 	}
 	iCtrl := NewClusterImageSetController(client, o)
 
+	// Push webhooks trigger a sync right away, polling goes on as a fallback
+	if o.WebhookSecret != "" {
+		mgr.GetWebhookServer().Register(WebhookPath, newWebhookReceiver(iCtrl, o.WebhookSecret))
+	}
+
+	if err := newSourceConfigWatcher(iCtrl).SetupWithManager(mgr); err != nil {
+		o.Log.Error(err, "unable to watch the source configuration")
+		return err
+	}
+
 	iCtrl.Start()
 
 	o.Log.Info("starting manager")
@@ -148,23 +209,83 @@ func (o *ImagesetOptions) runControllerManager(ctx context.Context, mgr manager.
 	return mgr.Start(ctrl.SetupSignalHandler())
 }
 
+const (
+	// SourceAnnotation records the configmap of the source that provides the clusterImageSet
+	SourceAnnotation = "cluster-imageset.open-cluster-management.io/source"
+
+	// FieldManager owns the fields of the clusterImageSets that the controller applies
+	FieldManager = "cluster-imageset-controller"
+
+	// LegacyFieldManager owns the fields of the clusterImageSets that earlier versions of the
+	// controller created and updated, the API server named it after the controller binary
+	LegacyFieldManager = "clusterimageset"
+
+	// syncFailureThreshold is the number of consecutive failed syncs after which the sync
+	// interval is lengthened
+	syncFailureThreshold = 3
+)
+
 type ClusterImageSetController struct {
-	client       client.Client
-	log          logr.Logger
-	stopch       chan struct{}
-	interval     int
-	configMap    string
+	client client.Client
+	log    logr.Logger
+	stopch chan struct{}
+	// syncch triggers a sync before the interval elapses
+	syncch chan struct{}
+	// resync requests a full sync, regardless of the revisions of the sources
+	resync   atomic.Bool
+	interval int
+	// maxInterval bounds the sync interval lengthened after repeated failures
+	maxInterval int
+	// failures is the number of consecutive failed syncs
+	failures int
+	// configMaps configure the sources in precedence order, the first source that provides a
+	// clusterImageSet wins
+	configMaps   []string
 	secret       string
-	lastCommitID string
+	cacheDir     string
+	lastRevision string
+	// failedApplies are the clusterImageSets that failed to be applied by the last sync, when the
+	// sync continues on errors
+	failedApplies []failedApply
+	// statusConfigMap records the sync status of each source
+	statusConfigMap string
+	// strictManifests rejects the unknown and duplicate fields of the clusterImageSet files
+	strictManifests bool
+	// continueOnError applies the valid clusterImageSets of a source when some of its files fail,
+	// unless more than maxFailedFilesPercent of the files fail
+	continueOnError       bool
+	maxFailedFilesPercent int
+	// forceApply takes over the fields of the clusterImageSets owned by other field managers
+	forceApply bool
+	// sourceConfigRefs are the configmaps and secrets that configured the sources at the last
+	// sync, the source config watcher resyncs when they change
+	sourceConfigRefs atomic.Pointer[sourceConfigRefs]
 }
 
 func NewClusterImageSetController(c client.Client, o *ImagesetOptions) *ClusterImageSetController {
+	configMaps := []string{}
+	for _, configMap := range strings.Split(o.ConfigMap, ",") {
+		if configMap = strings.TrimSpace(configMap); configMap != "" {
+			configMaps = append(configMaps, configMap)
+		}
+	}
+
 	return &ClusterImageSetController{
-		client:    c,
-		log:       o.Log,
-		interval:  o.Interval,
-		configMap: o.ConfigMap,
-		secret:    o.Secret,
+		client:      c,
+		log:         o.Log,
+		syncch:      make(chan struct{}, 1),
+		interval:    o.Interval,
+		maxInterval: o.MaxInterval,
+		configMaps:  configMaps,
+		secret:      o.Secret,
+		cacheDir:    o.CacheDir,
+
+		statusConfigMap: o.StatusConfigMap,
+		strictManifests: o.StrictManifests,
+
+		continueOnError:       o.ContinueOnError,
+		maxFailedFilesPercent: o.MaxFailedFilesPercent,
+		forceApply:            o.ForceApply,
 	}
 }
 
@@ -176,16 +297,96 @@ func (r *ClusterImageSetController) Start() {
 
 	r.stopch = make(chan struct{})
 
+	go r.run(r.stopch)
+}
+
+// run syncs the clusterImageSets at every interval until stopch is closed
+func (r *ClusterImageSetController) run(stopch chan struct{}) {
 	cleanup := true
 
-	go wait.Until(func() {
+	for {
+		// The configuration changed, the unchanged revisions may now provide other clusterImageSets
+		if r.resync.Swap(false) {
+			r.lastRevision = ""
+			r.failedApplies = nil
+			cleanup = true
+		}
+
 		err := r.syncClusterImageSet(cleanup)
 		if err != nil {
 			fmt.Printf("error syncing clusterImageSets: %v", err.Error())
 		}
+		r.recordSyncResult(err)
 
-		cleanup = false // Perform cleanup on first run only
-	}, time.Duration(r.interval)*time.Second, r.stopch)
+		// Perform cleanup on the first successful run, and after a configuration change only
+		if err == nil {
+			cleanup = false
+		}
+
+		select {
+		case <-stopch:
+			return
+		case <-r.syncch:
+		case <-time.After(getSyncInterval(r.interval, r.maxInterval, r.failures)):
+		}
+	}
+}
+
+// Resync requests a full sync, including the cleanup, even if the revisions of the sources
+// did not change.
+func (r *ClusterImageSetController) Resync() {
+	r.resync.Store(true)
+	r.Trigger()
+}
+
+// Trigger requests a sync without waiting for the interval to elapse. A sync in progress is
+// followed by another one.
+func (r *ClusterImageSetController) Trigger() {
+	select {
+	case r.syncch <- struct{}{}:
+	default:
+	}
+}
+
+// recordSyncResult counts the consecutive failed syncs, and logs when the sync interval starts
+// and stops being lengthened.
+func (r *ClusterImageSetController) recordSyncResult(err error) {
+	if err == nil {
+		if r.failures >= syncFailureThreshold {
+			r.log.Info(fmt.Sprintf("sync succeeded after %d consecutive failures, syncing every %d seconds again",
+				r.failures, r.interval))
+		}
+		r.failures = 0
+		consecutiveSyncFailures.Set(0)
+		return
+	}
+
+	r.failures++
+	consecutiveSyncFailures.Set(float64(r.failures))
+
+	if r.failures == syncFailureThreshold {
+		r.log.Info(fmt.Sprintf("sync failed %d consecutive times, lengthening the sync interval up to %d seconds",
+			r.failures, r.maxInterval))
+	}
+}
+
+// getSyncInterval returns the interval before the next sync. From syncFailureThreshold
+// consecutive failed syncs, the interval doubles with each failure, up to maxInterval.
+func getSyncInterval(interval, maxInterval, failures int) time.Duration {
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+
+	seconds := interval
+	for i := syncFailureThreshold; i <= failures && seconds < maxInterval; i++ {
+		seconds *= 2
+	}
+
+	if seconds > maxInterval {
+		seconds = maxInterval
+	}
+
+	return time.Duration(seconds) * time.Second
 }
 
 func (r *ClusterImageSetController) Stop() {
@@ -198,142 +399,356 @@ func (r *ClusterImageSetController) syncClusterImageSet(cleanup bool) error {
 	r.log.Info("start syncClusterImageSet")
 	defer r.log.Info("done syncClusterImageSet")
 
-	// Check if the last commit ID is different since the previous sync
-	if r.lastCommitID != "" {
-		lastCommitID, err := r.getLastCommitID()
+	// The source type is read from the configmap, which can change between syncs
+	sources, err := r.getSources()
+	if err != nil {
+		return err
+	}
+
+	// Check if the revision of any source is different since the previous sync
+	if r.lastRevision != "" {
+		lastRevision, err := r.getLastRevision(sources)
 		if err != nil {
 			return err
 		}
 
-		if r.lastCommitID == lastCommitID {
-			r.log.Info(fmt.Sprintf("previous commit %v is already the most recent, skip sync", lastCommitID))
+		if r.lastRevision == lastRevision {
+			r.log.Info(fmt.Sprintf("previous revision %v is already the most recent, skip sync", lastRevision))
+			r.retryFailedApplies()
 			return nil
 		}
 	}
 
-	tempDir, err := ioutil.TempDir(os.TempDir(), "cluster-imageset-")
-	if err != nil {
-		return err
+	// Collect the clusterImageSets of all sources before applying any of them, so that a
+	// source that fails to sync does not change which source provides a clusterImageSet.
+	revisions := []string{}
+	contents := []*SourceContent{}
+	reports := map[string]*fileReport{}
+	imagesets := map[string]*hivev1.ClusterImageSet{}
+	imagesetList := []string{}
+
+	for _, source := range sources {
+		content, err := source.Fetch()
+		if err != nil {
+			r.recordSyncError(source.Name(), err, nil)
+			return err
+		}
+
+		sourceImagesets, report, err := r.loadImageSets(content)
+		if err != nil {
+			r.reportFailedFiles(source.Name(), report)
+			r.recordSyncError(source.Name(), err, report.failures)
+			return err
+		}
+		reports[source.Name()] = report
+
+		for _, imageset := range sourceImagesets {
+			if existing, ok := imagesets[imageset.GetName()]; ok {
+				r.log.Info(fmt.Sprintf("clusterImageSet %v from source %v is overridden by source %v",
+					imageset.GetName(), source.Name(), existing.GetAnnotations()[SourceAnnotation]))
+				continue
+			}
+
+			annotations := imageset.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			annotations[SourceAnnotation] = source.Name()
+			imageset.SetAnnotations(annotations)
+
+			imagesets[imageset.GetName()] = imageset
+			imagesetList = append(imagesetList, imageset.GetName())
+		}
+
+		revisions = append(revisions, content.Revision)
+		contents = append(contents, content)
 	}
-	defer os.RemoveAll(tempDir)
 
-	repo, err := r.cloneGitRepo(tempDir, false)
-	if err != nil {
-		return err
+	failedApplies := []failedApply{}
+	for _, name := range imagesetList {
+		if _, err := r.applyClusterImageSet(imagesets[name]); err != nil {
+			r.log.Info("failed to apply clusterImageSet: " + name)
+			source := imagesets[name].GetAnnotations()[SourceAnnotation]
+			if !r.continueOnError {
+				r.recordSyncError(source, err, nil)
+				return err
+			}
+
+			report := reports[source]
+			failure := report.add(report.paths[name], fmt.Errorf("failed to apply clusterImageSet %v: %w", name, err))
+			failedApplies = append(failedApplies, failedApply{
+				imageset: imagesets[name],
+				source:   source,
+				path:     report.paths[name],
+				report:   report,
+				failure:  failure,
+			})
+		}
 	}
 
-	imagesetList, err := r.applyImageSetsFromClonedGitRepo(tempDir)
-	if err != nil {
-		return err
+	// The clusterImageSets of the sources with failed files are not cleaned up, the failed files
+	// may still provide them
+	keepSources := map[string]bool{}
+	for _, source := range sources {
+		report := reports[source.Name()]
+		r.reportFailedFiles(source.Name(), report)
+		if len(report.failures) == 0 {
+			continue
+		}
+
+		keepSources[source.Name()] = true
+		if err := report.exceeds(r.maxFailedFilesPercent); err != nil {
+			r.recordSyncError(source.Name(), err, report.failures)
+			return err
+		}
 	}
 
 	if cleanup {
-		err = r.cleanupClusterImages(imagesetList)
+		err := r.cleanupClusterImages(imagesetList, keepSources)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Update lastCommitID
-	ref, err := repo.Head()
-	if err != nil {
-		return err
-	}
-	commit, err := repo.CommitObject(ref.Hash())
-	if err != nil {
-		return err
+	for i, source := range sources {
+		r.recordSyncSuccess(source.Name(), contents[i], reports[source.Name()].failures)
 	}
-	r.lastCommitID = commit.ID().String()
+
+	// Update lastRevision, the clusterImageSets that failed to be applied are retried at the next
+	// syncs without fetching the sources again. The files that cannot be read or are invalid are
+	// only read again when the revision of their source changes.
+	r.lastRevision = strings.Join(revisions, ",")
+	r.failedApplies = failedApplies
 
 	return nil
 }
 
-func (r *ClusterImageSetController) applyImageSetsFromClonedGitRepo(destDir string) ([]string, error) {
-	imageSetList := []string{}
+// retryFailedApplies applies again the clusterImageSets that failed to be applied by the last
+// sync, and removes the files whose clusterImageSets are now all applied from the failed files
+func (r *ClusterImageSetController) retryFailedApplies() {
+	if len(r.failedApplies) == 0 {
+		return
+	}
 
-	_, _, gitRepoPath, channel, _, _, err := r.getGitRepoConfig()
-	if err != nil {
-		return nil, err
+	failedApplies := []failedApply{}
+	applied := []failedApply{}
+	for _, failed := range r.failedApplies {
+		if _, err := r.applyClusterImageSet(failed.imageset); err != nil {
+			r.log.Info(fmt.Sprintf("failed to apply clusterImageSet %v again: %v", failed.imageset.GetName(), err.Error()))
+			failedApplies = append(failedApplies, failed)
+			continue
+		}
+
+		applied = append(applied, failed)
 	}
+	r.failedApplies = failedApplies
 
-	resourcePath := filepath.Join(destDir, gitRepoPath, channel)
-	r.log.Info(fmt.Sprintf("applying clusterImageSets from path: %v", resourcePath))
+	for _, failed := range applied {
+		if failed.failure == nil {
+			continue
+		}
 
-	err = filepath.Walk(resourcePath,
-		func(path string, info os.FileInfo, err error) error {
-			if !info.IsDir() {
-				file, err := ioutil.ReadFile(filepath.Clean(path))
-				if err != nil {
-					r.log.Info("failed to read clusterImageSet file: " + path)
-					return err
-				}
+		// Another clusterImageSet of the same file may still fail
+		retried := true
+		for _, other := range failedApplies {
+			if other.source == failed.source && other.path == failed.path {
+				retried = false
+			}
+		}
 
-				imageset, err := r.applyClusterImageSetFile(file)
-				if err != nil {
-					r.log.Info("failed to apply clusterImageSet file:" + path)
-					return err
-				}
-				imageSetList = append(imageSetList, imageset.GetName())
+		if retried {
+			failed.report.remove(failed.failure)
+			failedFiles.WithLabelValues(failed.source).Set(float64(len(failed.report.failures)))
+			r.recordFailedFiles(failed.source, failed.report.failures)
+		}
+	}
+}
+
+// getSources returns the sources configured by the configmaps, in precedence order
+func (r *ClusterImageSetController) getSources() ([]Source, error) {
+	sources := []Source{}
+
+	refs := newSourceConfigRefs(r.configMaps)
+	defer r.sourceConfigRefs.Store(refs)
+
+	for _, configMap := range r.configMaps {
+		config, err := getSourceConfig(r.client, r.log, configMap, r.secret)
+		if err != nil {
+			// The configuration cannot be read until the CA bundle configmap exists and holds the
+			// bundle, OpenShift injects it after the configmap is created
+			if caBundleConfigMap := getCABundleConfigMapRef(r.client, configMap); caBundleConfigMap != "" {
+				refs.configMaps.Insert(caBundleConfigMap)
 			}
+			return nil, err
+		}
+		refs.add(config)
 
-			return nil
-		})
+		source, err := newSource(r.client, r.log, config, configMap, r.secret, r.cacheDir)
+		if err != nil {
+			return nil, err
+		}
 
-	return imageSetList, err
+		sources = append(sources, source)
+	}
+
+	return sources, nil
 }
 
-func (r *ClusterImageSetController) applyClusterImageSetFile(file []byte) (*hivev1.ClusterImageSet, error) {
-	imageset := &hivev1.ClusterImageSet{}
-	if err := yaml.Unmarshal(file, imageset); err != nil {
-		return nil, err
+// getLastRevision returns the revisions of all sources, in precedence order
+func (r *ClusterImageSetController) getLastRevision(sources []Source) (string, error) {
+	revisions := []string{}
+
+	for _, source := range sources {
+		revision, err := source.Revision()
+		if err != nil {
+			return "", err
+		}
+
+		revisions = append(revisions, revision)
 	}
 
-	oImageset := &hivev1.ClusterImageSet{}
-	err := r.client.Get(context.TODO(), client.ObjectKeyFromObject(imageset), oImageset)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			err = r.createClusterImageSet(imageset)
-		} else {
-			r.log.Info("failed to create clusterImageSet")
+	return strings.Join(revisions, ","), nil
+}
+
+// loadImageSets returns the clusterImageSets of the files of the source content. A file that fails
+// fails the sync, unless the sync continues on errors: the file is then recorded in the report,
+// and the sync fails only when more than maxFailedFilesPercent of the files fail.
+func (r *ClusterImageSetController) loadImageSets(content *SourceContent) ([]*hivev1.ClusterImageSet, *fileReport, error) {
+	imagesets := []*hivev1.ClusterImageSet{}
+	report := newFileReport(len(content.Manifests))
+
+	for _, manifest := range content.Manifests {
+		err := manifest.Err
+		var fileImagesets []*hivev1.ClusterImageSet
+		if err == nil {
+			fileImagesets, err = r.loadClusterImageSetFile(manifest.Path, manifest.Data)
 		}
-	} else {
-		// Check if visible label and release image values changed
-		if oImageset.GetLabels()["visible"] != imageset.GetLabels()["visible"] ||
-			oImageset.Spec.ReleaseImage != imageset.Spec.ReleaseImage {
-
-			err = r.updateClusterImageSet(oImageset, imageset)
-		} else {
-			r.log.V(2).Info(fmt.Sprintf("clusterImageSet(%v) already exists, skipping", imageset.GetName()))
-			imageset = oImageset
+		if err != nil {
+			r.log.Info("failed to load clusterImageSet file:" + manifest.Path)
+			if !r.continueOnError {
+				return nil, report, err
+			}
+
+			report.add(manifest.Path, err)
+			continue
 		}
+
+		for _, imageset := range fileImagesets {
+			report.paths[imageset.GetName()] = manifest.Path
+		}
+		imagesets = append(imagesets, fileImagesets...)
+	}
+
+	if err := report.exceeds(r.maxFailedFilesPercent); err != nil {
+		return nil, report, err
 	}
 
-	return imageset, err
+	return imagesets, report, nil
 }
 
-func (r *ClusterImageSetController) createClusterImageSet(imageset *hivev1.ClusterImageSet) error {
-	r.log.Info(fmt.Sprintf("create clusterImageSet: %v", imageset))
+// reportFailedFiles logs the failed files of a source and sets the failed files metric
+func (r *ClusterImageSetController) reportFailedFiles(name string, report *fileReport) {
+	for _, failure := range report.failures {
+		r.log.Info(fmt.Sprintf("clusterImageSet file %v of source %v failed: %v", failure.Path, name, failure.Error))
+	}
 
-	if err := r.client.Create(context.TODO(), imageset); err != nil {
-		return err
+	failedFiles.WithLabelValues(name).Set(float64(len(report.failures)))
+}
+
+// loadClusterImageSetFile returns the clusterImageSets of a file. The file holds one or more YAML
+// documents separated by ---, and each document is a clusterImageSet, or a List or a
+// ClusterImageSetList of clusterImageSets. Every clusterImageSet is validated, so that an invalid
+// file fails the sync before any clusterImageSet is applied.
+func (r *ClusterImageSetController) loadClusterImageSetFile(path string, file []byte) ([]*hivev1.ClusterImageSet, error) {
+	imagesets := []*hivev1.ClusterImageSet{}
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(file)))
+	for index := 1; ; index++ {
+		document, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read document %d of %s: %w", index, path, err)
+		}
+
+		documentImagesets, err := loadClusterImageSetDocument(document, r.strictManifests)
+		if err != nil {
+			return nil, fmt.Errorf("invalid document %d of %s: %w", index, path, err)
+		}
+		imagesets = append(imagesets, documentImagesets...)
 	}
 
-	return nil
+	return imagesets, nil
 }
 
-func (r *ClusterImageSetController) updateClusterImageSet(oImageset, imageset *hivev1.ClusterImageSet) error {
-	oImageset.Spec = imageset.Spec
-	oImageset.Labels = imageset.Labels
-	r.log.Info(fmt.Sprintf("update clusterImageSet: %v", oImageset))
+// applyClusterImageSet applies the clusterImageSet with server-side apply. The controller only
+// owns the labels, annotations and spec fields of the clusterImageSet file, the fields set by
+// other tools or by admins are kept. A field owned by another field manager fails the apply with
+// a conflict, unless forceApply is set.
+func (r *ClusterImageSetController) applyClusterImageSet(imageset *hivev1.ClusterImageSet) (*hivev1.ClusterImageSet, error) {
+	applyImageset := &hivev1.ClusterImageSet{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: hivev1.SchemeGroupVersion.String(),
+			Kind:       clusterImageSetKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        imageset.GetName(),
+			Labels:      imageset.GetLabels(),
+			Annotations: imageset.GetAnnotations(),
+		},
+		Spec: imageset.Spec,
+	}
+
+	options := []client.PatchOption{client.FieldOwner(FieldManager)}
+	if r.forceApply {
+		options = append(options, client.ForceOwnership)
+	}
 
-	if err := r.client.Update(context.TODO(), oImageset); err != nil {
+	r.log.V(2).Info(fmt.Sprintf("apply clusterImageSet: %v", imageset.GetName()))
+
+	if err := r.upgradeManagedFields(imageset.GetName()); err != nil {
+		return nil, err
+	}
+
+	err := r.client.Patch(context.TODO(), applyImageset, client.Apply, options...)
+	if errors.IsConflict(err) {
+		return nil, fmt.Errorf("clusterImageSet %v has fields owned by other field managers, "+
+			"start the controller with --force-apply to take them over: %w", imageset.GetName(), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return applyImageset, nil
+}
+
+// upgradeManagedFields moves the fields of a clusterImageSet owned by the updates of earlier
+// versions of the controller to the apply field manager, so that applying them does not conflict
+// with the controller itself
+func (r *ClusterImageSetController) upgradeManagedFields(name string) error {
+	imageset := &hivev1.ClusterImageSet{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name}, imageset)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
-	return nil
+	patch, err := csaupgrade.UpgradeManagedFieldsPatch(imageset, sets.New(LegacyFieldManager), FieldManager)
+	if err != nil || patch == nil {
+		return err
+	}
+
+	r.log.Info(fmt.Sprintf("upgrade managed fields of clusterImageSet %v to field manager %v", name, FieldManager))
+
+	return r.client.Patch(context.TODO(), imageset, client.RawPatch(types.JSONPatchType, patch))
 }
 
-func (r *ClusterImageSetController) cleanupClusterImages(currentImageSetList []string) error {
+// cleanupClusterImages deletes the clusterImageSets with a channel label that are not in the
+// current list, except the clusterImageSets provided by the sources to keep
+func (r *ClusterImageSetController) cleanupClusterImages(currentImageSetList []string, keepSources map[string]bool) error {
 	r.log.Info("cleanup old clusterImageSets")
 
 	imageSets := &hivev1.ClusterImageSetList{}
@@ -352,6 +767,10 @@ func (r *ClusterImageSetController) cleanupClusterImages(currentImageSetList []s
 				continue
 			}
 
+			if keepSources[imageSet.GetAnnotations()[SourceAnnotation]] {
+				continue
+			}
+
 			i := sort.SearchStrings(currentImageSetList, imageSet.GetName())
 			if i >= len(currentImageSetList) || currentImageSetList[i] != imageSet.GetName() {
 				r.log.Info(fmt.Sprintf("deleting clusterImageSet: %v", imageSet.GetName()))
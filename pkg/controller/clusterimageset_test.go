@@ -2,12 +2,17 @@ package clusterimageset
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/go-logr/zapr"
 	"github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
 	hivev1 "github.com/openshift/hive/apis/hive/v1"
 	"github.com/stolostron/cluster-imageset-controller/test/integration/util"
 	"go.uber.org/zap"
@@ -15,8 +20,10 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
@@ -71,7 +78,7 @@ func TestSyncImageSet(t *testing.T) {
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 
 	iCtrl = NewClusterImageSetController(c, options)
-	iCtrl.lastCommitID = "fakeCommit"
+	iCtrl.lastRevision = "fakeRevision"
 	err = iCtrl.syncClusterImageSet(true)
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 
@@ -90,6 +97,260 @@ func TestSyncImageSet(t *testing.T) {
 	g.Expect(errors.IsNotFound(err)).To(gomega.BeTrue())
 }
 
+func TestSyncImageSetMultipleSources(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	gitRoot := t.TempDir()
+	commitGitRepoFiles(t, filepath.Join(gitRoot, "internal.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-hotfix.yaml":    getClusterImageSetYAML("img4.11.0-hotfix", "quay.io/internal/ocp-release:4.11.0-hotfix"),
+		"clusterImageSets/fast/img4.11.0-x86-64.yaml":    getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/internal/ocp-release:4.11.0-x86_64"),
+		"clusterImageSets/stable/img4.10.0-x86-64.yaml":  getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/internal/ocp-release:4.10.0-x86_64"),
+		"clusterImageSets/candidate/img4.12.0-rc.0.yaml": getClusterImageSetYAML("img4.12.0-rc.0-appsub", "quay.io/internal/ocp-release:4.12.0-rc.0"),
+	})
+	commitGitRepoFiles(t, filepath.Join(gitRoot, "public.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64.yaml": getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+		"clusterImageSets/fast/img4.11.1-x86-64.yaml": getClusterImageSetYAML("img4.11.1-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.1-x86_64"),
+	})
+
+	server := newGitHTTPServer(t, gitRoot)
+
+	c := initClient()
+
+	internalConfigMap := getConfigMap(server.URL+"/internal.git", "master", "clusterImageSets", "fast")
+	internalConfigMap.Name = "internal-releases"
+	g.Expect(c.Create(context.TODO(), internalConfigMap)).To(gomega.Succeed())
+
+	publicConfigMap := getConfigMap(server.URL+"/public.git", "master", "clusterImageSets", "fast")
+	publicConfigMap.Name = "public-releases"
+	g.Expect(c.Create(context.TODO(), publicConfigMap)).To(gomega.Succeed())
+
+	// Imageset from a channel that no source provides anymore
+	oldImageset := &hivev1.ClusterImageSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "img4.9.0-x86-64-appsub",
+			Labels: map[string]string{util.ChannelLabel: "fast"},
+		},
+		Spec: hivev1.ClusterImageSetSpec{
+			ReleaseImage: "quay.io/openshift-release-dev/ocp-release:4.9.0-x86_64",
+		},
+	}
+	g.Expect(c.Create(context.TODO(), oldImageset)).To(gomega.Succeed())
+
+	zapLog, _ := zap.NewDevelopment()
+	options := &ImagesetOptions{
+		Log:       zapr.NewLogger(zapLog),
+		Interval:  60,
+		ConfigMap: "internal-releases, public-releases",
+		CacheDir:  t.TempDir(),
+	}
+
+	iCtrl := NewClusterImageSetController(c, options)
+	g.Expect(iCtrl.configMaps).To(gomega.Equal([]string{"internal-releases", "public-releases"}))
+
+	err := iCtrl.syncClusterImageSet(true)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(strings.Split(iCtrl.lastRevision, ",")).To(gomega.HaveLen(2))
+
+	wantSources := map[string]string{
+		"img4.11.0-hotfix":        "internal-releases",
+		"img4.11.0-x86-64-appsub": "internal-releases",
+		"img4.11.1-x86-64-appsub": "public-releases",
+	}
+	imagesetList := &hivev1.ClusterImageSetList{}
+	g.Expect(c.List(context.TODO(), imagesetList)).To(gomega.Succeed())
+	g.Expect(imagesetList.Items).To(gomega.HaveLen(len(wantSources)))
+	for _, imageset := range imagesetList.Items {
+		g.Expect(imageset.GetAnnotations()[SourceAnnotation]).To(gomega.Equal(wantSources[imageset.GetName()]))
+	}
+
+	// The source listed first wins
+	imageset := &hivev1.ClusterImageSet{}
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.0-x86-64-appsub"}, imageset)).To(gomega.Succeed())
+	g.Expect(imageset.Spec.ReleaseImage).To(gomega.Equal("quay.io/internal/ocp-release:4.11.0-x86_64"))
+
+	// The unchanged sources are not synced again
+	err = iCtrl.syncClusterImageSet(false)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+}
+
+func TestSyncImageSetContinueOnError(t *testing.T) {
+	tests := []struct {
+		name                  string
+		continueOnError       bool
+		maxFailedFilesPercent int
+		wantErr               bool
+		wantImagesets         []string
+		wantFailedFiles       []string
+	}{
+		{
+			name:          "stop on error",
+			wantErr:       true,
+			wantImagesets: []string{"img4.9.0-x86-64-appsub"},
+		},
+		{
+			name:                  "continue on error",
+			continueOnError:       true,
+			maxFailedFilesPercent: 50,
+			wantImagesets:         []string{"img4.10.0-x86-64-appsub", "img4.11.0-x86-64-appsub", "img4.12.0-x86-64-appsub", "img4.9.0-x86-64-appsub"},
+			wantFailedFiles:       []string{"img4.13.0-x86-64.yaml"},
+		},
+		{
+			name:                  "too many failed files",
+			continueOnError:       true,
+			maxFailedFilesPercent: 10,
+			wantErr:               true,
+			wantImagesets:         []string{"img4.9.0-x86-64-appsub"},
+			wantFailedFiles:       []string{"img4.13.0-x86-64.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{
+				"img4.10.0-x86-64.yaml": getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+				"img4.11.0-x86-64.yaml": getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+				"img4.12.0-x86-64.yaml": getClusterImageSetYAML("img4.12.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.12.0-x86_64"),
+				"img4.13.0-x86-64.yaml": getClusterImageSetYAML("img4.13.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release 4.13.0"),
+			})
+
+			c := initClient()
+			g.Expect(c.Create(context.TODO(), getSourceConfigMap("directory", map[string]string{
+				SourceType:    SourceTypeDirectory,
+				DirectoryPath: dir,
+			}))).To(gomega.Succeed())
+
+			// The failed file of the source may still provide the imageset, it is not cleaned up
+			g.Expect(c.Create(context.TODO(), &hivev1.ClusterImageSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "img4.9.0-x86-64-appsub",
+					Labels:      map[string]string{util.ChannelLabel: "fast"},
+					Annotations: map[string]string{SourceAnnotation: "directory"},
+				},
+				Spec: hivev1.ClusterImageSetSpec{
+					ReleaseImage: "quay.io/openshift-release-dev/ocp-release:4.9.0-x86_64",
+				},
+			})).To(gomega.Succeed())
+
+			zapLog, _ := zap.NewDevelopment()
+			iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+				Log:                   zapr.NewLogger(zapLog),
+				Interval:              60,
+				ConfigMap:             "directory",
+				StatusConfigMap:       DefaultStatusConfigMap,
+				ContinueOnError:       tt.continueOnError,
+				MaxFailedFilesPercent: tt.maxFailedFilesPercent,
+			})
+
+			err := iCtrl.syncClusterImageSet(true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncClusterImageSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// The revision is kept, the invalid files are only read again when it changes
+			g.Expect(iCtrl.lastRevision != "").To(gomega.Equal(!tt.wantErr))
+
+			imagesetList := &hivev1.ClusterImageSetList{}
+			g.Expect(c.List(context.TODO(), imagesetList)).To(gomega.Succeed())
+			imagesets := []string{}
+			for _, imageset := range imagesetList.Items {
+				imagesets = append(imagesets, imageset.GetName())
+			}
+			g.Expect(imagesets).To(gomega.ConsistOf(tt.wantImagesets))
+
+			status, err := iCtrl.getSourceStatus("directory")
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			failedFiles := []string{}
+			for _, failure := range status.FailedFiles {
+				g.Expect(failure.Error).To(gomega.ContainSubstring("spec.releaseImage"))
+				failedFiles = append(failedFiles, failure.Path)
+			}
+			g.Expect(failedFiles).To(gomega.ConsistOf(tt.wantFailedFiles))
+			g.Expect(status.LastError != "").To(gomega.Equal(tt.wantErr))
+		})
+	}
+}
+
+func TestSyncImageSetRetryFailedApplies(t *testing.T) {
+	tests := []struct {
+		name            string
+		continueOnError bool
+		wantErr         bool
+	}{
+		{name: "stop on error", wantErr: true},
+		{name: "continue on error", continueOnError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{
+				"img4.10.0-x86-64.yaml": getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+				"img4.11.0-x86-64.yaml": getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+			})
+
+			// The apply of img4.11.0-x86-64-appsub fails until the server recovers
+			applyFails := true
+			c := interceptor.NewClient(initClient().(client.WithWatch), interceptor.Funcs{
+				Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+					if applyFails && obj.GetName() == "img4.11.0-x86-64-appsub" {
+						return errors.NewServiceUnavailable("server is unavailable")
+					}
+
+					return applyPatch(ctx, c, obj, patch, opts...)
+				},
+			})
+			g.Expect(c.Create(context.TODO(), getSourceConfigMap("directory", map[string]string{
+				SourceType:    SourceTypeDirectory,
+				DirectoryPath: dir,
+			}))).To(gomega.Succeed())
+
+			zapLog, _ := zap.NewDevelopment()
+			iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+				Log:                   zapr.NewLogger(zapLog),
+				Interval:              60,
+				ConfigMap:             "directory",
+				StatusConfigMap:       DefaultStatusConfigMap,
+				ContinueOnError:       tt.continueOnError,
+				MaxFailedFilesPercent: 50,
+			})
+
+			err := iCtrl.syncClusterImageSet(true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncClusterImageSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			status, err := iCtrl.getSourceStatus("directory")
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			if tt.wantErr {
+				g.Expect(status.LastError).To(gomega.ContainSubstring("server is unavailable"))
+				return
+			}
+			g.Expect(status.FailedFiles).To(gomega.HaveLen(1))
+			g.Expect(status.FailedFiles[0].Path).To(gomega.Equal("img4.11.0-x86-64.yaml"))
+
+			// The revision did not change, only the failed clusterImageSet is applied again
+			revision := iCtrl.lastRevision
+			g.Expect(revision).NotTo(gomega.BeEmpty())
+			g.Expect(iCtrl.syncClusterImageSet(false)).To(gomega.Succeed())
+			g.Expect(iCtrl.failedApplies).To(gomega.HaveLen(1))
+
+			applyFails = false
+			g.Expect(iCtrl.syncClusterImageSet(false)).To(gomega.Succeed())
+			g.Expect(iCtrl.failedApplies).To(gomega.BeEmpty())
+			g.Expect(iCtrl.lastRevision).To(gomega.Equal(revision))
+			g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.0-x86-64-appsub"}, &hivev1.ClusterImageSet{})).To(gomega.Succeed())
+
+			status, err = iCtrl.getSourceStatus("directory")
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(status.FailedFiles).To(gomega.BeEmpty())
+			g.Expect(status.Revision).To(gomega.Equal(revision))
+		})
+	}
+}
+
 func TestSetupImageSetController(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
 
@@ -119,6 +380,7 @@ func TestApplyClusterImageSet(t *testing.T) {
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 
 	cis := &hivev1.ClusterImageSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: hivev1.SchemeGroupVersion.String(), Kind: "ClusterImageSet"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:   "img4.11.0-x86-64-appsub",
 			Labels: map[string]string{"visible": "true"},
@@ -130,6 +392,7 @@ func TestApplyClusterImageSet(t *testing.T) {
 
 	// ReleaseImage changed
 	cis2 := &hivev1.ClusterImageSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: hivev1.SchemeGroupVersion.String(), Kind: "ClusterImageSet"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:   "img4.11.0-x86-64-appsub",
 			Labels: map[string]string{"visible": "true"},
@@ -141,6 +404,7 @@ func TestApplyClusterImageSet(t *testing.T) {
 
 	// Visible label changed
 	cis3 := &hivev1.ClusterImageSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: hivev1.SchemeGroupVersion.String(), Kind: "ClusterImageSet"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:   "img4.11.0-x86-64-appsub",
 			Labels: map[string]string{"visible": "false"},
@@ -153,7 +417,10 @@ func TestApplyClusterImageSet(t *testing.T) {
 	bCis, err := yaml.Marshal(cis)
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 
-	_, err = iCtrl.applyClusterImageSetFile(bCis)
+	imagesets, err := iCtrl.loadClusterImageSetFile("imageset.yaml", bCis)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(imagesets).To(gomega.HaveLen(1))
+	_, err = iCtrl.applyClusterImageSet(imagesets[0])
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 	createdCis := &hivev1.ClusterImageSet{}
 	err = iCtrl.client.Get(context.TODO(), client.ObjectKeyFromObject(cis), createdCis)
@@ -164,7 +431,10 @@ func TestApplyClusterImageSet(t *testing.T) {
 	bCis2, err := yaml.Marshal(cis2)
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 
-	_, err = iCtrl.applyClusterImageSetFile(bCis2)
+	imagesets, err = iCtrl.loadClusterImageSetFile("imageset.yaml", bCis2)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(imagesets).To(gomega.HaveLen(1))
+	_, err = iCtrl.applyClusterImageSet(imagesets[0])
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 	err = iCtrl.client.Get(context.TODO(), client.ObjectKeyFromObject(cis2), createdCis)
 	g.Expect(err).NotTo(gomega.HaveOccurred())
@@ -174,18 +444,312 @@ func TestApplyClusterImageSet(t *testing.T) {
 	bCis3, err := yaml.Marshal(cis3)
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 
-	_, err = iCtrl.applyClusterImageSetFile(bCis3)
+	imagesets, err = iCtrl.loadClusterImageSetFile("imageset.yaml", bCis3)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(imagesets).To(gomega.HaveLen(1))
+	_, err = iCtrl.applyClusterImageSet(imagesets[0])
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 	err = iCtrl.client.Get(context.TODO(), client.ObjectKeyFromObject(cis3), createdCis)
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 	g.Expect(createdCis.GetLabels()["visible"]).To(gomega.Equal(cis3.GetLabels()["visible"]))
 
+	// apply should keep the labels and annotations added by other tools
+	createdCis.Labels["team"] = "platform"
+	createdCis.Annotations = map[string]string{"note": "pinned"}
+	g.Expect(iCtrl.client.Update(context.TODO(), createdCis)).To(gomega.Succeed())
+	imagesets, err = iCtrl.loadClusterImageSetFile("imageset.yaml", bCis2)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	_, err = iCtrl.applyClusterImageSet(imagesets[0])
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	err = iCtrl.client.Get(context.TODO(), client.ObjectKeyFromObject(cis2), createdCis)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(createdCis.GetLabels()).To(gomega.Equal(map[string]string{"visible": "true", "team": "platform"}))
+	g.Expect(createdCis.GetAnnotations()).To(gomega.Equal(map[string]string{"note": "pinned"}))
+
 	// unmarshal error
 	badCis := []byte("bad$:xys")
-	_, err = iCtrl.applyClusterImageSetFile(badCis)
+	_, err = iCtrl.loadClusterImageSetFile("imageset.yaml", badCis)
 	g.Expect(err).To(gomega.HaveOccurred())
 }
 
+func TestApplyClusterImageSetConflict(t *testing.T) {
+	tests := []struct {
+		name       string
+		forceApply bool
+		wantErr    bool
+	}{
+		{name: "conflict", wantErr: true},
+		{name: "force apply", forceApply: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			// The release image is owned by another field manager
+			c := interceptor.NewClient(initClient().(client.WithWatch), interceptor.Funcs{
+				Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+					patchOptions := &client.PatchOptions{}
+					patchOptions.ApplyOptions(opts)
+					if patchOptions.FieldManager != FieldManager {
+						t.Errorf("field manager = %v, want %v", patchOptions.FieldManager, FieldManager)
+					}
+					if patchOptions.Force == nil || !*patchOptions.Force {
+						return errors.NewConflict(hivev1.Resource("clusterimagesets"), obj.GetName(),
+							fmt.Errorf("conflict with \"admin\": .spec.releaseImage"))
+					}
+
+					return applyPatch(ctx, c, obj, patch, opts...)
+				},
+			})
+
+			zapLog, _ := zap.NewDevelopment()
+			iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+				Log:        zapr.NewLogger(zapLog),
+				Interval:   60,
+				ConfigMap:  "cluster-image-set-git-repo",
+				ForceApply: tt.forceApply,
+			})
+
+			imagesets, err := iCtrl.loadClusterImageSetFile("imageset.yaml",
+				[]byte(getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64")))
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			_, err = iCtrl.applyClusterImageSet(imagesets[0])
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyClusterImageSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				g.Expect(err.Error()).To(gomega.ContainSubstring("--force-apply"))
+				g.Expect(errors.IsConflict(err)).To(gomega.BeTrue())
+			}
+		})
+	}
+}
+
+func TestApplyClusterImageSetUpgradeManagedFields(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// An earlier version of the controller created the clusterImageSet with an update
+	c := initClient()
+	g.Expect(c.Create(context.TODO(), &hivev1.ClusterImageSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "img4.11.0-x86-64-appsub",
+			Labels: map[string]string{util.ChannelLabel: "fast"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:    LegacyFieldManager,
+				Operation:  metav1.ManagedFieldsOperationUpdate,
+				APIVersion: hivev1.SchemeGroupVersion.String(),
+				FieldsType: "FieldsV1",
+				FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:spec":{".":{},"f:releaseImage":{}}}`)},
+			}},
+		},
+		Spec: hivev1.ClusterImageSetSpec{ReleaseImage: "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"},
+	})).To(gomega.Succeed())
+
+	// The apply conflicts with the fields owned by the updates
+	c = interceptor.NewClient(c.(client.WithWatch), interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if patch.Type() == types.ApplyPatchType {
+				existing := &hivev1.ClusterImageSet{}
+				g.Expect(c.Get(ctx, client.ObjectKeyFromObject(obj), existing)).To(gomega.Succeed())
+				for _, entry := range existing.GetManagedFields() {
+					if entry.Operation == metav1.ManagedFieldsOperationUpdate {
+						return errors.NewConflict(hivev1.Resource("clusterimagesets"), obj.GetName(),
+							fmt.Errorf("conflict with %q using %v: .spec.releaseImage", entry.Manager, entry.APIVersion))
+					}
+				}
+			}
+
+			return applyPatch(ctx, c, obj, patch, opts...)
+		},
+	})
+
+	zapLog, _ := zap.NewDevelopment()
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:       zapr.NewLogger(zapLog),
+		Interval:  60,
+		ConfigMap: "cluster-image-set-git-repo",
+	})
+
+	imagesets, err := iCtrl.loadClusterImageSetFile("imageset.yaml",
+		[]byte(getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.1-x86_64")))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	_, err = iCtrl.applyClusterImageSet(imagesets[0])
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	imageset := &hivev1.ClusterImageSet{}
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.0-x86-64-appsub"}, imageset)).To(gomega.Succeed())
+	g.Expect(imageset.Spec.ReleaseImage).To(gomega.Equal("quay.io/openshift-release-dev/ocp-release:4.11.1-x86_64"))
+	g.Expect(imageset.GetManagedFields()).To(gomega.HaveLen(1))
+	g.Expect(imageset.GetManagedFields()[0].Manager).To(gomega.Equal(FieldManager))
+	g.Expect(imageset.GetManagedFields()[0].Operation).To(gomega.Equal(metav1.ManagedFieldsOperationApply))
+}
+
+func TestLoadClusterImageSetFile(t *testing.T) {
+	iCtrl, err := getImageSetController()
+	if err != nil {
+		t.Fatalf("failed to create the controller: %v", err)
+	}
+
+	img410 := getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64")
+	img411 := getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64")
+
+	tests := []struct {
+		name      string
+		file      string
+		strict    bool
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "single document",
+			file:      img410,
+			wantNames: []string{"img4.10.0-x86-64-appsub"},
+		},
+		{
+			name:      "multiple documents",
+			file:      "---\n" + img410 + "\n---\n# comment only\n---\n" + img411 + "\n---\n",
+			wantNames: []string{"img4.10.0-x86-64-appsub", "img4.11.0-x86-64-appsub"},
+		},
+		{
+			name: "list",
+			file: `apiVersion: v1
+kind: List
+items:
+- apiVersion: hive.openshift.io/v1
+  kind: ClusterImageSet
+  metadata:
+    name: img4.10.0-x86-64-appsub
+  spec:
+    releaseImage: quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64
+- apiVersion: hive.openshift.io/v1
+  kind: ClusterImageSet
+  metadata:
+    name: img4.11.0-x86-64-appsub
+  spec:
+    releaseImage: quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64
+`,
+			wantNames: []string{"img4.10.0-x86-64-appsub", "img4.11.0-x86-64-appsub"},
+		},
+		{
+			name: "clusterImageSet list and document",
+			file: img410 + `
+---
+apiVersion: hive.openshift.io/v1
+kind: ClusterImageSetList
+items:
+- metadata:
+    name: img4.11.0-x86-64-appsub
+  spec:
+    releaseImage: quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64
+`,
+			wantNames: []string{"img4.10.0-x86-64-appsub", "img4.11.0-x86-64-appsub"},
+		},
+		{
+			name:    "invalid document",
+			file:    img410 + "\n---\nbad$:xys\n",
+			wantErr: "invalid document 2 of imagesets.yaml",
+		},
+		{
+			name: "invalid list item",
+			file: `apiVersion: v1
+kind: List
+items:
+- apiVersion: hive.openshift.io/v1
+  kind: ClusterImageSet
+  metadata:
+    name: img4.10.0-x86-64-appsub
+  spec:
+    releaseImage: quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64
+- spec: invalid
+`,
+			wantErr: "invalid document 1 of imagesets.yaml: item 2 of List",
+		},
+		{
+			name:    "list item without kind",
+			file:    "apiVersion: v1\nkind: List\nitems:\n- metadata:\n    name: img4.10.0-x86-64-appsub\n",
+			wantErr: `item 1 of List: unsupported apiVersion "" and kind ""`,
+		},
+		{
+			name:    "configmap",
+			file:    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: releases\ndata:\n  key: value\n",
+			wantErr: `unsupported apiVersion "v1" and kind "ConfigMap"`,
+		},
+		{
+			name:    "markdown",
+			file:    "# Releases\n\nThe clusterImageSets of the fast channel.\n",
+			wantErr: "invalid document 1 of imagesets.yaml",
+		},
+		{
+			name:    "missing name",
+			file:    getClusterImageSetYAML("", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+			wantErr: "metadata.name is required",
+		},
+		{
+			name:    "invalid name",
+			file:    getClusterImageSetYAML("img4.10.0_X86", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+			wantErr: `invalid metadata.name "img4.10.0_X86"`,
+		},
+		{
+			name:    "missing release image",
+			file:    getClusterImageSetYAML("img4.10.0-x86-64-appsub", `""`),
+			wantErr: "spec.releaseImage of clusterImageSet img4.10.0-x86-64-appsub is required",
+		},
+		{
+			name:    "invalid release image",
+			file:    getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/OCP-release:4.10.0 x86_64"),
+			wantErr: "invalid spec.releaseImage of clusterImageSet img4.10.0-x86-64-appsub",
+		},
+		{
+			name:      "unknown field",
+			file:      img410 + "  releaseImages: quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64\n",
+			wantNames: []string{"img4.10.0-x86-64-appsub"},
+		},
+		{
+			name:    "unknown field in strict mode",
+			file:    img410 + "  releaseImages: quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64\n",
+			strict:  true,
+			wantErr: `unknown field "releaseImages"`,
+		},
+		{
+			name:    "unknown list field in strict mode",
+			file:    "apiVersion: v1\nkind: List\nitem: []\n",
+			strict:  true,
+			wantErr: `unknown field "item"`,
+		},
+		{
+			name:      "strict mode",
+			file:      img410,
+			strict:    true,
+			wantNames: []string{"img4.10.0-x86-64-appsub"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iCtrl.strictManifests = tt.strict
+			imagesets, err := iCtrl.loadClusterImageSetFile("imagesets.yaml", []byte(tt.file))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadClusterImageSetFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadClusterImageSetFile() error = %v", err)
+			}
+
+			names := []string{}
+			for _, imageset := range imagesets {
+				names = append(names, imageset.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("loadClusterImageSetFile() = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
 func TestSyncCommand(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
 
@@ -206,6 +770,19 @@ func getImageSetController() (*ClusterImageSetController, error) {
 	return NewClusterImageSetController(client, options), nil
 }
 
+func getClusterImageSetYAML(name, releaseImage string) string {
+	return fmt.Sprintf(`apiVersion: hive.openshift.io/v1
+kind: ClusterImageSet
+metadata:
+  labels:
+    channel: fast
+    visible: "true"
+  name: %s
+spec:
+  releaseImage: %s
+`, name, releaseImage)
+}
+
 func getConfigMap(gitRepoUrl, gitRepoBranch, gitRepoPath, channel string) *corev1.ConfigMap {
 	data := map[string]string{
 		"gitRepoUrl":    gitRepoUrl,
@@ -247,15 +824,45 @@ func getSecret(name string, user, accessToken, key, cert []byte) *corev1.Secret
 	}
 }
 
+func getTypedSecret(name string, secretType corev1.SecretType, data map[string]string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "multicluster-engine",
+		},
+		Type: secretType,
+		Data: map[string][]byte{},
+	}
+
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+
+	return secret
+}
+
 func initClient() client.Client {
 	scheme := runtime.NewScheme()
 
 	metav1.AddMetaToScheme(scheme)
 	hivev1.AddToScheme(scheme)
 	corev1.AddToScheme(scheme)
+	configv1.AddToScheme(scheme)
 
 	ncb := fake.NewClientBuilder()
 	ncb.WithScheme(scheme)
+	ncb.WithInterceptorFuncs(interceptor.Funcs{Patch: applyPatch})
 	return ncb.Build()
 
 }
+
+// applyPatch creates the object of a server-side apply when it does not exist, the fake client
+// only applies to existing objects
+func applyPatch(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	err := c.Patch(ctx, obj, patch, opts...)
+	if patch.Type() == types.ApplyPatchType && errors.IsNotFound(err) {
+		return c.Create(ctx, obj)
+	}
+
+	return err
+}
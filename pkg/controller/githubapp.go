@@ -0,0 +1,185 @@
+package clusterimageset
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Secret data for GitHub App authentication
+	GitHubAppID             = "githubAppID"
+	GitHubAppInstallationID = "githubAppInstallationID"
+	GitHubAppPrivateKey     = "githubAppPrivateKey"
+
+	// GitHub App configuration (in configmap)
+	GitHubAPIUrl = "githubApiUrl"
+
+	// Default values
+	DefaultGitHubAPIUrl = "https://api.github.com"
+
+	// githubAppTokenUser is the user name of the installation tokens in Git requests
+	githubAppTokenUser = "x-access-token"
+	// githubAppTokenRefresh is how long before its expiry an installation token is renewed
+	githubAppTokenRefresh = 5 * time.Minute
+)
+
+// githubAppToken is an installation token, valid until expiresAt
+type githubAppToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// githubAppTokens caches the installation tokens by API URL, app ID, installation ID and private
+// key, so that a token is only minted when the previous one is about to expire.
+var githubAppTokens = struct {
+	sync.Mutex
+	tokens map[string]*githubAppToken
+}{tokens: map[string]*githubAppToken{}}
+
+// getGitHubAppToken returns an installation token of the GitHub App, minting a new one with
+// the app private key when the cached token is missing or about to expire.
+func getGitHubAppToken(httpClient *http.Client, apiURL string, auth *sourceAuth) (string, error) {
+	keyDigest := sha256.Sum256(auth.githubAppPrivateKey)
+	key := strings.Join([]string{apiURL, auth.githubAppID, auth.githubAppInstallationID, hex.EncodeToString(keyDigest[:])}, "/")
+
+	githubAppTokens.Lock()
+	defer githubAppTokens.Unlock()
+
+	if token, ok := githubAppTokens.tokens[key]; ok && time.Until(token.ExpiresAt) > githubAppTokenRefresh {
+		return token.Token, nil
+	}
+
+	jwt, err := newGitHubAppJWT(auth.githubAppID, auth.githubAppPrivateKey, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	tokenURL := fmt.Sprintf("%s/app/installations/%s/access_tokens",
+		strings.TrimSuffix(apiURL, "/"), url.PathEscape(auth.githubAppInstallationID))
+	req, err := http.NewRequest(http.MethodPost, tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		message := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(body, &message)
+
+		return "", fmt.Errorf("failed to create an installation token of GitHub App %s: %s %s",
+			auth.githubAppID, resp.Status, message.Message)
+	}
+
+	token := &githubAppToken{}
+	if err := json.Unmarshal(body, token); err != nil || token.Token == "" {
+		return "", fmt.Errorf("invalid installation token of GitHub App %s from %s", auth.githubAppID, tokenURL)
+	}
+
+	githubAppTokens.tokens[key] = token
+
+	return token.Token, nil
+}
+
+// newGitHubAppJWT returns the JSON Web Token that authenticates as the GitHub App, signed
+// with RS256 by its private key
+func newGitHubAppJWT(appID string, privateKey []byte, now time.Time) (string, error) {
+	key, err := parseRSAPrivateKey(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %w", GitHubAppPrivateKey, err)
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	// Allow for clock drift, GitHub rejects tokens issued in the future or valid for more
+	// than 10 minutes
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA private key
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
+
+// getGitHubAPIURL returns the GitHub API URL of the Git repository URL in use, which is a
+// fallback URL after a failover. GitHub Enterprise Server serves its API under /api/v3 of the
+// Git host.
+func getGitHubAPIURL(config *sourceConfig, repoURL string) string {
+	if config.githubApiUrl != "" {
+		return config.githubApiUrl
+	}
+
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" || strings.EqualFold(u.Hostname(), "github.com") {
+		return DefaultGitHubAPIUrl
+	}
+
+	return fmt.Sprintf("https://%s/api/v3", u.Host)
+}
@@ -0,0 +1,295 @@
+package clusterimageset
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGitHTTPTokenAuth(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	appKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate the GitHub App key: %v", err)
+	}
+	appKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(appKey)})
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate the GitHub App key: %v", err)
+	}
+	otherKeyDER, _ := x509.MarshalPKCS8PrivateKey(otherKey)
+	otherKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: otherKeyDER})
+
+	gitRoot := t.TempDir()
+	commit := commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+	gitServer := newGitHTTPServer(t, gitRoot)
+
+	// The GitHub API mints installation tokens for the app JWTs signed by the app key
+	var tokens int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/42/access_tokens" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := verifyGitHubAppJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), "1234", &appKey.PublicKey); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"A JSON web token could not be decoded"}`))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"token":      fmt.Sprintf("ghs_%d", atomic.AddInt32(&tokens, 1)),
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	}))
+	defer apiServer.Close()
+
+	// The Git server only accepts the bearer token, or the first installation token
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" && !(ok && user == "x-access-token" && password == "ghs_1") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		gitServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		wantErr bool
+	}{
+		{
+			name: "bearer token",
+			data: map[string][]byte{BearerToken: []byte("s3cr3t\n")},
+		},
+		{
+			name:    "wrong bearer token",
+			data:    map[string][]byte{BearerToken: []byte("wrong")},
+			wantErr: true,
+		},
+		{
+			name: "bearer token over basic auth",
+			data: map[string][]byte{BearerToken: []byte("s3cr3t"), UserID: []byte("user"), AccessToken: []byte("wrong")},
+		},
+		{
+			name: "GitHub App",
+			data: map[string][]byte{
+				GitHubAppID:             []byte("1234"),
+				GitHubAppInstallationID: []byte("42"),
+				GitHubAppPrivateKey:     appKeyPEM,
+			},
+		},
+		{
+			name: "GitHub App signed by another key",
+			data: map[string][]byte{
+				GitHubAppID:             []byte("1234"),
+				GitHubAppInstallationID: []byte("42"),
+				GitHubAppPrivateKey:     otherKeyPEM,
+			},
+			wantErr: true,
+		},
+		{
+			name: "GitHub App without private key",
+			data: map[string][]byte{
+				GitHubAppID:             []byte("1234"),
+				GitHubAppInstallationID: []byte("42"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "GitHub App with invalid installation ID",
+			data: map[string][]byte{
+				GitHubAppID:             []byte("1234"),
+				GitHubAppInstallationID: []byte("installation"),
+				GitHubAppPrivateKey:     appKeyPEM,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+			configMap.Data[GitHubAPIUrl] = apiServer.URL
+			configMap.Data[Retries] = "0"
+			g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+			g.Expect(c.Create(context.TODO(), &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: getPodNamespace()},
+				Data:       tt.data,
+			})).To(gomega.Succeed())
+
+			s := newGitSource(c, log, configMap.Name, "secret", t.TempDir())
+
+			content, err := s.Fetch()
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(content.Revision).To(gomega.Equal(commit))
+
+			// The installation token is reused until it is about to expire
+			revision, err := s.Revision()
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(revision).To(gomega.Equal(commit))
+		})
+	}
+
+	if minted := atomic.LoadInt32(&tokens); minted != 1 {
+		t.Errorf("installation tokens minted = %v, want 1", minted)
+	}
+}
+
+func TestGetGitHubAppToken(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	appKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	// The first token expires within the refresh margin, the second one is renewed
+	var tokens int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokens, 1)
+		expiry := time.Hour
+		if n == 1 {
+			expiry = time.Minute
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"token":      fmt.Sprintf("ghs_%d", n),
+			"expires_at": time.Now().Add(expiry).UTC().Format(time.RFC3339),
+		})
+	}))
+	defer apiServer.Close()
+
+	auth := &sourceAuth{
+		githubAppID:             "5678",
+		githubAppInstallationID: "7",
+		githubAppPrivateKey:     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(appKey)}),
+	}
+
+	for _, want := range []string{"ghs_1", "ghs_2", "ghs_2"} {
+		token, err := getGitHubAppToken(http.DefaultClient, apiServer.URL, auth)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(token).To(gomega.Equal(want))
+	}
+}
+
+func TestGetGitHubAPIURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *sourceConfig
+		repoURL string
+		want    string
+	}{
+		{
+			name:   "github.com",
+			config: &sourceConfig{url: "https://github.com/stolostron/acm-hive-openshift-releases.git"},
+			want:   DefaultGitHubAPIUrl,
+		},
+		{
+			name:   "GitHub Enterprise Server",
+			config: &sourceConfig{url: "https://github.example.com/releases/imagesets.git"},
+			want:   "https://github.example.com/api/v3",
+		},
+		{
+			name:   "configured API URL",
+			config: &sourceConfig{url: "https://github.example.com/releases/imagesets.git", githubApiUrl: "https://api.example.com"},
+			want:   "https://api.example.com",
+		},
+		{
+			name: "fallback URL",
+			config: &sourceConfig{
+				url:          "https://github.example.com/releases/imagesets.git",
+				fallbackUrls: []string{"https://github.com/stolostron/acm-hive-openshift-releases.git"},
+			},
+			repoURL: "https://github.com/stolostron/acm-hive-openshift-releases.git",
+			want:    DefaultGitHubAPIUrl,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoURL := tt.repoURL
+			if repoURL == "" {
+				repoURL = tt.config.url
+			}
+
+			if got := getGitHubAPIURL(tt.config, repoURL); got != tt.want {
+				t.Errorf("getGitHubAPIURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// verifyGitHubAppJWT checks the RS256 signature, the issuer and the validity of a GitHub App JWT
+func verifyGitHubAppJWT(jwt, appID string, key *rsa.PublicKey) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+
+	claims := struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if claims.Issuer != appID || claims.IssuedAt > now || claims.ExpiresAt < now || claims.ExpiresAt-claims.IssuedAt > 600 {
+		return fmt.Errorf("invalid JWT claims %+v", claims)
+	}
+
+	return nil
+}
@@ -2,27 +2,39 @@ package clusterimageset
 
 import (
 	"bytes"
-	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	goerrors "errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net/http"
+	"net"
 	"os"
-	"strconv"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
-	"time"
 
-	"github.com/ghodss/yaml"
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gopkg.in/src-d/go-git.v4"
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	gitclient "gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
 	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
@@ -31,281 +43,986 @@ const (
 	AccessToken = "accessToken"
 	ClientKey   = "clientKey"
 	ClientCert  = "clientCert"
+	BearerToken = "bearerToken"
+
+	// Secret data for Git authentication over SSH
+	SSHPrivateKey = "sshPrivateKey"
+	SSHPassphrase = "sshPassphrase"
 
 	// Git repo configurations (in configmap)
-	GitRepoUrl         = "gitRepoUrl"
-	GitRepoBranch      = "gitRepoBranch"
-	GitRepoPath        = "gitRepoPath"
-	Channel            = "channel"
-	CaCerts            = "caCerts"
-	InsecureSkipVerify = "insecureSkipVerify"
+	GitRepoUrl               = "gitRepoUrl"
+	GitRepoFallbackUrls      = "gitRepoFallbackUrls"
+	GitRepoBranch            = "gitRepoBranch"
+	GitRepoRef               = "gitRepoRef"
+	GitRepoTagPattern        = "gitRepoTagPattern"
+	GitRepoPath              = "gitRepoPath"
+	GitRepoDepth             = "gitRepoDepth"
+	GitRepoSubmodules        = "gitRepoSubmodules"
+	Channel                  = "channel"
+	CaCerts                  = "caCerts"
+	InsecureSkipVerify       = "insecureSkipVerify"
+	GitSecret                = "gitSecret"
+	SSHKnownHosts            = "sshKnownHosts"
+	SSHStrictHostKeyChecking = "sshStrictHostKeyChecking"
 
 	// Default values
+	// DefaultGitConfigMap is the legacy source configmap, the default Git repository is synced
+	// when it does not exist
+	DefaultGitConfigMap  = "cluster-image-set-git-repo"
 	DefaultGitRepoUrl    = "https://github.com/stolostron/acm-hive-openshift-releases.git"
 	DefaultGitRepoBranch = "backplane-2.8"
 	DefaultGitRepoPath   = "clusterImageSets"
 	DefaultChannel       = "fast"
+	DefaultGitRepoDepth  = 1
+	DefaultSSHUser       = "git"
+	DefaultCacheDirName  = "cluster-imageset-cache"
+
+	gitmodulesFile = ".gitmodules"
 )
 
-func (r *ClusterImageSetController) getLastCommitID() (string, error) {
-	tempDir, err := ioutil.TempDir(os.TempDir(), "cluster-imageset-")
+// gitSource is a Git repository that provides clusterImageSets, configured by a configmap
+// and an optional secret in the pod namespace.
+type gitSource struct {
+	client    client.Client
+	log       logr.Logger
+	configMap string
+	secret    string
+	cacheDir  string
+}
+
+func newGitSource(c client.Client, log logr.Logger, configMap, secret, cacheDir string) *gitSource {
+	return &gitSource{
+		client:    c,
+		log:       log.WithValues("source", configMap),
+		configMap: configMap,
+		secret:    secret,
+		cacheDir:  cacheDir,
+	}
+}
+
+func (s *gitSource) Name() string {
+	return s.configMap
+}
+
+// Revision returns the commit ID of the configured reference, without fetching the repository
+func (s *gitSource) Revision() (string, error) {
+	config, err := s.getGitRepoConfig()
 	if err != nil {
 		return "", err
 	}
-	defer os.RemoveAll(tempDir)
 
-	repo, err := r.cloneGitRepo(tempDir, true)
+	revision := ""
+	err = retryOperation(s.log, config, "listing Git repository references", func() error {
+		revision, err = s.getLastCommitID(config)
+		return err
+	})
+
+	return revision, err
+}
+
+// Fetch syncs the local Git repository and returns the files of the channel directory. The
+// configuration is read once, and used for the whole fetch.
+func (s *gitSource) Fetch() (*SourceContent, error) {
+	config, err := s.getGitRepoConfig()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	ref, err := repo.Head()
+	var repo *git.Repository
+	var ref *gitRepoRef
+	err = retryOperation(s.log, config, "syncing Git repository", func() error {
+		repo, ref, err = s.syncGitRepo(config)
+		return err
+	})
 	if err != nil {
-		r.log.Info(fmt.Sprintf("failed to get git repo head: %v", err.Error()))
-		return "", err
+		return nil, err
 	}
 
-	lastCommit, err := repo.CommitObject(ref.Hash())
+	s.log.Info(fmt.Sprintf("synced %v from Git repository %s", ref, ref.url))
+
+	// Refuse to load the clusterImageSets of a revision that is not signed by a trusted key
+	verifiedBy := ""
+	if config.verifySignature != "" {
+		verifiedBy, err = verifyGitRepoSignature(s.client, s.log, config, repo, ref)
+		if err != nil {
+			if sigErr, ok := err.(*signatureError); ok {
+				signatureVerificationFailures.WithLabelValues(s.configMap, sigErr.reason).Inc()
+			}
+			s.log.Info(fmt.Sprintf("signature verification of %v failed: %v", ref, err.Error()))
+			return nil, err
+		}
+
+		s.log.Info(fmt.Sprintf("signature of %v verified, signed by %v", ref, verifiedBy))
+	}
+
+	resourcePath := filepath.Join(s.getGitRepoDir(), config.path, config.channel)
+	s.log.Info(fmt.Sprintf("loading clusterImageSets from path: %v", resourcePath))
+
+	manifests, err := readManifests(resourcePath, newManifestFilter(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SourceContent{Revision: ref.hash.String(), Manifests: manifests, VerifiedBy: verifiedBy, URL: ref.url}, nil
+}
+
+// gitRepoRef is the reference of the Git repository to sync, resolved from the configmap
+type gitRepoRef struct {
+	// name is the branch or tag reference, it is empty when the sync is pinned to a commit ID
+	name plumbing.ReferenceName
+	// hash is the commit ID, or the tag object ID of an annotated tag
+	hash plumbing.Hash
+	// url is the URL of the Git repository the reference was resolved from
+	url string
+}
+
+func (ref *gitRepoRef) String() string {
+	if ref.name == "" {
+		return ref.hash.String()
+	}
+
+	return fmt.Sprintf("%s (%s)", ref.name.Short(), ref.hash)
+}
+
+// getLastCommitID returns the commit ID of the configured reference from the references
+// advertised by the remote Git repository (like git ls-remote), without fetching any objects.
+func (s *gitSource) getLastCommitID(config *sourceConfig) (string, error) {
+	var ref *gitRepoRef
+	err := s.withGitRepoURLs(config, func(options *git.CloneOptions) error {
+		var err error
+		ref, err = s.resolveGitRepoRef(config, options)
+		return err
+	})
 	if err != nil {
-		r.log.Info(fmt.Sprintf("failed to get the last commit ID: %v", err.Error()))
 		return "", err
 	}
 
-	return lastCommit.ID().String(), nil
+	return ref.hash.String(), nil
+}
+
+// withGitRepoURLs runs the operation with the clone options of each URL of the Git repository,
+// in priority order, until it succeeds. It only fails over to the next URL on the network and
+// authentication errors that the next URL may not have.
+func (s *gitSource) withGitRepoURLs(config *sourceConfig, operation func(options *git.CloneOptions) error) error {
+	urls := config.gitRepoURLs()
+	for i, repoURL := range urls {
+		options, err := s.getCloneOptions(config, repoURL)
+		if err == nil {
+			err = operation(options)
+		}
+
+		if err == nil || i == len(urls)-1 || !isFailoverError(err) {
+			return err
+		}
+
+		s.log.Info(fmt.Sprintf("failed to access Git repository %s: %v, failing over to %s", repoURL, err.Error(), urls[i+1]))
+	}
+
+	return nil
+}
+
+// isFailoverError returns true for the errors that another URL of the Git repository may not
+// have: network errors, and authentication and authorization failures.
+func isFailoverError(err error) bool {
+	if isRetryableError(err) {
+		return true
+	}
+
+	if goerrors.Is(err, transport.ErrAuthenticationRequired) || goerrors.Is(err, transport.ErrAuthorizationFailed) ||
+		goerrors.Is(err, transport.ErrRepositoryNotFound) {
+		return true
+	}
+
+	// The SSH handshake fails when the server accepts none of the keys
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// resolveGitRepoRef resolves the reference to sync from the configmap. gitRepoRef takes
+// precedence over gitRepoTagPattern, which takes precedence over gitRepoBranch.
+func (s *gitSource) resolveGitRepoRef(config *sourceConfig, options *git.CloneOptions) (*gitRepoRef, error) {
+	// A commit ID is pinned, there is nothing to look up
+	if isCommitID(config.ref) {
+		return &gitRepoRef{hash: plumbing.NewHash(config.ref), url: options.URL}, nil
+	}
+
+	refs, err := s.listGitRepoRefs(config, options)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case config.ref != "":
+		candidates := []plumbing.ReferenceName{plumbing.ReferenceName(config.ref)}
+		if !strings.HasPrefix(config.ref, "refs/") {
+			candidates = []plumbing.ReferenceName{
+				plumbing.NewBranchReferenceName(config.ref),
+				plumbing.NewTagReferenceName(config.ref),
+			}
+		}
+
+		for _, candidate := range candidates {
+			if hash, ok := refs[candidate]; ok {
+				return &gitRepoRef{name: candidate, hash: hash, url: options.URL}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("reference %s not found in Git repository %s", config.ref, options.URL)
+
+	case config.tagPattern != "":
+		var newest plumbing.ReferenceName
+		for name := range refs {
+			if !name.IsTag() {
+				continue
+			}
+
+			matched, err := path.Match(config.tagPattern, name.Short())
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", GitRepoTagPattern, config.tagPattern, err)
+			}
+
+			if matched && (newest == "" || compareVersions(name.Short(), newest.Short()) > 0) {
+				newest = name
+			}
+		}
+
+		if newest == "" {
+			return nil, fmt.Errorf("no tag matching %s found in Git repository %s", config.tagPattern, options.URL)
+		}
+
+		s.log.Info(fmt.Sprintf("newest tag matching %s is %s", config.tagPattern, newest.Short()))
+
+		return &gitRepoRef{name: newest, hash: refs[newest], url: options.URL}, nil
+
+	default:
+		branch := plumbing.NewBranchReferenceName(config.branch)
+		if hash, ok := refs[branch]; ok {
+			return &gitRepoRef{name: branch, hash: hash, url: options.URL}, nil
+		}
+
+		return nil, fmt.Errorf("branch %s not found in Git repository %s", config.branch, options.URL)
+	}
+}
+
+// listGitRepoRefs returns the references advertised by the remote Git repository, within the
+// total timeout of a Git operation
+func (s *gitSource) listGitRepoRefs(config *sourceConfig, options *git.CloneOptions) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{options.URL},
+	})
+
+	ctx, cancel := newOperationContext(config)
+	defer cancel()
+
+	// go-git lists the references without a context, a remote that hangs is left behind
+	type listResult struct {
+		refs []*plumbing.Reference
+		err  error
+	}
+	results := make(chan listResult, 1)
+	go func() {
+		refs, err := remote.List(&git.ListOptions{Auth: options.Auth})
+		results <- listResult{refs: refs, err: err}
+	}()
+
+	var refs []*plumbing.Reference
+	var err error
+	select {
+	case result := <-results:
+		refs, err = result.refs, result.err
+	case <-ctx.Done():
+		err = fmt.Errorf("failed to list Git repository references of %s: %w", options.URL, ctx.Err())
+	}
+	if err != nil {
+		s.log.Info(fmt.Sprintf("failed to list Git repository references: %v", err.Error()))
+		return nil, err
+	}
+
+	refHashes := map[plumbing.ReferenceName]plumbing.Hash{}
+	for _, ref := range refs {
+		if ref.Type() == plumbing.HashReference {
+			refHashes[ref.Name()] = ref.Hash()
+		}
+	}
+
+	return refHashes, nil
+}
+
+// syncGitRepo fetches the configured reference into the local working copy and fast-forwards
+// the working copy to it. The working copy is cloned again if it is missing or corrupted.
+// It returns the resolved reference, whose hash is the revision that was checked out.
+func (s *gitSource) syncGitRepo(config *sourceConfig) (*git.Repository, *gitRepoRef, error) {
+	var repo *git.Repository
+	var ref *gitRepoRef
+	err := s.withGitRepoURLs(config, func(options *git.CloneOptions) error {
+		var err error
+		repo, ref, err = s.syncGitRepoURL(config, options)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return repo, ref, nil
 }
 
-func (r *ClusterImageSetController) cloneGitRepo(destDir string, noCheckOut bool) (*git.Repository, error) {
-	options, err := r.getHTTPOptions()
+// syncGitRepoURL syncs the local working copy from the Git repository URL of the options
+func (s *gitSource) syncGitRepoURL(config *sourceConfig, options *git.CloneOptions) (*git.Repository, *gitRepoRef, error) {
+	ref, err := s.resolveGitRepoRef(config, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repoDir := s.getGitRepoDir()
+
+	repo, err := s.openGitRepo(config, repoDir, options)
+	if err == nil {
+		err = s.fetchGitRepo(config, repo, options, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err = s.checkoutGitRepo(config, repo, options, ref); err == nil {
+			return repo, ref, nil
+		}
+
+		s.log.Info(fmt.Sprintf("failed to update the local Git repository: %v, re-cloning", err.Error()))
+	} else {
+		s.log.Info(fmt.Sprintf("local Git repository is not usable: %v, cloning", err.Error()))
+	}
+
+	repo, err = s.cloneGitRepo(config, repoDir, options, ref)
+	if err != nil {
+		// Do not leave a partial clone behind
+		_ = os.RemoveAll(repoDir)
+		return nil, nil, err
+	}
+
+	return repo, ref, nil
+}
+
+// openGitRepo opens the local working copy and checks that it tracks the configured
+// repository and that its HEAD commit can be read.
+func (s *gitSource) openGitRepo(config *sourceConfig, repoDir string, options *git.CloneOptions) (*git.Repository, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := repo.Remote(git.DefaultRemoteName)
 	if err != nil {
 		return nil, err
 	}
 
-	options.NoCheckout = noCheckOut
+	if urls := remote.Config().URLs; len(urls) == 0 || urls[0] != options.URL {
+		if len(urls) == 0 || !config.isGitRepoURL(urls[0]) {
+			return nil, fmt.Errorf("the local Git repository does not track %s", options.URL)
+		}
 
-	r.log.Info(fmt.Sprintf("cloning Git repository:%s, branch:%v to directory:%s, no-checkout:%v", options.URL, options.ReferenceName, destDir, noCheckOut))
+		// The working copy was synced from another URL of the same repository
+		if err := setGitRepoRemoteURL(repo, options.URL); err != nil {
+			return nil, err
+		}
+	}
 
-	repository, err := git.PlainClone(destDir, false, options)
+	head, err := repo.Head()
 	if err != nil {
-		return repository, err
+		return nil, err
 	}
 
-	return repository, nil
+	if _, err := repo.CommitObject(head.Hash()); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
 }
 
-func (r *ClusterImageSetController) getHTTPOptions() (*git.CloneOptions, error) {
-	gitRepoUrl, gitRepoBranch, _, _, caCerts, insecureSkipVerify, err := r.getGitRepoConfig()
+// setGitRepoRemoteURL changes the URL that the local working copy fetches from
+func setGitRepoRemoteURL(repo *git.Repository, repoURL string) error {
+	cfg, err := repo.Storer.Config()
 	if err != nil {
+		return err
+	}
+
+	remote, ok := cfg.Remotes[git.DefaultRemoteName]
+	if !ok {
+		return fmt.Errorf("the local Git repository has no %s remote", git.DefaultRemoteName)
+	}
+	remote.URLs = []string{repoURL}
+
+	return repo.Storer.SetConfig(cfg)
+}
+
+// cloneGitRepo initializes a new local working copy in destDir, replacing any existing one,
+// and checks out the given reference.
+func (s *gitSource) cloneGitRepo(config *sourceConfig, destDir string, options *git.CloneOptions, ref *gitRepoRef) (*git.Repository, error) {
+	s.log.Info(fmt.Sprintf("cloning Git repository:%s, reference:%v to directory:%s", options.URL, ref, destDir))
+
+	if err := os.RemoveAll(destDir); err != nil {
 		return nil, err
 	}
 
-	options := &git.CloneOptions{
-		URL:               gitRepoUrl,
-		SingleBranch:      true,
-		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		ReferenceName:     plumbing.NewBranchReferenceName(gitRepoBranch),
+	repo, err := git.PlainInit(destDir, false)
+	if err != nil {
+		return nil, err
 	}
 
-	user, accessToken, clientKey, clientCert, err := r.getGitRepoAuthFromSecret()
+	_, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{options.URL},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if user != "" && accessToken != "" {
-		options.Auth = &githttp.BasicAuth{
-			Username: user,
-			Password: accessToken,
-		}
+	if err := s.fetchGitRepo(config, repo, options, ref); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkoutGitRepo(config, repo, options, ref); err != nil {
+		return nil, err
 	}
 
-	installProtocol := false
-	clientConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	return repo, nil
+}
 
-	// skip TLS certificate verification for Git servers with custom or self-signed certs
-	if insecureSkipVerify {
-		r.log.Info("insecureSkipVerify = true, skipping Git server's certificate verification.")
+// fetchGitRepo fetches the given reference into the local working copy, without updating
+// the working tree.
+func (s *gitSource) fetchGitRepo(config *sourceConfig, repo *git.Repository, options *git.CloneOptions, ref *gitRepoRef) error {
+	var refSpecs []gitconfig.RefSpec
 
-		clientConfig.InsecureSkipVerify = true
-		installProtocol = true
-	} else if !strings.EqualFold(caCerts, "") {
-		r.log.Info("adding Git server's CA certificate to trust certificate pool")
+	// Only the commit of a branch or tag is needed, a pinned commit ID may be anywhere in
+	// the history
+	depth := options.Depth
 
-		// Load the host's trusted certs into memory
-		certPool, _ := x509.SystemCertPool()
-		if certPool == nil {
-			certPool = x509.NewCertPool()
+	switch {
+	case ref.name.IsBranch():
+		remoteRef := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, ref.name.Short())
+		refSpecs = []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref.name, remoteRef))}
+	case ref.name.IsTag():
+		refSpecs = []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref.name, ref.name))}
+	default:
+		// A commit ID cannot be fetched directly, fetch all branches and tags unless it is already here
+		if _, err := repo.CommitObject(ref.hash); err == nil {
+			return nil
 		}
 
-		certChain := getCertChain(caCerts)
-		if len(certChain.Certificate) == 0 {
-			r.log.Info("no certificate found")
+		refSpecs = []gitconfig.RefSpec{
+			gitconfig.RefSpec("+refs/heads/*:refs/remotes/origin/*"),
+			gitconfig.RefSpec("+refs/tags/*:refs/tags/*"),
 		}
+		depth = 0
+	}
 
-		// Add CA certs from the config map to the cert pool
-		// It will not add duplicate certs
-		for _, cert := range certChain.Certificate {
-			x509Cert, err := x509.ParseCertificate(cert)
-			if err != nil {
-				return options, err
-			}
-			r.log.V(4).Info("adding certificate -->" + x509Cert.Subject.String())
-			certPool.AddCert(x509Cert)
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return err
+	}
+
+	// go-git cannot negotiate a fetch from the commits of a shallow working copy, whose parents
+	// are missing, the new revision is fetched at depth into the working copy without negotiation
+	if shallow, err := repo.Storer.Shallow(); err == nil && len(shallow) > 0 {
+		remote = git.NewRemote(&shallowFetchStorer{Storer: repo.Storer}, remote.Config())
+	}
+
+	s.log.Info(fmt.Sprintf("fetching Git repository:%s, reference:%v, depth:%d", options.URL, ref, depth))
+
+	ctx, cancel := newOperationContext(config)
+	defer cancel()
+
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   refSpecs,
+		Depth:      depth,
+		Auth:       options.Auth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	return nil
+}
+
+// shallowFetchStorer hides the references of a shallow working copy from the fetch negotiation.
+// go-git walks the history of the local references to tell the Git server which commits it has,
+// and fails on the missing parents of the shallow commits. Without references, the server sends
+// the fetched revision at the requested depth.
+type shallowFetchStorer struct {
+	storage.Storer
+}
+
+func (s *shallowFetchStorer) IterReferences() (storer.ReferenceIter, error) {
+	return storer.NewReferenceSliceIter(nil), nil
+}
+
+// PackfileWriter writes the fetched objects as a packfile, like the fetches of the local
+// working copy without the wrapper
+func (s *shallowFetchStorer) PackfileWriter() (io.WriteCloser, error) {
+	packfileWriter, ok := s.Storer.(storer.PackfileWriter)
+	if !ok {
+		return nil, fmt.Errorf("the local Git repository storage does not support packfiles")
+	}
+
+	return packfileWriter.PackfileWriter()
+}
+
+// checkoutGitRepo fast-forwards the working tree of the local working copy to the commit
+// of the given reference. Only the configured path and channel directory is checked out, the
+// rest of the working tree is never read.
+func (s *gitSource) checkoutGitRepo(config *sourceConfig, repo *git.Repository, options *git.CloneOptions, ref *gitRepoRef) error {
+	commit, err := getGitRepoCommit(repo, ref)
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	// The working copy is only read, keep HEAD detached at the synced commit
+	err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, commit.Hash))
+	if err != nil {
+		return err
+	}
+
+	sparsePath := path.Clean(filepath.ToSlash(filepath.Join(config.path, config.channel)))
+	submodules, err := checkoutGitRepoPath(repo, s.getGitRepoDir(), commit, sparsePath)
+	if err != nil {
+		return err
+	}
+
+	if len(submodules) == 0 || options.RecurseSubmodules == git.NoRecurseSubmodules {
+		return nil
+	}
+
+	// Only the submodules in the checked out path are updated
+	allSubmodules, err := worktree.Submodules()
+	if err != nil {
+		return err
+	}
+
+	updates := git.Submodules{}
+	for _, submodule := range allSubmodules {
+		if _, ok := submodules[submodule.Config().Path]; ok {
+			updates = append(updates, submodule)
 		}
+	}
 
-		clientConfig.RootCAs = certPool
-		installProtocol = true
+	if len(updates) == 0 {
+		return nil
 	}
 
-	// If client key pair is provided, make mTLS connection
-	if len(clientKey) > 0 && len(clientCert) > 0 {
-		r.log.Info("client certificate key pair is provided. Making mTLS connection.")
+	ctx, cancel := newOperationContext(config)
+	defer cancel()
 
-		clientCertificate, err := tls.X509KeyPair(clientCert, clientKey)
+	return updates.UpdateContext(ctx, &git.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: options.RecurseSubmodules - 1,
+		Auth:              options.Auth,
+	})
+}
+
+// checkoutGitRepoPath replaces the working tree in repoDir by the files of the commit under
+// sparsePath, and the .gitmodules file. The index only records the submodules under sparsePath,
+// which are returned with their commit IDs.
+func checkoutGitRepoPath(repo *git.Repository, repoDir string, commit *object.Commit, sparsePath string) (map[string]plumbing.Hash, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == git.GitDirName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(repoDir, entry.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	submodules := map[string]plumbing.Hash{}
+	idx := &index.Index{Version: 2}
+
+	checkout := func(name string, entry object.TreeEntry) error {
+		dest := filepath.Join(repoDir, filepath.FromSlash(name))
+
+		switch entry.Mode {
+		case filemode.Dir:
+			return nil
+		case filemode.Submodule:
+			submodules[name] = entry.Hash
+			idx.Entries = append(idx.Entries, &index.Entry{Name: name, Hash: entry.Hash, Mode: filemode.Submodule})
+			return os.MkdirAll(dest, 0750)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+			return err
+		}
+
+		file, err := tree.TreeEntryFile(&entry)
 		if err != nil {
-			r.log.Info(fmt.Sprintf("failed to get key pair: %v", err.Error()))
-			return options, err
+			return err
 		}
 
-		// Add the client certificate in the connection
-		clientConfig.Certificates = []tls.Certificate{clientCertificate}
+		contents, err := file.Contents()
+		if err != nil {
+			return err
+		}
+
+		if entry.Mode == filemode.Symlink {
+			return os.Symlink(contents, dest)
+		}
+
+		return ioutil.WriteFile(dest, []byte(contents), 0600)
+	}
 
-		r.log.Info("client certificate key pair added successfully")
+	if entry, err := tree.FindEntry(gitmodulesFile); err == nil {
+		if err := checkout(gitmodulesFile, *entry); err != nil {
+			return nil, err
+		}
 	}
 
-	if installProtocol {
-		transportConfig := &http.Transport{
-			TLSClientConfig: clientConfig, // #nosec G402
+	sparseTree := tree
+	if sparsePath != "." {
+		sparseTree, err = tree.Tree(sparsePath)
+		if err == object.ErrDirectoryNotFound {
+			// Nothing to check out, loading the clusterImageSets reports the missing directory
+			return submodules, repo.Storer.SetIndex(idx)
+		}
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		httpProxy := os.Getenv("HTTP_PROXY")
-		httpsProxy := os.Getenv("HTTPS_PROXY")
-		noProxy := os.Getenv("NO_PROXY")
+	walker := object.NewTreeWalker(sparseTree, true, nil)
+	defer walker.Close()
 
-		r.log.Info(fmt.Sprintf("HTTP_PROXY=%s, HTTPS_PROXY=%s, NO_PROXY=%s", httpProxy, httpsProxy, noProxy))
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 
-		if httpProxy != "" || httpsProxy != "" || noProxy != "" {
-			transportConfig.Proxy = http.ProxyFromEnvironment
+		if sparsePath != "." {
+			name = path.Join(sparsePath, name)
+		}
 
-			r.log.Info("HTTP transport proxy set")
+		if err := checkout(name, entry); err != nil {
+			return nil, err
 		}
+	}
+
+	sort.Slice(idx.Entries, func(i, j int) bool { return idx.Entries[i].Name < idx.Entries[j].Name })
 
-		customClient := &http.Client{
-			Transport: transportConfig,  // #nosec G402
-			Timeout:   15 * time.Second, // 15 second timeout
+	return submodules, repo.Storer.SetIndex(idx)
+}
 
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
+// getGitRepoCommit returns the commit of the given reference, peeling annotated tags
+func getGitRepoCommit(repo *git.Repository, ref *gitRepoRef) (*object.Commit, error) {
+	if ref.name.IsTag() {
+		tag, err := repo.TagObject(ref.hash)
+		if err == nil {
+			return tag.Commit()
 		}
 
-		gitclient.InstallProtocol("https", githttp.NewClient(customClient))
+		if err != plumbing.ErrObjectNotFound {
+			return nil, err
+		}
 	}
 
-	return options, nil
+	return repo.CommitObject(ref.hash)
 }
 
-func (r *ClusterImageSetController) getGitRepoAuthFromSecret() (string, string, []byte, []byte, error) {
-	username := ""
-	accessToken := ""
-	clientKey := []byte("")
-	clientCert := []byte("")
+// getGitRepoDir returns the directory of the local working copy of the Git repository
+func (s *gitSource) getGitRepoDir() string {
+	cacheDir := s.cacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), DefaultCacheDirName)
+	}
 
-	secret := &corev1.Secret{}
-	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.secret, Namespace: getPodNamespace()}, secret)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			return username, accessToken, clientKey, clientCert, nil
+	return filepath.Join(cacheDir, s.configMap)
+}
+
+// isCommitID returns true if ref is a full commit ID
+func isCommitID(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+
+	_, err := hex.DecodeString(ref)
+	return err == nil
+}
+
+// compareVersions compares two version strings such as release-2.8.10 and release-2.8.9,
+// comparing runs of digits numerically and everything else lexically.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		aPart, aRest := splitVersionPart(a)
+		bPart, bRest := splitVersionPart(b)
+
+		if isDigit(aPart[0]) && isDigit(bPart[0]) {
+			aNum := strings.TrimLeft(aPart, "0")
+			bNum := strings.TrimLeft(bPart, "0")
+			if len(aNum) != len(bNum) {
+				if len(aNum) < len(bNum) {
+					return -1
+				}
+				return 1
+			}
+			if c := strings.Compare(aNum, bNum); c != 0 {
+				return c
+			}
+		} else if c := strings.Compare(aPart, bPart); c != 0 {
+			return c
 		}
 
-		r.log.Info("unable to get secret for cluster image set Git repo")
-		return username, accessToken, clientKey, clientCert, err
+		a, b = aRest, bRest
 	}
 
-	err = yaml.Unmarshal(secret.Data[UserID], &username)
-	if err != nil {
-		r.log.Info("failed to unmarshal username from the secret.")
-		return username, accessToken, clientKey, clientCert, err
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// splitVersionPart splits the leading run of digits or non-digits from s
+func splitVersionPart(s string) (string, string) {
+	i := 1
+	for i < len(s) && isDigit(s[i]) == isDigit(s[0]) {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// getCloneOptions returns the clone options for a URL of the configured Git repository,
+// using the SSH transport for ssh:// and scp-like (git@host:org/repo.git) URLs
+// and the HTTP(S) transport otherwise.
+func (s *gitSource) getCloneOptions(config *sourceConfig, repoURL string) (*git.CloneOptions, error) {
+	if isSSHURL(repoURL) {
+		return s.getSSHOptions(config, repoURL)
 	}
 
-	err = yaml.Unmarshal(secret.Data[AccessToken], &accessToken)
+	return s.getHTTPOptions(config, repoURL)
+}
+
+func (s *gitSource) getSSHOptions(config *sourceConfig, repoURL string) (*git.CloneOptions, error) {
+	options := &git.CloneOptions{
+		URL:               repoURL,
+		SingleBranch:      true,
+		Depth:             config.depth,
+		RecurseSubmodules: config.submodules,
+		ReferenceName:     plumbing.NewBranchReferenceName(config.branch),
+	}
+
+	auth, err := s.getGitRepoAuthFromSecret(config)
 	if err != nil {
-		r.log.Info("failed to unmarshal accessToken from the secret.")
-		return username, accessToken, clientKey, clientCert, err
+		return nil, err
 	}
 
-	clientKey = bytes.TrimSpace(secret.Data[ClientKey])
-	clientCert = bytes.TrimSpace(secret.Data[ClientCert])
+	if len(auth.sshPrivateKey) == 0 {
+		s.log.Info(fmt.Sprintf("%s or %s is required in the secret to access Git repository over SSH",
+			SSHPrivateKey, corev1.SSHAuthPrivateKey))
+		return nil, fmt.Errorf("%s or %s is required in the secret to access Git repository %s over SSH",
+			SSHPrivateKey, corev1.SSHAuthPrivateKey, repoURL)
+	}
 
-	if (len(clientKey) == 0 && len(clientCert) > 0) || (len(clientKey) > 0 && len(clientCert) == 0) {
-		r.log.Info("for mTLS connection to Git, both clientKey (private key) and clientCert (certificate) are required in the channel secret")
-		return username, accessToken, clientKey, clientCert,
-			fmt.Errorf("for mTLS connection to Git, both clientKey (private key) and clientCert (certificate) are required in the channel secret")
+	user := DefaultSSHUser
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return nil, err
 	}
+	if endpoint.User != "" {
+		user = endpoint.User
+	}
+
+	publicKeys, err := gitssh.NewPublicKeys(user, auth.sshPrivateKey, auth.sshPassphrase)
+	if err != nil {
+		s.log.Info(fmt.Sprintf("failed to parse SSH private key: %v", err.Error()))
+		return nil, err
+	}
+
+	publicKeys.HostKeyCallback, err = getHostKeyCallback(config.sshKnownHosts, config.sshStrictHostKeyChecking)
 	if err != nil {
-		return username, accessToken, clientKey, clientCert, err
+		s.log.Info(fmt.Sprintf("failed to set up SSH host key verification: %v", err.Error()))
+		return nil, err
 	}
 
-	return username, accessToken, clientKey, clientCert, nil
+	options.Auth = &gitSSHAuth{PublicKeys: publicKeys, connectTimeout: config.connectTimeout}
+
+	return options, nil
 }
 
-func getCertChain(certs string) tls.Certificate {
-	var certChain tls.Certificate
-	certPEMBlock := []byte(certs)
-	var certDERBlock *pem.Block
+func (s *gitSource) getHTTPOptions(config *sourceConfig, repoURL string) (*git.CloneOptions, error) {
+	options := &git.CloneOptions{
+		URL:               repoURL,
+		SingleBranch:      true,
+		Depth:             config.depth,
+		RecurseSubmodules: config.submodules,
+		ReferenceName:     plumbing.NewBranchReferenceName(config.branch),
+	}
 
-	for {
-		certDERBlock, certPEMBlock = pem.Decode(certPEMBlock)
-		if certDERBlock == nil {
-			break
+	auth, err := s.getGitRepoAuthFromSecret(config)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig, err := getTLSClientConfig(s.log, config, auth)
+	if err != nil {
+		return options, err
+	}
+
+	// Every clone and fetch uses its own HTTP client built from the current configuration
+	httpAuth := &gitHTTPAuth{client: newHTTPClient(s.log, config, clientConfig)}
+
+	// A GitHub App takes precedence over a bearer token, which takes precedence over basic auth
+	switch {
+	case auth.githubAppID != "":
+		token, err := getGitHubAppToken(httpAuth.client, getGitHubAPIURL(config, repoURL), auth)
+		if err != nil {
+			s.log.Info(fmt.Sprintf("failed to get a GitHub App installation token: %v", err.Error()))
+			return nil, err
 		}
 
-		if certDERBlock.Type == "CERTIFICATE" {
-			certChain.Certificate = append(certChain.Certificate, certDERBlock.Bytes)
+		httpAuth.auth = &githttp.BasicAuth{
+			Username: githubAppTokenUser,
+			Password: token,
+		}
+	case auth.bearerToken != "":
+		httpAuth.auth = &githttp.TokenAuth{Token: auth.bearerToken}
+	case auth.user != "" && auth.accessToken != "":
+		httpAuth.auth = &githttp.BasicAuth{
+			Username: auth.user,
+			Password: auth.accessToken,
 		}
 	}
 
-	return certChain
+	options.Auth = httpAuth
+
+	return options, nil
+}
+
+func (s *gitSource) getGitRepoAuthFromSecret(config *sourceConfig) (*sourceAuth, error) {
+	return getSourceAuth(s.client, s.log, config.secret)
+}
+
+// getGitRepoConfig reads the configuration of the Git repository, once per Revision or Fetch, so
+// that a configuration change does not take effect in the middle of a sync
+func (s *gitSource) getGitRepoConfig() (*sourceConfig, error) {
+	return getSourceConfig(s.client, s.log, s.configMap, s.secret)
 }
 
-func (r *ClusterImageSetController) getGitRepoConfig() (string, string, string, string, string, bool, error) {
-	configMap := &corev1.ConfigMap{}
-	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.configMap, Namespace: getPodNamespace()}, configMap)
+// getHostKeyCallback returns the SSH host key callback for the given known_hosts content.
+// In strict mode the Git server's host key must be listed in known_hosts. Otherwise unknown
+// hosts are accepted, but a host listed with a different key is still rejected.
+func getHostKeyCallback(knownHosts string, strict bool) (ssh.HostKeyCallback, error) {
+	if strings.TrimSpace(knownHosts) == "" {
+		if strict {
+			return nil, fmt.Errorf("%s is required when %s is true", SSHKnownHosts, SSHStrictHostKeyChecking)
+		}
+
+		return ssh.InsecureIgnoreHostKey(), nil // #nosec G106
+	}
+
+	// knownhosts only reads from files, the callback keeps the parsed entries in memory
+	knownHostsFile, err := ioutil.TempFile(os.TempDir(), "cluster-imageset-known-hosts-")
 	if err != nil {
-		r.log.Info(fmt.Sprintf("unable to get config map %v, use default values.", r.configMap))
-		return DefaultGitRepoUrl, DefaultGitRepoBranch, DefaultGitRepoPath, DefaultChannel, "", false, nil
+		return nil, err
 	}
+	defer os.Remove(knownHostsFile.Name())
 
-	gitRepoUrl := configMap.Data[GitRepoUrl]
-	if gitRepoUrl == "" {
-		gitRepoUrl = DefaultGitRepoUrl
+	_, err = knownHostsFile.WriteString(knownHosts)
+	if closeErr := knownHostsFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	gitRepoBranch := configMap.Data[GitRepoBranch]
-	if gitRepoBranch == "" {
-		gitRepoBranch = DefaultGitRepoBranch
+	callback, err := knownhosts.New(knownHostsFile.Name())
+	if err != nil {
+		return nil, err
 	}
 
-	gitRepoPath := configMap.Data[GitRepoPath]
-	if gitRepoPath == "" {
-		gitRepoPath = DefaultGitRepoPath
+	if strict {
+		return callback, nil
 	}
 
-	channel := configMap.Data[Channel]
-	if channel == "" {
-		channel = DefaultChannel
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if goerrors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil
+		}
+
+		return err
+	}, nil
+}
+
+// isSSHURL returns true if the Git repository URL uses the SSH transport
+func isSSHURL(url string) bool {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return false
 	}
 
-	caCert := configMap.Data[CaCerts]
+	return endpoint.Protocol == "ssh"
+}
 
-	bSkipCertVerify := false
-	skipCertVerify := configMap.Data[InsecureSkipVerify]
-	if skipCertVerify != "" {
-		bSkipCertVerify, err = strconv.ParseBool(skipCertVerify)
-		if err != nil {
-			r.log.Info(fmt.Sprintf("invalid bool value for insecureSkipVerify: %v", err.Error()))
+// getCertChain returns the certificates of a PEM encoded bundle. Text outside of the PEM blocks,
+// such as the comments of the system bundles, is ignored, but a bundle without certificates or
+// with a malformed block is invalid.
+func getCertChain(certs string) (tls.Certificate, error) {
+	var certChain tls.Certificate
+	certPEMBlock := []byte(certs)
+	var certDERBlock *pem.Block
+
+	for {
+		certDERBlock, certPEMBlock = pem.Decode(certPEMBlock)
+		if certDERBlock == nil {
+			break
+		}
+
+		if certDERBlock.Type != "CERTIFICATE" {
+			return certChain, fmt.Errorf("unexpected %s PEM block, only CERTIFICATE blocks are supported", certDERBlock.Type)
+		}
+
+		if _, err := x509.ParseCertificate(certDERBlock.Bytes); err != nil {
+			return certChain, fmt.Errorf("certificate %d is invalid: %w", len(certChain.Certificate)+1, err)
 		}
+
+		certChain.Certificate = append(certChain.Certificate, certDERBlock.Bytes)
+	}
+
+	// pem.Decode stops at the first block it cannot decode
+	if bytes.Contains(certPEMBlock, []byte("-----BEGIN")) {
+		return certChain, fmt.Errorf("malformed PEM block after %d certificates", len(certChain.Certificate))
+	}
+
+	if len(certChain.Certificate) == 0 && strings.TrimSpace(certs) != "" {
+		return certChain, fmt.Errorf("no PEM encoded certificate found")
 	}
 
-	return gitRepoUrl, gitRepoBranch, gitRepoPath, channel, caCert, bSkipCertVerify, nil
+	return certChain, nil
 }
 
 func getPodNamespace() string {
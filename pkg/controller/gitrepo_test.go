@@ -2,12 +2,36 @@ package clusterimageset
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -17,13 +41,42 @@ func TestGetGitRepoAuthFromSecret(t *testing.T) {
 	secret1 := getSecret("secret1", []byte("user1"), []byte("token1"), []byte("key1"), []byte("cert1"))
 	_ = c.Create(context.TODO(), secret1)
 
+	// Values that look like YAML are read as is
+	secretBasicAuth := getTypedSecret("secret-basic-auth", corev1.SecretTypeBasicAuth, map[string]string{
+		corev1.BasicAuthUsernameKey: "12345",
+		corev1.BasicAuthPasswordKey: "ghp_a:b #c\n",
+	})
+	_ = c.Create(context.TODO(), secretBasicAuth)
+
+	secretBasicAuthNoPassword := getTypedSecret("secret-basic-auth-no-password", corev1.SecretTypeBasicAuth, map[string]string{
+		corev1.BasicAuthUsernameKey: "user1",
+	})
+	_ = c.Create(context.TODO(), secretBasicAuthNoPassword)
+
+	secretTLS := getTypedSecret("secret-tls", corev1.SecretTypeTLS, map[string]string{
+		corev1.TLSPrivateKeyKey: "key2",
+		corev1.TLSCertKey:       "cert2",
+	})
+	_ = c.Create(context.TODO(), secretTLS)
+
+	secretTLSNoKey := getTypedSecret("secret-tls-no-key", corev1.SecretTypeTLS, map[string]string{
+		corev1.TLSCertKey: "cert2",
+	})
+	_ = c.Create(context.TODO(), secretTLSNoKey)
+
+	secretSSHAuthNoKey := getTypedSecret("secret-ssh-auth-no-key", corev1.SecretTypeSSHAuth, map[string]string{})
+	_ = c.Create(context.TODO(), secretSSHAuthNoKey)
+
+	secretUserColon := getSecret("secret-user-colon", []byte("user:1"), []byte("token1"), []byte(""), []byte(""))
+	_ = c.Create(context.TODO(), secretUserColon)
+
+	secretUserOnly := getSecret("secret-user-only", []byte("user1"), []byte(""), []byte(""), []byte(""))
+	_ = c.Create(context.TODO(), secretUserOnly)
+
 	type ctrlFields struct {
-		client       client.Client
-		log          logr.Logger
-		interval     int
-		configMap    string
-		secret       string
-		lastCommitID string
+		client client.Client
+		log    logr.Logger
+		secret string
 	}
 	f1 := ctrlFields{
 		client: c,
@@ -60,33 +113,80 @@ func TestGetGitRepoAuthFromSecret(t *testing.T) {
 			wantClientCert:   []byte("cert1"),
 			wantErr:          false,
 		},
+		{
+			name:             "basic-auth secret",
+			controllerFields: ctrlFields{client: c, secret: "secret-basic-auth"},
+			wantUsername:     "12345",
+			wantAccessToken:  "ghp_a:b #c",
+			wantClientKey:    []byte(""),
+			wantClientCert:   []byte(""),
+			wantErr:          false,
+		},
+		{
+			name:             "basic-auth secret without password",
+			controllerFields: ctrlFields{client: c, secret: "secret-basic-auth-no-password"},
+			wantErr:          true,
+		},
+		{
+			name:             "tls secret",
+			controllerFields: ctrlFields{client: c, secret: "secret-tls"},
+			wantClientKey:    []byte("key2"),
+			wantClientCert:   []byte("cert2"),
+			wantErr:          false,
+		},
+		{
+			name:             "tls secret without key",
+			controllerFields: ctrlFields{client: c, secret: "secret-tls-no-key"},
+			wantErr:          true,
+		},
+		{
+			name:             "ssh-auth secret without private key",
+			controllerFields: ctrlFields{client: c, secret: "secret-ssh-auth-no-key"},
+			wantErr:          true,
+		},
+		{
+			name:             "user with a colon",
+			controllerFields: ctrlFields{client: c, secret: "secret-user-colon"},
+			wantErr:          true,
+		},
+		{
+			name:             "user without access token",
+			controllerFields: ctrlFields{client: c, secret: "secret-user-only"},
+			wantErr:          true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := &ClusterImageSetController{
-				client:       tt.controllerFields.client,
-				log:          tt.controllerFields.log,
-				interval:     tt.controllerFields.interval,
-				configMap:    tt.controllerFields.configMap,
-				secret:       tt.controllerFields.secret,
-				lastCommitID: tt.controllerFields.lastCommitID,
-			}
-			gotUsername, gotAccessToken, gotClientKey, gotClientCert, err := r.getGitRepoAuthFromSecret()
+			s := &gitSource{
+				client: tt.controllerFields.client,
+				log:    tt.controllerFields.log,
+				// The default configmap does not exist, the default configuration is used
+				configMap: DefaultGitConfigMap,
+				secret:    tt.controllerFields.secret,
+			}
+			config, err := s.getGitRepoConfig()
+			if err != nil {
+				t.Fatalf("gitSource.getGitRepoConfig() error = %v", err)
+			}
+			gotAuth, err := s.getGitRepoAuthFromSecret(config)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("ClusterImageSetController.getGitRepoAuthFromSecret() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("gitSource.getGitRepoAuthFromSecret() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if gotUsername != tt.wantUsername {
-				t.Errorf("ClusterImageSetController.getGitRepoAuthFromSecret() got = %v, want %v", gotUsername, tt.wantUsername)
+			if err != nil {
+				return
+			}
+			if gotAuth.user != tt.wantUsername {
+				t.Errorf("gitSource.getGitRepoAuthFromSecret() user = %v, want %v", gotAuth.user, tt.wantUsername)
 			}
-			if gotAccessToken != tt.wantAccessToken {
-				t.Errorf("ClusterImageSetController.getGitRepoAuthFromSecret() got1 = %v, want %v", gotAccessToken, tt.wantAccessToken)
+			if gotAuth.accessToken != tt.wantAccessToken {
+				t.Errorf("gitSource.getGitRepoAuthFromSecret() accessToken = %v, want %v", gotAuth.accessToken, tt.wantAccessToken)
 			}
-			if !reflect.DeepEqual(gotClientKey, tt.wantClientKey) {
-				t.Errorf("ClusterImageSetController.getGitRepoAuthFromSecret() got2 = %v, want %v", gotClientKey, tt.wantClientKey)
+			if !reflect.DeepEqual(gotAuth.clientKey, tt.wantClientKey) {
+				t.Errorf("gitSource.getGitRepoAuthFromSecret() clientKey = %v, want %v", gotAuth.clientKey, tt.wantClientKey)
 			}
-			if !reflect.DeepEqual(gotClientCert, tt.wantClientCert) {
-				t.Errorf("ClusterImageSetController.getGitRepoAuthFromSecret() got3 = %v, want %v", gotClientCert, tt.wantClientCert)
+			if !reflect.DeepEqual(gotAuth.clientCert, tt.wantClientCert) {
+				t.Errorf("gitSource.getGitRepoAuthFromSecret() clientCert = %v, want %v", gotAuth.clientCert, tt.wantClientCert)
 			}
 		})
 	}
@@ -127,28 +227,58 @@ func TestGetCertChain(t *testing.T) {
 		    -----END CERTIFICATE-----`
 	*/
 
+	cert1 := newCertificatePEM(t, "ca1")
+	cert2 := newCertificatePEM(t, "ca2")
+
 	tests := []struct {
 		name     string
 		certs    string
 		wantCert int
+		wantErr  bool
 	}{
 		{
 			name:     "no cert",
 			certs:    "",
 			wantCert: 0,
 		},
-		/*
-			{
-				name:     "has cert",
-				certs:    cert,
-				wantCert: 1,
-			}, */
+		{
+			name:     "has cert",
+			certs:    cert1,
+			wantCert: 1,
+		},
+		{
+			name:     "bundle with comments",
+			certs:    "# ca1\n" + cert1 + "\n# ca2\n" + cert2,
+			wantCert: 2,
+		},
+		{
+			name:    "no PEM data",
+			certs:   "not a certificate",
+			wantErr: true,
+		},
+		{
+			name:    "truncated block",
+			certs:   cert1 + cert2[:len(cert2)/2],
+			wantErr: true,
+		},
+		{
+			name:    "invalid certificate",
+			certs:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")})),
+			wantErr: true,
+		},
+		{
+			name:    "private key",
+			certs:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})),
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			t.Logf("cert: %v", tt.certs)
-			gotCert := getCertChain(tt.certs)
-			if len(gotCert.Certificate) != tt.wantCert {
+			gotCert, err := getCertChain(tt.certs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getCertChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(gotCert.Certificate) != tt.wantCert {
 				t.Errorf("getCertChain() = %v, want %v", len(gotCert.Certificate), tt.wantCert)
 			}
 		})
@@ -207,20 +337,17 @@ func TestGetHTTPOptions(t *testing.T) {
 	zapLog, _ := zap.NewDevelopment()
 
 	type ctrlFields struct {
-		client       client.Client
-		log          logr.Logger
-		interval     int
-		configMap    string
-		secret       string
-		lastCommitID string
+		client    client.Client
+		log       logr.Logger
+		configMap string
+		secret    string
 	}
 
 	f1 := ctrlFields{
-		client:       c,
-		log:          zapr.NewLogger(zapLog),
-		configMap:    "configmap-skip-verify",
-		secret:       "secretUser",
-		lastCommitID: "abc",
+		client:    c,
+		log:       zapr.NewLogger(zapLog),
+		configMap: "configmap-skip-verify",
+		secret:    "secretUser",
 	}
 	f2 := ctrlFields{
 		client:    c,
@@ -246,19 +373,1020 @@ func TestGetHTTPOptions(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := &ClusterImageSetController{
-				client:       tt.controllerFields.client,
-				log:          tt.controllerFields.log,
-				interval:     tt.controllerFields.interval,
-				configMap:    tt.controllerFields.configMap,
-				secret:       tt.controllerFields.secret,
-				lastCommitID: tt.controllerFields.lastCommitID,
-			}
-			_, err := r.getHTTPOptions()
+			s := &gitSource{
+				client:    tt.controllerFields.client,
+				log:       tt.controllerFields.log,
+				configMap: tt.controllerFields.configMap,
+				secret:    tt.controllerFields.secret,
+			}
+			config, err := s.getGitRepoConfig()
+			if err != nil {
+				t.Fatalf("gitSource.getGitRepoConfig() error = %v", err)
+			}
+			_, err = s.getHTTPOptions(config, DefaultGitRepoUrl)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("gitSource.getHTTPOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+		})
+	}
+}
+
+func TestGetSSHOptions(t *testing.T) {
+	c := initClient()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate private key: %v", err)
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	configMapSSH := getConfigMap("git@github.com:stolostron/acm-hive-openshift-releases.git", "backplane-2.8", "clusterImageSets", "fast")
+	configMapSSH.Data[SSHKnownHosts] = "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	configMapSSH.Name = "configmap-ssh"
+	_ = c.Create(context.TODO(), configMapSSH)
+
+	configMapSSHStrict := getConfigMap("ssh://git@github.com/stolostron/acm-hive-openshift-releases.git", "backplane-2.8", "clusterImageSets", "fast")
+	configMapSSHStrict.Name = "configmap-ssh-strict"
+	_ = c.Create(context.TODO(), configMapSSHStrict)
+
+	configMapSSHNotStrict := getConfigMap("git@github.com:stolostron/acm-hive-openshift-releases.git", "backplane-2.8", "clusterImageSets", "fast")
+	configMapSSHNotStrict.Data[SSHStrictHostKeyChecking] = "false"
+	configMapSSHNotStrict.Name = "configmap-ssh-not-strict"
+	_ = c.Create(context.TODO(), configMapSSHNotStrict)
+
+	secretSSH := getSecret("secretSSH", []byte(""), []byte(""), []byte(""), []byte(""))
+	secretSSH.Data[SSHPrivateKey] = privateKeyPEM
+	_ = c.Create(context.TODO(), secretSSH)
+
+	secretBadSSH := getSecret("secretBadSSH", []byte(""), []byte(""), []byte(""), []byte(""))
+	secretBadSSH.Data[SSHPrivateKey] = []byte("bad key")
+	_ = c.Create(context.TODO(), secretBadSSH)
+
+	zapLog, _ := zap.NewDevelopment()
+
+	tests := []struct {
+		name      string
+		configMap string
+		secret    string
+		wantErr   bool
+	}{
+		{
+			name:      "private key and known hosts",
+			configMap: "configmap-ssh",
+			secret:    "secretSSH",
+			wantErr:   false,
+		},
+		{
+			name:      "strict host key checking without known hosts",
+			configMap: "configmap-ssh-strict",
+			secret:    "secretSSH",
+			wantErr:   true,
+		},
+		{
+			name:      "no strict host key checking without known hosts",
+			configMap: "configmap-ssh-not-strict",
+			secret:    "secretSSH",
+			wantErr:   false,
+		},
+		{
+			name:      "no private key",
+			configMap: "configmap-ssh",
+			secret:    "nosecret",
+			wantErr:   true,
+		},
+		{
+			name:      "invalid private key",
+			configMap: "configmap-ssh",
+			secret:    "secretBadSSH",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &gitSource{
+				client:    c,
+				log:       zapr.NewLogger(zapLog),
+				configMap: tt.configMap,
+				secret:    tt.secret,
+			}
+			config, err := s.getGitRepoConfig()
+			if err != nil {
+				t.Fatalf("gitSource.getGitRepoConfig() error = %v", err)
+			}
+			options, err := s.getCloneOptions(config, config.url)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("gitSource.getCloneOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			publicKeys, ok := options.Auth.(*gitSSHAuth)
+			if !ok {
+				t.Errorf("gitSource.getCloneOptions() auth = %T, want *gitSSHAuth", options.Auth)
+				return
+			}
+			if publicKeys.User != DefaultSSHUser {
+				t.Errorf("gitSource.getCloneOptions() user = %v, want %v", publicKeys.User, DefaultSSHUser)
+			}
+			clientConfig, err := publicKeys.ClientConfig()
+			if err != nil {
+				t.Errorf("gitSSHAuth.ClientConfig() error = %v", err)
+				return
+			}
+			if clientConfig.Timeout != DefaultConnectTimeout {
+				t.Errorf("gitSSHAuth.ClientConfig() timeout = %v, want %v", clientConfig.Timeout, DefaultConnectTimeout)
+			}
+		})
+	}
+}
+
+func TestGetHostKeyCallback(t *testing.T) {
+	hostKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	sshHostKey, err := ssh.NewPublicKey(hostKey)
+	if err != nil {
+		t.Fatalf("failed to convert host key: %v", err)
+	}
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	sshOtherKey, err := ssh.NewPublicKey(otherKey)
+	if err != nil {
+		t.Fatalf("failed to convert host key: %v", err)
+	}
+
+	knownHosts := knownhosts.Line([]string{"git.example.com"}, sshHostKey)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		strict     bool
+		hostname   string
+		key        ssh.PublicKey
+		wantErr    bool
+	}{
+		{
+			name:       "strict known host",
+			knownHosts: knownHosts,
+			strict:     true,
+			hostname:   "git.example.com:22",
+			key:        sshHostKey,
+			wantErr:    false,
+		},
+		{
+			name:       "strict unknown host",
+			knownHosts: knownHosts,
+			strict:     true,
+			hostname:   "other.example.com:22",
+			key:        sshHostKey,
+			wantErr:    true,
+		},
+		{
+			name:       "not strict unknown host",
+			knownHosts: knownHosts,
+			strict:     false,
+			hostname:   "other.example.com:22",
+			key:        sshHostKey,
+			wantErr:    false,
+		},
+		{
+			name:       "not strict changed host key",
+			knownHosts: knownHosts,
+			strict:     false,
+			hostname:   "git.example.com:22",
+			key:        sshOtherKey,
+			wantErr:    true,
+		},
+		{
+			name:       "not strict without known hosts",
+			knownHosts: "",
+			strict:     false,
+			hostname:   "git.example.com:22",
+			key:        sshOtherKey,
+			wantErr:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callback, err := getHostKeyCallback(tt.knownHosts, tt.strict)
+			if err != nil {
+				t.Errorf("getHostKeyCallback() error = %v", err)
+				return
+			}
+
+			err = callback(tt.hostname, remote, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getHostKeyCallback() callback error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyncGitRepo(t *testing.T) {
+	c := initClient()
+
+	gitRoot := t.TempDir()
+	sourceDir := filepath.Join(gitRoot, "releases.git")
+	firstCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+
+	server := newGitHTTPServer(t, gitRoot)
+
+	configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	_ = c.Create(context.TODO(), configMap)
+
+	zapLog, _ := zap.NewDevelopment()
+	s := &gitSource{
+		client:    c,
+		log:       zapr.NewLogger(zapLog),
+		configMap: configMap.Name,
+		cacheDir:  t.TempDir(),
+	}
+	repoFile := filepath.Join(s.getGitRepoDir(), "clusterImageSets", "fast", "img4.11.1-x86-64-appsub.yaml")
+
+	// First sync clones the repository
+	_, ref, err := syncTestGitRepo(s)
+	if err != nil {
+		t.Fatalf("gitSource.syncGitRepo() error = %v", err)
+	}
+	if ref.hash.String() != firstCommit {
+		t.Errorf("gitSource.syncGitRepo() commit = %v, want %v", ref.hash, firstCommit)
+	}
+
+	// Next syncs fetch and fast-forward the local working copy
+	secondCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.1-x86-64-appsub.yaml": "img4.11.1",
+	})
+
+	_, ref, err = syncTestGitRepo(s)
+	if err != nil {
+		t.Fatalf("gitSource.syncGitRepo() error = %v", err)
+	}
+	if ref.hash.String() != secondCommit {
+		t.Errorf("gitSource.syncGitRepo() commit = %v, want %v", ref.hash, secondCommit)
+	}
+	if _, err := os.Stat(repoFile); err != nil {
+		t.Errorf("gitSource.syncGitRepo() did not fast-forward the working tree: %v", err)
+	}
+
+	// A corrupted working copy is cloned again
+	if err := os.RemoveAll(filepath.Join(s.getGitRepoDir(), ".git", "objects")); err != nil {
+		t.Fatalf("failed to corrupt the local Git repository: %v", err)
+	}
+
+	_, ref, err = syncTestGitRepo(s)
+	if err != nil {
+		t.Fatalf("gitSource.syncGitRepo() error = %v", err)
+	}
+	if ref.hash.String() != secondCommit {
+		t.Errorf("gitSource.syncGitRepo() commit = %v, want %v", ref.hash, secondCommit)
+	}
+	if _, err := os.Stat(repoFile); err != nil {
+		t.Errorf("gitSource.syncGitRepo() did not re-clone the working tree: %v", err)
+	}
+}
+
+func TestGitSourceFetchSymlinks(t *testing.T) {
+	gitRoot := t.TempDir()
+	sourceDir := filepath.Join(gitRoot, "releases.git")
+	commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml":   getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+		"clusterImageSets/stable/img4.10.0-x86-64-appsub.yaml": getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+	})
+
+	// A file of the controller, such as its service account token
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("secret token"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	links := map[string]string{
+		"clusterImageSets/fast/latest.yaml": "img4.11.0-x86-64-appsub.yaml",
+		"clusterImageSets/fast/token.yaml":  token,
+		"clusterImageSets/fast/stable.yaml": "../stable/img4.10.0-x86-64-appsub.yaml",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(sourceDir, name)); err != nil {
+			t.Fatalf("failed to create symbolic link: %v", err)
+		}
+		// go-git rewrites the absolute link targets, add the links with git
+		if out, err := exec.Command("git", "-C", sourceDir, "add", name).CombinedOutput(); err != nil {
+			t.Skipf("git is required to add the symbolic links: %v: %s", err, out)
+		}
+	}
+	commitGitRepoFiles(t, sourceDir, map[string]string{})
+
+	server := newGitHTTPServer(t, gitRoot)
+
+	c := initClient()
+	configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	if err := c.Create(context.TODO(), configMap); err != nil {
+		t.Fatalf("failed to create config map: %v", err)
+	}
+
+	zapLog, _ := zap.NewDevelopment()
+	s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+	content, err := s.Fetch()
+	if err != nil {
+		t.Fatalf("gitSource.Fetch() error = %v", err)
+	}
+
+	// Only the links to the files of the channel directory are read
+	got := map[string]bool{}
+	for _, manifest := range content.Manifests {
+		if strings.Contains(string(manifest.Data), "secret token") {
+			t.Errorf("gitSource.Fetch() read the target of %v", manifest.Path)
+		}
+		got[manifest.Path] = manifest.Err == nil
+	}
+	want := map[string]bool{
+		"img4.11.0-x86-64-appsub.yaml": true,
+		"latest.yaml":                  true,
+		"stable.yaml":                  false,
+		"token.yaml":                   false,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gitSource.Fetch() manifests = %v, want %v", got, want)
+	}
+}
+
+func TestSyncGitRepoShallowSparse(t *testing.T) {
+	tests := []struct {
+		name        string
+		depth       string
+		wantHistory bool
+	}{
+		{name: "default depth", depth: ""},
+		{name: "full history", depth: "0", wantHistory: true},
+		{name: "invalid depth", depth: "-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitRoot := t.TempDir()
+			sourceDir := filepath.Join(gitRoot, "releases.git")
+			firstCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+				"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml":   "img4.11.0",
+				"clusterImageSets/stable/img4.10.0-x86-64-appsub.yaml": "img4.10.0",
+				"README.md": "releases",
+			})
+			secondCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+				"clusterImageSets/fast/img4.11.1-x86-64-appsub.yaml": "img4.11.1",
+			})
+
+			server := newGitHTTPServer(t, gitRoot)
+
+			c := initClient()
+			configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+			configMap.Data[GitRepoDepth] = tt.depth
+			_ = c.Create(context.TODO(), configMap)
+
+			zapLog, _ := zap.NewDevelopment()
+			s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+			repo, ref, err := syncTestGitRepo(s)
+			if err != nil {
+				t.Fatalf("gitSource.syncGitRepo() error = %v", err)
+			}
+			if ref.hash.String() != secondCommit {
+				t.Errorf("gitSource.syncGitRepo() commit = %v, want %v", ref.hash, secondCommit)
+			}
+
+			_, err = repo.CommitObject(plumbing.NewHash(firstCommit))
+			if (err == nil) != tt.wantHistory {
+				t.Errorf("gitSource.syncGitRepo() parent commit error = %v, want history %v", err, tt.wantHistory)
+			}
+
+			// Only the channel directory is checked out
+			for name, want := range map[string]bool{
+				"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml":   true,
+				"clusterImageSets/fast/img4.11.1-x86-64-appsub.yaml":   true,
+				"clusterImageSets/stable/img4.10.0-x86-64-appsub.yaml": false,
+				"README.md": false,
+			} {
+				if _, err := os.Stat(filepath.Join(s.getGitRepoDir(), name)); (err == nil) != want {
+					t.Errorf("gitSource.syncGitRepo() file %v checked out = %v, want %v", name, err == nil, want)
+				}
+			}
+
+			// Next syncs fetch into the shallow working copy, and remove the deleted files
+			runGit(t, sourceDir, "rm", "-q", "clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml")
+			thirdCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+				"clusterImageSets/fast/img4.12.0-x86-64-appsub.yaml": "img4.12.0",
+			})
+
+			// The marker is removed if the working copy is cloned again
+			marker := filepath.Join(s.getGitRepoDir(), ".git", "marker")
+			if err := os.WriteFile(marker, []byte{}, 0600); err != nil {
+				t.Fatalf("failed to write marker: %v", err)
+			}
+
+			content, err := s.Fetch()
+			if err != nil {
+				t.Fatalf("gitSource.Fetch() error = %v", err)
+			}
+			if content.Revision != thirdCommit {
+				t.Errorf("gitSource.Fetch() revision = %v, want %v", content.Revision, thirdCommit)
+			}
+			if _, err := os.Stat(marker); err != nil {
+				t.Errorf("gitSource.Fetch() cloned the working copy again: %v", err)
+			}
+
+			repo, err = git.PlainOpen(s.getGitRepoDir())
+			if err != nil {
+				t.Fatalf("failed to open the local Git repository: %v", err)
+			}
+			// The fetch did not deepen the history
+			_, err = repo.CommitObject(plumbing.NewHash(firstCommit))
+			if (err == nil) != tt.wantHistory {
+				t.Errorf("gitSource.Fetch() first commit error = %v, want history %v", err, tt.wantHistory)
+			}
+
+			paths := []string{}
+			for _, manifest := range content.Manifests {
+				paths = append(paths, manifest.Path)
+			}
+			wantPaths := []string{"img4.11.1-x86-64-appsub.yaml", "img4.12.0-x86-64-appsub.yaml"}
+			if !reflect.DeepEqual(paths, wantPaths) {
+				t.Errorf("gitSource.Fetch() manifests = %v, want %v", paths, wantPaths)
+			}
+		})
+	}
+}
+
+func TestSyncGitRepoSubmodules(t *testing.T) {
+	gitRoot := t.TempDir()
+	server := newGitHTTPServer(t, gitRoot)
+
+	commitGitRepoFiles(t, filepath.Join(gitRoot, "hotfix.git"), map[string]string{
+		"img4.11.0-hotfix.yaml": "img4.11.0-hotfix",
+	})
+	commitGitRepoFiles(t, filepath.Join(gitRoot, "docs.git"), map[string]string{
+		"README.md": "docs",
+	})
+
+	sourceDir := filepath.Join(gitRoot, "releases.git")
+	commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+	runGit(t, sourceDir, "submodule", "add", "-q", server.URL+"/hotfix.git", "clusterImageSets/fast/hotfix")
+	runGit(t, sourceDir, "submodule", "add", "-q", server.URL+"/docs.git", "docs")
+	runGit(t, sourceDir, "commit", "-q", "-m", "add submodules")
+
+	tests := []struct {
+		name       string
+		submodules string
+		wantHotfix bool
+	}{
+		{name: "default", submodules: "", wantHotfix: true},
+		{name: "enabled", submodules: "true", wantHotfix: true},
+		{name: "depth", submodules: "1", wantHotfix: true},
+		{name: "disabled", submodules: "false", wantHotfix: false},
+		{name: "depth 0", submodules: "0", wantHotfix: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := initClient()
+
+			configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+			configMap.Data[GitRepoSubmodules] = tt.submodules
+			_ = c.Create(context.TODO(), configMap)
+
+			zapLog, _ := zap.NewDevelopment()
+			s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+			if _, _, err := syncTestGitRepo(s); err != nil {
+				t.Fatalf("gitSource.syncGitRepo() error = %v", err)
+			}
+
+			hotfixFile := filepath.Join(s.getGitRepoDir(), "clusterImageSets/fast/hotfix/img4.11.0-hotfix.yaml")
+			if _, err := os.Stat(hotfixFile); (err == nil) != tt.wantHotfix {
+				t.Errorf("gitSource.syncGitRepo() submodule checked out = %v, want %v", err == nil, tt.wantHotfix)
+			}
+
+			// Submodules outside of the channel directory are never fetched
+			if _, err := os.Stat(filepath.Join(s.getGitRepoDir(), ".git", "modules", "docs")); err == nil {
+				t.Errorf("gitSource.syncGitRepo() fetched the docs submodule")
+			}
+		})
+	}
+}
+
+func TestGetLastCommitID(t *testing.T) {
+	c := initClient()
+
+	gitRoot := t.TempDir()
+	sourceDir := filepath.Join(gitRoot, "releases.git")
+	firstCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+
+	server := newGitHTTPServer(t, gitRoot)
+
+	configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	configMap.Name = "configmap-master"
+	_ = c.Create(context.TODO(), configMap)
+
+	configMapNoBranch := getConfigMap(server.URL+"/releases.git", "nobranch", "clusterImageSets", "fast")
+	configMapNoBranch.Name = "configmap-nobranch"
+	_ = c.Create(context.TODO(), configMapNoBranch)
+
+	configMapNoRepo := getConfigMap(server.URL+"/norepo.git", "master", "clusterImageSets", "fast")
+	configMapNoRepo.Name = "configmap-norepo"
+	_ = c.Create(context.TODO(), configMapNoRepo)
+
+	zapLog, _ := zap.NewDevelopment()
+	cacheDir := t.TempDir()
+
+	getLastCommitID := func(configMap string) (string, error) {
+		s := &gitSource{
+			client:    c,
+			log:       zapr.NewLogger(zapLog),
+			configMap: configMap,
+			cacheDir:  cacheDir,
+		}
+		return getTestLastCommitID(s)
+	}
+
+	lastCommitID, err := getLastCommitID("configmap-master")
+	if err != nil {
+		t.Fatalf("gitSource.getLastCommitID() error = %v", err)
+	}
+	if lastCommitID != firstCommit {
+		t.Errorf("gitSource.getLastCommitID() = %v, want %v", lastCommitID, firstCommit)
+	}
+
+	secondCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.1-x86-64-appsub.yaml": "img4.11.1",
+	})
+
+	lastCommitID, err = getLastCommitID("configmap-master")
+	if err != nil {
+		t.Fatalf("gitSource.getLastCommitID() error = %v", err)
+	}
+	if lastCommitID != secondCommit {
+		t.Errorf("gitSource.getLastCommitID() = %v, want %v", lastCommitID, secondCommit)
+	}
+
+	// The remote references are listed without cloning the repository
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("failed to read cache directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("gitSource.getLastCommitID() should not clone the repository, found %v", entries)
+	}
+
+	if _, err := getLastCommitID("configmap-nobranch"); err == nil {
+		t.Errorf("gitSource.getLastCommitID() expected error for missing branch")
+	}
+
+	if _, err := getLastCommitID("configmap-norepo"); err == nil {
+		t.Errorf("gitSource.getLastCommitID() expected error for missing repository")
+	}
+}
+
+func TestResolveGitRepoRef(t *testing.T) {
+	c := initClient()
+
+	gitRoot := t.TempDir()
+	sourceDir := filepath.Join(gitRoot, "releases.git")
+	firstCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+	tagGitRepo(t, sourceDir, "release-2.8.9", false)
+	secondCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.1-x86-64-appsub.yaml": "img4.11.1",
+	})
+	annotatedTag := tagGitRepo(t, sourceDir, "release-2.8.10", true)
+	thirdCommit := commitGitRepoFiles(t, sourceDir, map[string]string{
+		"clusterImageSets/fast/img4.11.2-x86-64-appsub.yaml": "img4.11.2",
+	})
+
+	server := newGitHTTPServer(t, gitRoot)
+
+	zapLog, _ := zap.NewDevelopment()
+
+	tests := []struct {
+		name       string
+		ref        string
+		tagPattern string
+		wantName   string
+		wantHash   string
+		wantCommit string
+		wantFile   string
+		wantErr    bool
+	}{
+		{
+			name:       "branch",
+			wantName:   "refs/heads/master",
+			wantHash:   thirdCommit,
+			wantCommit: thirdCommit,
+			wantFile:   "img4.11.2-x86-64-appsub.yaml",
+		},
+		{
+			name:       "lightweight tag",
+			ref:        "release-2.8.9",
+			wantName:   "refs/tags/release-2.8.9",
+			wantHash:   firstCommit,
+			wantCommit: firstCommit,
+			wantFile:   "img4.11.0-x86-64-appsub.yaml",
+		},
+		{
+			name:       "annotated tag",
+			ref:        "refs/tags/release-2.8.10",
+			wantName:   "refs/tags/release-2.8.10",
+			wantHash:   annotatedTag,
+			wantCommit: secondCommit,
+			wantFile:   "img4.11.1-x86-64-appsub.yaml",
+		},
+		{
+			name:       "commit ID",
+			ref:        firstCommit,
+			wantName:   "",
+			wantHash:   firstCommit,
+			wantCommit: firstCommit,
+			wantFile:   "img4.11.0-x86-64-appsub.yaml",
+		},
+		{
+			name:       "newest tag matching pattern",
+			tagPattern: "release-2.8.*",
+			wantName:   "refs/tags/release-2.8.10",
+			wantHash:   annotatedTag,
+			wantCommit: secondCommit,
+			wantFile:   "img4.11.1-x86-64-appsub.yaml",
+		},
+		{
+			name:       "ref takes precedence over tag pattern",
+			ref:        "release-2.8.9",
+			tagPattern: "release-2.8.*",
+			wantName:   "refs/tags/release-2.8.9",
+			wantHash:   firstCommit,
+			wantCommit: firstCommit,
+			wantFile:   "img4.11.0-x86-64-appsub.yaml",
+		},
+		{
+			name:    "ref not found",
+			ref:     "release-2.9.0",
+			wantErr: true,
+		},
+		{
+			name:       "no tag matching pattern",
+			tagPattern: "release-2.9.*",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+			configMap.Name = "configmap-" + strings.ReplaceAll(tt.name, " ", "-")
+			configMap.Data[GitRepoRef] = tt.ref
+			configMap.Data[GitRepoTagPattern] = tt.tagPattern
+			_ = c.Create(context.TODO(), configMap)
+
+			s := &gitSource{
+				client:    c,
+				log:       zapr.NewLogger(zapLog),
+				configMap: configMap.Name,
+				cacheDir:  t.TempDir(),
+			}
+
+			lastCommitID, err := getTestLastCommitID(s)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("ClusterImageSetController.getHTTPOptions() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("gitSource.getLastCommitID() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if err != nil {
+				return
+			}
+			if lastCommitID != tt.wantHash {
+				t.Errorf("gitSource.getLastCommitID() = %v, want %v", lastCommitID, tt.wantHash)
+			}
+
+			repo, ref, err := syncTestGitRepo(s)
+			if err != nil {
+				t.Fatalf("gitSource.syncGitRepo() error = %v", err)
+			}
+			if string(ref.name) != tt.wantName || ref.hash.String() != tt.wantHash {
+				t.Errorf("gitSource.syncGitRepo() ref = %v, want %v (%v)", ref, tt.wantName, tt.wantHash)
+			}
+
+			head, err := repo.Head()
+			if err != nil {
+				t.Fatalf("failed to get HEAD: %v", err)
+			}
+			if head.Hash().String() != tt.wantCommit {
+				t.Errorf("gitSource.syncGitRepo() HEAD = %v, want %v", head.Hash(), tt.wantCommit)
+			}
+
+			files, err := os.ReadDir(filepath.Join(s.getGitRepoDir(), "clusterImageSets", "fast"))
+			if err != nil {
+				t.Fatalf("failed to read the local Git repository: %v", err)
+			}
+			if len(files) == 0 || files[len(files)-1].Name() != tt.wantFile {
+				t.Errorf("gitSource.syncGitRepo() files = %v, want last file %v", files, tt.wantFile)
+			}
 		})
 	}
 }
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{a: "release-2.8.10", b: "release-2.8.9", want: 1},
+		{a: "release-2.8.9", b: "release-2.8.10", want: -1},
+		{a: "release-2.8.9", b: "release-2.8.9", want: 0},
+		{a: "release-2.8", b: "release-2.8.0", want: -1},
+		{a: "release-2.9.0", b: "release-2.10.0", want: -1},
+		{a: "v4.11.007", b: "v4.11.7", want: 0},
+		{a: "release-2.8.1-rc", b: "release-2.8.1", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			if got := compareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareVersions(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitRepoFallbackUrls(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	gitRoot := t.TempDir()
+	commit := commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+	})
+	mirror := newGitHTTPServer(t, gitRoot)
+
+	// The primary server fails with the status code, or serves the repository when it is 0
+	var primaryStatus int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := atomic.LoadInt32(&primaryStatus); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		mirror.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer primary.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	c := initClient()
+	configMap := getConfigMap(primary.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	configMap.Data[GitRepoFallbackUrls] = down.URL + "/releases.git,\n" + mirror.URL + "/releases.git"
+	configMap.Data[Retries] = "0"
+	g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+
+	zapLog, _ := zap.NewDevelopment()
+	cacheDir := t.TempDir()
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:             zapr.NewLogger(zapLog),
+		Interval:        60,
+		ConfigMap:       configMap.Name,
+		Secret:          "secret",
+		CacheDir:        cacheDir,
+		StatusConfigMap: DefaultStatusConfigMap,
+	})
+
+	tests := []struct {
+		name    string
+		status  int32
+		wantURL string
+		wantErr bool
+	}{
+		{
+			name:    "primary URL",
+			wantURL: primary.URL + "/releases.git",
+		},
+		{
+			name:    "server error fails over",
+			status:  http.StatusServiceUnavailable,
+			wantURL: mirror.URL + "/releases.git",
+		},
+		{
+			name:    "authentication failure fails over",
+			status:  http.StatusUnauthorized,
+			wantURL: mirror.URL + "/releases.git",
+		},
+		{
+			name:    "missing repository fails over",
+			status:  http.StatusNotFound,
+			wantURL: mirror.URL + "/releases.git",
+		},
+		{
+			name:    "bad request does not fail over",
+			status:  http.StatusBadRequest,
+			wantErr: true,
+		},
+		{
+			name:    "back to the primary URL",
+			wantURL: primary.URL + "/releases.git",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			atomic.StoreInt32(&primaryStatus, tt.status)
+
+			revision, err := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", cacheDir).Revision()
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(iCtrl.syncClusterImageSet(true)).NotTo(gomega.Succeed())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(revision).To(gomega.Equal(commit))
+
+			// The working copy is reused whatever the URL it was synced from
+			iCtrl.lastRevision = ""
+			g.Expect(iCtrl.syncClusterImageSet(true)).To(gomega.Succeed())
+			g.Expect(getStatus(t, c, configMap.Name).URL).To(gomega.Equal(tt.wantURL))
+
+			repo, err := git.PlainOpen(filepath.Join(cacheDir, configMap.Name))
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			remote, err := repo.Remote(git.DefaultRemoteName)
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(remote.Config().URLs).To(gomega.Equal([]string{tt.wantURL}))
+		})
+	}
+}
+
+// newGitHTTPServer serves the Git repositories under root over the Git smart HTTP protocol,
+// using git http-backend as a stand-in for the Git server.
+// newCertificatePEM returns a PEM encoded self-signed CA certificate
+func newCertificatePEM(t *testing.T, commonName string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func newGitHTTPServer(t *testing.T, root string) *httptest.Server {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is required to serve the test Git repository")
+	}
+
+	server := httptest.NewServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// commitGitRepoFiles writes the files to the Git repository in repoDir, initializing the
+// repository if needed, and returns the ID of the new commit.
+func commitGitRepoFiles(t *testing.T, repoDir string, files map[string]string) string {
+	repo, err := git.PlainOpen(repoDir)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(repoDir, false)
+	}
+	if err != nil {
+		t.Fatalf("failed to open Git repository: %v", err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("failed to get Git worktree: %v", err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(repoDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		if _, err := worktree.Add(name); err != nil {
+			t.Fatalf("failed to add file: %v", err)
+		}
+	}
+
+	commit, err := worktree.Commit("update clusterImageSets", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	return commit.String()
+}
+
+// tagGitRepo tags the HEAD commit of the Git repository in repoDir and returns the ID of
+// the tag object for annotated tags, or the commit ID otherwise.
+func tagGitRepo(t *testing.T, repoDir, name string, annotated bool) string {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		t.Fatalf("failed to open Git repository: %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("failed to get HEAD: %v", err)
+	}
+
+	if !annotated {
+		ref := plumbing.NewHashReference(plumbing.NewTagReferenceName(name), head.Hash())
+		if err := repo.Storer.SetReference(ref); err != nil {
+			t.Fatalf("failed to create tag: %v", err)
+		}
+		return head.Hash().String()
+	}
+
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		Message:    name,
+		TargetType: plumbing.CommitObject,
+		Target:     head.Hash(),
+	}
+	obj := repo.Storer.NewEncodedObject()
+	if err := tag.Encode(obj); err != nil {
+		t.Fatalf("failed to encode tag: %v", err)
+	}
+	tagHash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatalf("failed to store tag: %v", err)
+	}
+
+	ref := plumbing.NewHashReference(plumbing.NewTagReferenceName(name), tagHash)
+	if err := repo.Storer.SetReference(ref); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+
+	return tagHash.String()
+}
+
+// runGit runs the git command line in dir, for the repository setups go-git cannot create
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "protocol.allow=always"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %v: %s", args, err, output)
+	}
+
+	return string(output)
+}
+
+// syncTestGitRepo syncs the local Git repository with the current configuration of the source
+func syncTestGitRepo(s *gitSource) (*git.Repository, *gitRepoRef, error) {
+	config, err := s.getGitRepoConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.syncGitRepo(config)
+}
+
+// getTestLastCommitID returns the commit ID of the reference configured for the source
+func getTestLastCommitID(s *gitSource) (string, error) {
+	config, err := s.getGitRepoConfig()
+	if err != nil {
+		return "", err
+	}
+
+	return s.getLastCommitID(config)
+}
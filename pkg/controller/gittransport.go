@@ -0,0 +1,92 @@
+package clusterimageset
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitclient "gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+func init() {
+	// go-git selects the transport of a Git repository URL from a global protocol table. The
+	// HTTP(S) entries are replaced once by a transport that holds no configuration, and takes
+	// the HTTP client of each clone and fetch from its gitHTTPAuth.
+	gitclient.InstallProtocol("https", gitHTTPTransport{})
+	gitclient.InstallProtocol("http", gitHTTPTransport{})
+}
+
+// gitHTTPAuth is the authentication of a clone or fetch over HTTP(S). It carries the HTTP client
+// built from the source configuration, with its TLS settings, along with the credentials.
+type gitHTTPAuth struct {
+	client *http.Client
+	// auth is the basic or token authentication, nil for anonymous access
+	auth githttp.AuthMethod
+}
+
+func (a *gitHTTPAuth) Name() string {
+	if a.auth != nil {
+		return a.auth.Name()
+	}
+
+	return "http-anonymous"
+}
+
+func (a *gitHTTPAuth) String() string {
+	if a.auth != nil {
+		return a.auth.String()
+	}
+
+	return a.Name()
+}
+
+// gitHTTPTransport is the go-git HTTP(S) transport that uses the HTTP client of the gitHTTPAuth
+// it is given. Other authentication methods use the default go-git HTTP client.
+type gitHTTPTransport struct{}
+
+func (gitHTTPTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	t, auth := getGitHTTPTransport(auth)
+	return t.NewUploadPackSession(ep, auth)
+}
+
+func (gitHTTPTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	t, auth := getGitHTTPTransport(auth)
+	return t.NewReceivePackSession(ep, auth)
+}
+
+// getGitHTTPTransport returns the go-git HTTP transport and the credentials of the authentication
+func getGitHTTPTransport(auth transport.AuthMethod) (transport.Transport, transport.AuthMethod) {
+	httpAuth, ok := auth.(*gitHTTPAuth)
+	if !ok {
+		return githttp.DefaultClient, auth
+	}
+
+	// Do not pass a typed nil, go-git rejects it as an invalid authentication method
+	if httpAuth.auth == nil {
+		return githttp.NewClient(httpAuth.client), nil
+	}
+
+	return githttp.NewClient(httpAuth.client), httpAuth.auth
+}
+
+// gitSSHAuth is the SSH public key authentication of a clone or fetch, with the connect timeout
+// of the source configuration.
+type gitSSHAuth struct {
+	*gitssh.PublicKeys
+	connectTimeout time.Duration
+}
+
+func (a *gitSSHAuth) ClientConfig() (*ssh.ClientConfig, error) {
+	config, err := a.PublicKeys.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	config.Timeout = a.connectTimeout
+
+	return config, nil
+}
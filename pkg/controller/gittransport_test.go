@@ -0,0 +1,246 @@
+package clusterimageset
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestGitHTTPTransport(t *testing.T) {
+	gitRoot := t.TempDir()
+	commit := commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+
+	server := newGitHTTPSServer(t, gitRoot)
+	caCerts := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	c := initClient()
+	configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	if err := c.Create(context.TODO(), configMap); err != nil {
+		t.Fatalf("failed to create config map: %v", err)
+	}
+
+	zapLog, _ := zap.NewDevelopment()
+	s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+	// The TLS settings of each sync come from the current configuration, and never leak into
+	// the next syncs
+	tests := []struct {
+		name    string
+		data    map[string]string
+		wantErr bool
+	}{
+		{name: "CA", data: map[string]string{CaCerts: caCerts}},
+		{name: "default after CA", data: map[string]string{}, wantErr: true},
+		{name: "insecure", data: map[string]string{InsecureSkipVerify: "true"}},
+		{name: "default after insecure", data: map[string]string{}, wantErr: true},
+		{name: "CA again", data: map[string]string{CaCerts: caCerts}},
+		{name: "invalid insecure value after CA", data: map[string]string{InsecureSkipVerify: "yes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updateConfigMap(t, c, configMap.Name, func(cm *corev1.ConfigMap) {
+				delete(cm.Data, CaCerts)
+				delete(cm.Data, InsecureSkipVerify)
+				for key, value := range tt.data {
+					cm.Data[key] = value
+				}
+			})
+
+			lastCommitID, err := getTestLastCommitID(s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitSource.getLastCommitID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			_, ref, syncErr := syncTestGitRepo(s)
+			if (syncErr != nil) != tt.wantErr {
+				t.Fatalf("gitSource.syncGitRepo() error = %v, wantErr %v", syncErr, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+			if lastCommitID != commit || ref.hash.String() != commit {
+				t.Errorf("gitSource commit = %v, %v, want %v", lastCommitID, ref.hash, commit)
+			}
+		})
+	}
+
+	// Sources with different TLS settings sync side by side
+	trusted := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	trusted.Name = "trusted"
+	trusted.Data[CaCerts] = caCerts
+	untrusted := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	untrusted.Name = "untrusted"
+	for _, cm := range []*corev1.ConfigMap{trusted, untrusted} {
+		if err := c.Create(context.TODO(), cm); err != nil {
+			t.Fatalf("failed to create config map: %v", err)
+		}
+	}
+
+	trustedSource := newGitSource(c, zapr.NewLogger(zapLog), trusted.Name, "secret", t.TempDir())
+	untrustedSource := newGitSource(c, zapr.NewLogger(zapLog), untrusted.Name, "secret", t.TempDir())
+
+	for i := 0; i < 2; i++ {
+		if _, err := trustedSource.Fetch(); err != nil {
+			t.Errorf("gitSource.Fetch() of the source with the CA error = %v", err)
+		}
+		if _, err := untrustedSource.Fetch(); err == nil {
+			t.Errorf("gitSource.Fetch() of the source without the CA succeeded")
+		}
+	}
+}
+
+func TestGitCABundleConfigMap(t *testing.T) {
+	gitRoot := t.TempDir()
+	commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+
+	server := newGitHTTPSServer(t, gitRoot)
+	caCerts := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	c := initClient()
+	configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	configMap.Data[CaBundleConfigMapRef] = "trusted-ca-bundle"
+	if err := c.Create(context.TODO(), configMap); err != nil {
+		t.Fatalf("failed to create config map: %v", err)
+	}
+
+	zapLog, _ := zap.NewDevelopment()
+	s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+	if _, err := getTestLastCommitID(s); err == nil {
+		t.Errorf("gitSource.getLastCommitID() without the CA bundle config map succeeded")
+	}
+
+	// OpenShift creates the configmap empty, and injects the bundle afterwards
+	bundle := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "trusted-ca-bundle",
+			Namespace: "multicluster-engine",
+			Labels:    map[string]string{"config.openshift.io/inject-trusted-cabundle": "true"},
+		},
+	}
+	if err := c.Create(context.TODO(), bundle); err != nil {
+		t.Fatalf("failed to create config map: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		bundle  string
+		wantErr bool
+	}{
+		{name: "not injected", bundle: "", wantErr: true},
+		{name: "injected", bundle: "# server\n" + caCerts},
+		{name: "rotated to another CA", bundle: newCertificatePEM(t, "other"), wantErr: true},
+		{name: "rotated back", bundle: newCertificatePEM(t, "other") + caCerts},
+		{name: "malformed", bundle: caCerts + "-----BEGIN CERTIFICATE-----\nMIIF", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updateConfigMap(t, c, "trusted-ca-bundle", func(cm *corev1.ConfigMap) {
+				cm.Data = map[string]string{DefaultCaBundleConfigMapKey: tt.bundle}
+			})
+
+			_, err := getTestLastCommitID(s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitSource.getLastCommitID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGitHTTPRedirect(t *testing.T) {
+	gitRoot := t.TempDir()
+	commit := commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+
+	gitServer := newGitHTTPServer(t, gitRoot)
+	otherHost := newGitHTTPServer(t, gitRoot)
+
+	// The renamed repository redirects to its new name, the moved repository to another host
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/renamed.git/"):
+			http.Redirect(w, r, strings.Replace(r.URL.RequestURI(), "/renamed.git/", "/releases.git/", 1), http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, "/moved.git/"):
+			http.Redirect(w, r, otherHost.URL+strings.Replace(r.URL.RequestURI(), "/moved.git/", "/releases.git/", 1), http.StatusMovedPermanently)
+		default:
+			gitServer.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name    string
+		repo    string
+		wantErr bool
+	}{
+		{name: "same host", repo: "/renamed.git"},
+		{name: "another host", repo: "/moved.git", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := initClient()
+			configMap := getConfigMap(server.URL+tt.repo, "master", "clusterImageSets", "fast")
+			if err := c.Create(context.TODO(), configMap); err != nil {
+				t.Fatalf("failed to create config map: %v", err)
+			}
+
+			zapLog, _ := zap.NewDevelopment()
+			s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+			_, ref, err := syncTestGitRepo(s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitSource.syncGitRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && ref.hash.String() != commit {
+				t.Errorf("gitSource.syncGitRepo() commit = %v, want %v", ref.hash, commit)
+			}
+		})
+	}
+}
+
+func newGitHTTPSServer(t *testing.T, root string) *httptest.Server {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is required to serve the test Git repository")
+	}
+
+	server := httptest.NewTLSServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func updateConfigMap(t *testing.T, c client.Client, name string, update func(*corev1.ConfigMap)) {
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(context.TODO(), client.ObjectKey{Name: name, Namespace: "multicluster-engine"}, configMap); err != nil {
+		t.Fatalf("failed to get config map: %v", err)
+	}
+
+	update(configMap)
+
+	if err := c.Update(context.TODO(), configMap); err != nil {
+		t.Fatalf("failed to update config map: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package clusterimageset
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Update graph source configurations (in configmap)
+	GraphUrl      = "graphUrl"
+	GraphChannels = "graphChannels"
+	GraphArch     = "graphArch"
+
+	// Default values
+	DefaultGraphUrl  = "https://api.openshift.com/api/upgrades_info/v1/graph"
+	DefaultGraphArch = "amd64"
+)
+
+// graphArchitectures maps the architectures of the update graph to the ones of the release
+// image tags, which are used in the clusterImageSet names
+var graphArchitectures = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+// graphSource queries an OpenShift update graph (Cincinnati) service, like api.openshift.com or
+// an OpenShift Update Service instance, and generates a clusterImageSet for each release of the
+// configured channels.
+type graphSource struct {
+	client    client.Client
+	log       logr.Logger
+	configMap string
+	secret    string
+}
+
+func newGraphSource(c client.Client, log logr.Logger, configMap, secret string) *graphSource {
+	return &graphSource{
+		client:    c,
+		log:       log.WithValues("source", configMap),
+		configMap: configMap,
+		secret:    secret,
+	}
+}
+
+func (s *graphSource) Name() string {
+	return s.configMap
+}
+
+// Revision returns the digest of the generated clusterImageSets
+func (s *graphSource) Revision() (string, error) {
+	content, err := s.Fetch()
+	if err != nil {
+		return "", err
+	}
+
+	return content.Revision, nil
+}
+
+func (s *graphSource) Fetch() (*SourceContent, error) {
+	config, err := getSourceConfig(s.client, s.log, s.configMap, s.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := []string{}
+	for _, channel := range strings.Split(config.graphChannels, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			channels = append(channels, channel)
+		}
+	}
+
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("%s is required in config map %v for %s source", GraphChannels, s.configMap, SourceTypeGraph)
+	}
+
+	auth, err := getSourceAuth(s.client, s.log, config.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig, err := getTLSClientConfig(s.log, config, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := newHTTPClient(s.log, config, clientConfig)
+
+	arch := config.graphArch
+	if releaseArch, ok := graphArchitectures[arch]; ok {
+		arch = releaseArch
+	}
+
+	manifests := []Manifest{}
+	names := map[string]bool{}
+
+	for _, channel := range channels {
+		nodes, err := getGraphNodes(httpClient, config.graphUrl, channel, config.graphArch)
+		if err != nil {
+			return nil, err
+		}
+
+		s.log.Info(fmt.Sprintf("generating clusterImageSets from %d releases of channel %v in update graph: %v", len(nodes), channel, config.graphUrl))
+
+		// The channel label is the channel name without the version, like the Git repository directories
+		channelLabel := channel
+		if i := strings.LastIndex(channel, "-"); i > 0 {
+			channelLabel = channel[:i]
+		}
+
+		for _, node := range nodes {
+			if parseSemver(node.Version) == nil || node.Payload == "" {
+				s.log.Info(fmt.Sprintf("skipping invalid release %v in channel %v", node.Version, channel))
+				continue
+			}
+
+			imageset := newReleaseClusterImageSet(node.Version, arch, node.Payload, channelLabel)
+
+			// A release can be in several of the channels, the first channel wins
+			if names[imageset.GetName()] {
+				continue
+			}
+			names[imageset.GetName()] = true
+
+			data, err := yaml.Marshal(imageset)
+			if err != nil {
+				return nil, err
+			}
+
+			manifests = append(manifests, Manifest{Path: channel + "/" + node.Version + ".yaml", Data: data})
+		}
+	}
+
+	return &SourceContent{Revision: getManifestsDigest(manifests), Manifests: manifests}, nil
+}
+
+// graphNode is a release in the update graph
+type graphNode struct {
+	Version string `json:"version"`
+	Payload string `json:"payload"`
+}
+
+// getGraphNodes returns the releases of the channel, sorted by version
+func getGraphNodes(httpClient *http.Client, graphURL, channel, arch string) ([]graphNode, error) {
+	requestURL, err := url.Parse(graphURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", GraphUrl, graphURL, err)
+	}
+
+	query := requestURL.Query()
+	query.Set("channel", channel)
+	query.Set("arch", arch)
+	requestURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get update graph %v: %v", requestURL, resp.Status)
+	}
+
+	body, err := readLimited(resp.Body, maxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := struct {
+		Nodes []graphNode `json:"nodes"`
+	}{}
+	if err := json.Unmarshal(body, &graph); err != nil {
+		return nil, fmt.Errorf("failed to parse update graph %v: %w", requestURL, err)
+	}
+
+	sort.SliceStable(graph.Nodes, func(i, j int) bool {
+		a, b := parseSemver(graph.Nodes[i].Version), parseSemver(graph.Nodes[j].Version)
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return compareSemver(a, b) < 0
+	})
+
+	return graph.Nodes, nil
+}
@@ -0,0 +1,156 @@
+package clusterimageset
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	"github.com/stolostron/cluster-imageset-controller/test/integration/util"
+	"go.uber.org/zap"
+)
+
+func TestGraphSource(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	// Update graph stand-in, the releases of each channel and architecture
+	graphs := map[string][]graphNode{
+		"fast-4.12/amd64": {
+			{Version: "4.12.1", Payload: getPayload("4121")},
+			{Version: "4.12.0", Payload: getPayload("4120")},
+		},
+		"fast-4.13/amd64": {
+			{Version: "4.13.0", Payload: getPayload("4130")},
+			{Version: "4.12.1", Payload: getPayload("4121")},
+			{Version: "not-a-version", Payload: getPayload("0")},
+		},
+		"stable-4.12/arm64": {
+			{Version: "4.12.0", Payload: getPayload("a120")},
+		},
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/upgrades_info/v1/graph" || r.Header.Get("Accept") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		nodes, ok := graphs[r.URL.Query().Get("channel")+"/"+r.URL.Query().Get("arch")]
+		if !ok {
+			nodes = []graphNode{}
+		}
+
+		body, _ := json.Marshal(map[string]interface{}{"nodes": nodes, "edges": [][]int{}})
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	caCerts := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	tests := []struct {
+		name          string
+		data          map[string]string
+		wantImagesets map[string]string
+		wantChannel   string
+		wantErr       bool
+	}{
+		{
+			name: "fast channels",
+			data: map[string]string{
+				GraphChannels: "fast-4.12, fast-4.13",
+			},
+			wantImagesets: map[string]string{
+				"img4.12.0-x86-64-appsub": getPayload("4120"),
+				"img4.12.1-x86-64-appsub": getPayload("4121"),
+				"img4.13.0-x86-64-appsub": getPayload("4130"),
+			},
+			wantChannel: "fast",
+		},
+		{
+			name: "arm64",
+			data: map[string]string{
+				GraphChannels: "stable-4.12",
+				GraphArch:     "arm64",
+			},
+			wantImagesets: map[string]string{
+				"img4.12.0-aarch64-appsub": getPayload("a120"),
+			},
+			wantChannel: "stable",
+		},
+		{
+			name:    "no channels",
+			data:    map[string]string{},
+			wantErr: true,
+		},
+		{
+			name: "graph not found",
+			data: map[string]string{
+				GraphChannels: "fast-4.12",
+				GraphUrl:      server.URL + "/missing",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			tt.data[SourceType] = SourceTypeGraph
+			tt.data[CaCerts] = caCerts
+			if tt.data[GraphUrl] == "" {
+				tt.data[GraphUrl] = server.URL + "/api/upgrades_info/v1/graph"
+			}
+			g.Expect(c.Create(context.TODO(), getSourceConfigMap("graph", tt.data))).To(gomega.Succeed())
+
+			s := newGraphSource(c, log, "graph", "secret")
+
+			content, err := s.Fetch()
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			iCtrl := &ClusterImageSetController{client: c, log: log}
+			imagesets, _, err := iCtrl.loadImageSets(content)
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			gotImagesets := map[string]string{}
+			for _, imageset := range imagesets {
+				gotImagesets[imageset.GetName()] = imageset.Spec.ReleaseImage
+				g.Expect(imageset.GetLabels()[util.ChannelLabel]).To(gomega.Equal(tt.wantChannel))
+				g.Expect(imageset.GetLabels()[VisibleLabel]).To(gomega.Equal("true"))
+			}
+			g.Expect(gotImagesets).To(gomega.Equal(tt.wantImagesets))
+
+			revision, err := s.Revision()
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(revision).To(gomega.Equal(content.Revision))
+		})
+	}
+
+	// The CA of the graph server is required
+	g := gomega.NewGomegaWithT(t)
+
+	c := initClient()
+	g.Expect(c.Create(context.TODO(), getSourceConfigMap("graph", map[string]string{
+		SourceType:    SourceTypeGraph,
+		GraphUrl:      server.URL + "/api/upgrades_info/v1/graph",
+		GraphChannels: "fast-4.12",
+	}))).To(gomega.Succeed())
+
+	_, err := newGraphSource(c, log, "graph", "secret").Fetch()
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+// getPayload returns a release payload pulled by digest, the sha256 digest repeats the prefix
+func getPayload(prefix string) string {
+	return "quay.io/openshift-release-dev/ocp-release@sha256:" + strings.Repeat(prefix, 64/len(prefix))
+}
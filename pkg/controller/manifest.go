@@ -0,0 +1,152 @@
+package clusterimageset
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	hivev1 "github.com/openshift/hive/apis/hive/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	clusterImageSetKind     = "ClusterImageSet"
+	clusterImageSetListKind = "ClusterImageSetList"
+	listKind                = "List"
+	listAPIVersion          = "v1"
+
+	// maxImageNameLength is the maximum length of the repository name of an image reference
+	maxImageNameLength = 255
+)
+
+var (
+	// imageReferenceRegexp matches the [registry[:port]/]repository[:tag][@digest] syntax of the
+	// image references, as defined by the OCI distribution specification
+	imageReferenceRegexp = regexp.MustCompile(`^` +
+		`((?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?/)?` +
+		`[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*)` +
+		`(?::([\w][\w.-]{0,127}))?` +
+		`(?:@([A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}))?` +
+		`$`)
+)
+
+// loadClusterImageSetDocument returns the clusterImageSets of a YAML document, none when the
+// document is empty. In strict mode, unknown and duplicate fields are rejected.
+func loadClusterImageSetDocument(document []byte, strict bool) ([]*hivev1.ClusterImageSet, error) {
+	data, err := yaml.YAMLToJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	if string(data) == "null" {
+		return nil, nil
+	}
+
+	typeMeta := &metav1.TypeMeta{}
+	if err := yaml.Unmarshal(document, typeMeta); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case typeMeta.Kind == listKind && typeMeta.APIVersion == listAPIVersion:
+	case typeMeta.Kind == clusterImageSetListKind && typeMeta.APIVersion == hivev1.SchemeGroupVersion.String():
+	default:
+		imageset, err := loadClusterImageSet(document, strict, false)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*hivev1.ClusterImageSet{imageset}, nil
+	}
+
+	list := &struct {
+		metav1.TypeMeta `json:",inline"`
+		metav1.ListMeta `json:"metadata,omitempty"`
+		Items           []json.RawMessage `json:"items"`
+	}{}
+	if err := unmarshalManifest(document, list, strict); err != nil {
+		return nil, err
+	}
+
+	imagesets := []*hivev1.ClusterImageSet{}
+	for i, item := range list.Items {
+		// The items of a typed list may leave out their apiVersion and kind
+		imageset, err := loadClusterImageSet(item, strict, typeMeta.Kind == clusterImageSetListKind)
+		if err != nil {
+			return nil, fmt.Errorf("item %d of %s: %w", i+1, typeMeta.Kind, err)
+		}
+		imagesets = append(imagesets, imageset)
+	}
+
+	return imagesets, nil
+}
+
+// loadClusterImageSet unmarshals and validates a clusterImageSet
+func loadClusterImageSet(data []byte, strict, typeOptional bool) (*hivev1.ClusterImageSet, error) {
+	imageset := &hivev1.ClusterImageSet{}
+	if err := unmarshalManifest(data, imageset, strict); err != nil {
+		return nil, err
+	}
+
+	if !typeOptional || imageset.APIVersion != "" || imageset.Kind != "" {
+		if imageset.APIVersion != hivev1.SchemeGroupVersion.String() || imageset.Kind != clusterImageSetKind {
+			return nil, fmt.Errorf("unsupported apiVersion %q and kind %q, expected apiVersion %s and kind %s, %s or %s %s",
+				imageset.APIVersion, imageset.Kind, hivev1.SchemeGroupVersion.String(), clusterImageSetKind,
+				clusterImageSetListKind, listAPIVersion, listKind)
+		}
+	}
+
+	if err := validateClusterImageSet(imageset); err != nil {
+		return nil, err
+	}
+
+	return imageset, nil
+}
+
+func unmarshalManifest(data []byte, obj interface{}, strict bool) error {
+	if strict {
+		return yaml.UnmarshalStrict(data, obj, yaml.DisallowUnknownFields)
+	}
+
+	return yaml.Unmarshal(data, obj)
+}
+
+// validateClusterImageSet checks the fields of a clusterImageSet that the controller relies on,
+// before it is applied
+func validateClusterImageSet(imageset *hivev1.ClusterImageSet) error {
+	if imageset.Name == "" {
+		return fmt.Errorf("metadata.name is required")
+	}
+
+	if errs := validation.IsDNS1123Subdomain(imageset.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid metadata.name %q: %s", imageset.Name, strings.Join(errs, ", "))
+	}
+
+	if imageset.Spec.ReleaseImage == "" {
+		return fmt.Errorf("spec.releaseImage of clusterImageSet %s is required", imageset.Name)
+	}
+
+	if err := validateImageReference(imageset.Spec.ReleaseImage); err != nil {
+		return fmt.Errorf("invalid spec.releaseImage of clusterImageSet %s: %w", imageset.Name, err)
+	}
+
+	return nil
+}
+
+// validateImageReference checks the syntax of an image reference, such as
+// quay.io/openshift-release-dev/ocp-release:4.14.0-x86_64 or
+// quay.io/openshift-release-dev/ocp-release@sha256:...
+func validateImageReference(reference string) error {
+	matches := imageReferenceRegexp.FindStringSubmatch(reference)
+	if matches == nil {
+		return fmt.Errorf("%q is not a valid image reference", reference)
+	}
+
+	if len(matches[1]) > maxImageNameLength {
+		return fmt.Errorf("the repository name of image reference %q is longer than %d characters", reference, maxImageNameLength)
+	}
+
+	return nil
+}
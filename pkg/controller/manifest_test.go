@@ -0,0 +1,34 @@
+package clusterimageset
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateImageReference(t *testing.T) {
+	tests := []struct {
+		name      string
+		reference string
+		wantErr   bool
+	}{
+		{name: "tag", reference: "quay.io/openshift-release-dev/ocp-release:4.14.0-x86_64"},
+		{name: "digest", reference: "quay.io/openshift-release-dev/ocp-release@sha256:" + strings.Repeat("a1", 32)},
+		{name: "tag and digest", reference: "quay.io/openshift-release-dev/ocp-release:4.14.0-x86_64@sha256:" + strings.Repeat("a1", 32)},
+		{name: "registry port", reference: "registry.example.com:5000/ocp4/openshift4:4.14.0-x86_64"},
+		{name: "no registry", reference: "ocp-release:4.14.0"},
+		{name: "empty", reference: "", wantErr: true},
+		{name: "uppercase repository", reference: "quay.io/openshift-release-dev/OCP-release:4.14.0", wantErr: true},
+		{name: "space", reference: "quay.io/openshift-release-dev/ocp-release:4.14.0 x86_64", wantErr: true},
+		{name: "invalid tag", reference: "quay.io/openshift-release-dev/ocp-release:-4.14.0", wantErr: true},
+		{name: "short digest", reference: "quay.io/openshift-release-dev/ocp-release@sha256:a1b2", wantErr: true},
+		{name: "scheme", reference: "https://quay.io/openshift-release-dev/ocp-release:4.14.0", wantErr: true},
+		{name: "long name", reference: "quay.io/" + strings.Repeat("a", 250) + ":4.14.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateImageReference(tt.reference); (err != nil) != tt.wantErr {
+				t.Errorf("validateImageReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
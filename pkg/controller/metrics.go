@@ -0,0 +1,39 @@
+package clusterimageset
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// signatureVerificationFailures counts the syncs refused because the Git revision is not
+	// signed by a trusted key
+	signatureVerificationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clusterimageset_signature_verification_failures_total",
+			Help: "Number of syncs refused because the signature of the Git revision could not be verified.",
+		},
+		[]string{"source", "reason"},
+	)
+
+	// consecutiveSyncFailures is the number of syncs that failed since the last successful sync
+	consecutiveSyncFailures = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "clusterimageset_sync_consecutive_failures",
+			Help: "Number of consecutive failed syncs since the last successful sync.",
+		},
+	)
+
+	// failedFiles is the number of clusterImageSet files of a source that failed in the last sync
+	failedFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "clusterimageset_sync_failed_files",
+			Help: "Number of clusterImageSet files of the source that failed to be read, loaded or applied in the last sync.",
+		},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(signatureVerificationFailures, consecutiveSyncFailures, failedFiles)
+}
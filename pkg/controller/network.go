@@ -0,0 +1,124 @@
+package clusterimageset
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// Network configurations (in configmap)
+	ConnectTimeout = "connectTimeout"
+	Timeout        = "timeout"
+	Retries        = "retries"
+	RetryBackoff   = "retryBackoff"
+
+	// Default values
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultTimeout        = 60 * time.Second
+	DefaultRetries        = 2
+	DefaultRetryBackoff   = time.Second
+
+	// maxRetryBackoff caps the delay between two attempts of an operation
+	maxRetryBackoff = 30 * time.Second
+)
+
+// retryOperation runs the operation until it succeeds, retrying transient network errors up
+// to the configured number of retries, with a jittered exponential backoff.
+func retryOperation(log logr.Logger, config *sourceConfig, name string, operation func() error) error {
+	backoff := wait.Backoff{
+		Duration: config.retryBackoff,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    config.retries + 1,
+		Cap:      maxRetryBackoff,
+	}
+
+	var lastErr error
+	attempt := 0
+
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		attempt++
+
+		lastErr = operation()
+		if lastErr == nil {
+			return true, nil
+		}
+
+		if !isRetryableError(lastErr) {
+			return false, lastErr
+		}
+
+		if attempt <= config.retries {
+			log.Info(fmt.Sprintf("%s failed: %v, retrying (%d/%d)", name, lastErr.Error(), attempt, config.retries))
+		}
+		return false, nil
+	})
+
+	if wait.Interrupted(err) && lastErr != nil {
+		return lastErr
+	}
+
+	return err
+}
+
+// isRetryableError returns true for the errors that may succeed on a new attempt: connection
+// failures, timeouts, truncated responses, and server errors.
+func isRetryableError(err error) bool {
+	// Certificate errors do not go away by retrying
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return false
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &dnsErr):
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+
+	// go-git reports the unexpected HTTP status codes of the Git server
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		var httpErr *githttp.Err
+		if errors.As(unexpected.Err, &httpErr) {
+			return httpErr.StatusCode() >= 500 || httpErr.StatusCode() == 429
+		}
+	}
+
+	return false
+}
+
+// newDialer returns the dialer of the HTTP transports, with the connect timeout
+func newDialer(config *sourceConfig) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   config.connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// newOperationContext returns the context of a Git operation, with the total timeout
+func newOperationContext(config *sourceConfig) (context.Context, context.CancelFunc) {
+	if config.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), config.timeout)
+}
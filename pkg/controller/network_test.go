@@ -0,0 +1,303 @@
+package clusterimageset
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+func TestGitRetries(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	gitRoot := t.TempDir()
+	commit := commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+	gitServer := newGitHTTPServer(t, gitRoot)
+
+	tests := []struct {
+		name string
+		// status is returned by the server for the first failures requests
+		status   int
+		failures int32
+		delay    time.Duration
+		data     map[string]string
+		// wantRequests is the number of requests that failed
+		wantRequests int32
+		wantErr      bool
+	}{
+		{
+			name:         "server errors are retried",
+			status:       http.StatusServiceUnavailable,
+			failures:     2,
+			data:         map[string]string{Retries: "2"},
+			wantRequests: 2,
+		},
+		{
+			name:         "retries exhausted",
+			status:       http.StatusBadGateway,
+			failures:     10,
+			data:         map[string]string{Retries: "1"},
+			wantRequests: 2,
+			wantErr:      true,
+		},
+		{
+			name:         "rate limit is retried",
+			status:       http.StatusTooManyRequests,
+			failures:     1,
+			data:         map[string]string{},
+			wantRequests: 1,
+		},
+		{
+			name:         "missing repository is not retried",
+			status:       http.StatusNotFound,
+			failures:     10,
+			data:         map[string]string{Retries: "3"},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "authentication failure is not retried",
+			status:       http.StatusUnauthorized,
+			failures:     10,
+			data:         map[string]string{Retries: "3"},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "slow server times out",
+			delay:        5 * time.Second,
+			failures:     10,
+			data:         map[string]string{Timeout: "200ms", Retries: "1"},
+			wantRequests: 2,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			var requests, failed int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) > tt.failures {
+					gitServer.Config.Handler.ServeHTTP(w, r)
+					return
+				}
+
+				atomic.AddInt32(&failed, 1)
+				if tt.delay > 0 {
+					select {
+					case <-time.After(tt.delay):
+					case <-r.Context().Done():
+					}
+				}
+				// The client gave up on the delayed response
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+			}))
+			defer server.Close()
+
+			c := initClient()
+			configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+			configMap.Data[RetryBackoff] = "10ms"
+			for key, value := range tt.data {
+				configMap.Data[key] = value
+			}
+			g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+
+			s := newGitSource(c, log, configMap.Name, "secret", t.TempDir())
+
+			start := time.Now()
+			content, err := s.Fetch()
+			g.Expect(time.Since(start)).To(gomega.BeNumerically("<", 3*time.Second))
+			g.Expect(atomic.LoadInt32(&failed)).To(gomega.Equal(tt.wantRequests))
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(content.Revision).To(gomega.Equal(commit))
+		})
+	}
+}
+
+func TestGitListTimeout(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// The SSH server accepts the connection and never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	c := initClient()
+	configMap := getConfigMap("ssh://git@"+listener.Addr().String()+"/releases.git", "master", "clusterImageSets", "fast")
+	configMap.Data[SSHStrictHostKeyChecking] = "false"
+	configMap.Data[Timeout] = "200ms"
+	configMap.Data[Retries] = "0"
+	g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+
+	secret := getSecret("secret", []byte(""), []byte(""), []byte(""), []byte(""))
+	secret.Data[SSHPrivateKey] = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	g.Expect(c.Create(context.TODO(), secret)).To(gomega.Succeed())
+
+	zapLog, _ := zap.NewDevelopment()
+	s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+	start := time.Now()
+	_, err = getTestLastCommitID(s)
+	g.Expect(time.Since(start)).To(gomega.BeNumerically("<", 3*time.Second))
+	g.Expect(errors.Is(err, context.DeadlineExceeded)).To(gomega.BeTrue())
+}
+
+func TestIsRetryableError(t *testing.T) {
+	unexpectedStatus := func(code int) error {
+		return plumbing.NewUnexpectedError(&githttp.Err{Response: &http.Response{StatusCode: code}})
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "connection refused",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			want: true,
+		},
+		{
+			name: "DNS failure",
+			err:  &url.Error{Op: "Get", URL: "https://git.example.com", Err: &net.DNSError{Err: "no such host"}},
+			want: true,
+		},
+		{
+			name: "timeout",
+			err:  fmt.Errorf("fetch: %w", context.DeadlineExceeded),
+			want: true,
+		},
+		{
+			name: "truncated response",
+			err:  io.ErrUnexpectedEOF,
+			want: true,
+		},
+		{
+			name: "server error",
+			err:  unexpectedStatus(http.StatusInternalServerError),
+			want: true,
+		},
+		{
+			name: "rate limit",
+			err:  unexpectedStatus(http.StatusTooManyRequests),
+			want: true,
+		},
+		{
+			name: "bad request",
+			err:  unexpectedStatus(http.StatusBadRequest),
+			want: false,
+		},
+		{
+			name: "authentication required",
+			err:  transport.ErrAuthenticationRequired,
+			want: false,
+		},
+		{
+			name: "repository not found",
+			err:  transport.ErrRepositoryNotFound,
+			want: false,
+		},
+		{
+			name: "signature",
+			err:  &signatureError{reason: signatureReasonUnsigned, message: "unsigned"},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableError(tt.err); got != tt.want {
+				t.Errorf("isRetryableError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSyncInterval(t *testing.T) {
+	tests := []struct {
+		name        string
+		interval    int
+		maxInterval int
+		failures    int
+		want        time.Duration
+	}{
+		{name: "no failure", interval: 60, maxInterval: 900, failures: 0, want: 60 * time.Second},
+		{name: "below threshold", interval: 60, maxInterval: 900, failures: 2, want: 60 * time.Second},
+		{name: "at threshold", interval: 60, maxInterval: 900, failures: 3, want: 120 * time.Second},
+		{name: "above threshold", interval: 60, maxInterval: 900, failures: 5, want: 480 * time.Second},
+		{name: "capped", interval: 60, maxInterval: 900, failures: 6, want: 900 * time.Second},
+		{name: "capped after many failures", interval: 60, maxInterval: 900, failures: 100, want: 900 * time.Second},
+		{name: "maximum below interval", interval: 60, maxInterval: 30, failures: 5, want: 60 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getSyncInterval(tt.interval, tt.maxInterval, tt.failures); got != tt.want {
+				t.Errorf("getSyncInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordSyncResult(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	iCtrl := NewClusterImageSetController(initClient(), &ImagesetOptions{
+		Log:         zapr.NewLogger(zap.NewNop()),
+		Interval:    60,
+		MaxInterval: 900,
+	})
+
+	for i := 1; i <= 4; i++ {
+		iCtrl.recordSyncResult(errors.New("sync failed"))
+		g.Expect(iCtrl.failures).To(gomega.Equal(i))
+		g.Expect(testutil.ToFloat64(consecutiveSyncFailures)).To(gomega.Equal(float64(i)))
+	}
+
+	iCtrl.recordSyncResult(nil)
+	g.Expect(iCtrl.failures).To(gomega.Equal(0))
+	g.Expect(testutil.ToFloat64(consecutiveSyncFailures)).To(gomega.Equal(float64(0)))
+}
@@ -0,0 +1,547 @@
+package clusterimageset
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// maxManifestSize limits the size of a downloaded OCI manifest
+	maxManifestSize = 4 << 20
+
+	// Media types of the OCI manifests
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociIndexMediaType       = "application/vnd.oci.image.index.v1+json"
+	dockerListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// ociSource is an OCI artifact in a container registry that provides clusterImageSets. Every
+// layer of the artifact is a tar or gzipped tar archive of clusterImageSet files.
+type ociSource struct {
+	client    client.Client
+	log       logr.Logger
+	configMap string
+	secret    string
+}
+
+func newOCISource(c client.Client, log logr.Logger, configMap, secret string) *ociSource {
+	return &ociSource{
+		client:    c,
+		log:       log.WithValues("source", configMap),
+		configMap: configMap,
+		secret:    secret,
+	}
+}
+
+func (s *ociSource) Name() string {
+	return s.configMap
+}
+
+// Revision returns the digest of the artifact manifest with a HEAD request
+func (s *ociSource) Revision() (string, error) {
+	registry, _, err := s.getRegistryClient()
+	if err != nil {
+		return "", err
+	}
+
+	digest, _, err := registry.getManifest(http.MethodHead)
+	if err != nil {
+		return "", err
+	}
+
+	if digest != "" {
+		return digest, nil
+	}
+
+	// The registry did not return the Docker-Content-Digest header, compute it from the manifest
+	digest, _, err = registry.getManifest(http.MethodGet)
+
+	return digest, err
+}
+
+func (s *ociSource) Fetch() (*SourceContent, error) {
+	registry, config, err := s.getRegistryClient()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, body, err := registry.getManifest(http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(body, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of OCI artifact %v: %w", config.ociArtifact, err)
+	}
+
+	if manifest.MediaType == ociIndexMediaType || manifest.MediaType == dockerListMediaType {
+		return nil, fmt.Errorf("OCI artifact %v is an image index, a single manifest is required", config.ociArtifact)
+	}
+
+	s.log.Info(fmt.Sprintf("loading clusterImageSets from OCI artifact: %v (%v)", config.ociArtifact, digest))
+
+	manifests := []Manifest{}
+	for _, layer := range manifest.Layers {
+		blob, err := registry.getBlob(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		layerManifests, err := readTarballManifests(blob, config.ociPath, newManifestFilter(config))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %v of OCI artifact %v: %w", layer.Digest, config.ociArtifact, err)
+		}
+
+		manifests = append(manifests, layerManifests...)
+	}
+
+	return &SourceContent{Revision: digest, Manifests: manifests}, nil
+}
+
+func (s *ociSource) getRegistryClient() (*ociRegistryClient, *sourceConfig, error) {
+	config, err := getSourceConfig(s.client, s.log, s.configMap, s.secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if config.ociArtifact == "" {
+		return nil, nil, fmt.Errorf("%s is required in config map %v for %s source", OCIArtifact, s.configMap, SourceTypeOCI)
+	}
+
+	host, repository, reference, err := parseOCIReference(config.ociArtifact)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	auth, err := getSourceAuth(s.client, s.log, config.secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registry, err := newOCIRegistryClient(s.log, config, auth, host, repository, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return registry, config, nil
+}
+
+// newOCIRegistryClient returns a registry client with the TLS configuration of the source and
+// the registry credentials of the dockerconfigjson secret
+func newOCIRegistryClient(log logr.Logger, config *sourceConfig, auth *sourceAuth, host, repository, reference string) (*ociRegistryClient, error) {
+	registry := &ociRegistryClient{
+		host:       host,
+		repository: repository,
+		reference:  reference,
+	}
+
+	if len(auth.dockerConfigJSON) > 0 {
+		var err error
+		registry.username, registry.password, err = getDockerCredentials(auth.dockerConfigJSON, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clientConfig, err := getTLSClientConfig(log, config, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	registry.httpClient = newHTTPClient(log, config, clientConfig)
+	// registries usually redirect blob downloads to a storage backend
+	registry.httpClient.CheckRedirect = nil
+
+	return registry, nil
+}
+
+// ociManifest is the part of an OCI image manifest that is needed to pull the artifact layers
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociRegistryClient pulls an artifact with the OCI distribution API
+type ociRegistryClient struct {
+	httpClient *http.Client
+	host       string
+	repository string
+	// reference is a tag or a digest
+	reference string
+	username  string
+	password  string
+	// token is the bearer token returned by the registry token service
+	token string
+}
+
+// getManifest returns the digest and the content of the artifact manifest. With a HEAD
+// request the digest is empty unless the registry sets the Docker-Content-Digest header.
+func (r *ociRegistryClient) getManifest(method string) (string, []byte, error) {
+	resp, err := r.do(method, fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.host, r.repository, r.reference),
+		strings.Join([]string{ociManifestMediaType, dockerManifestMediaType, ociIndexMediaType, dockerListMediaType}, ", "))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if method == http.MethodHead {
+		return digest, nil, nil
+	}
+
+	body, err := readLimited(resp.Body, maxManifestSize)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	computed := "sha256:" + hex.EncodeToString(sum[:])
+
+	if isOCIDigest(r.reference) && r.reference != computed {
+		return "", nil, fmt.Errorf("manifest digest %v does not match the requested digest %v", computed, r.reference)
+	}
+
+	return computed, body, nil
+}
+
+// getBlob returns the content of a blob after verifying its digest
+func (r *ociRegistryClient) getBlob(digest string) ([]byte, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported blob digest %v", digest)
+	}
+
+	resp, err := r.do(http.MethodGet, fmt.Sprintf("https://%s/v2/%s/blobs/%s", r.host, r.repository, digest), "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	blob, err := readLimited(resp.Body, maxTarballSize)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(blob)
+	if computed := "sha256:" + hex.EncodeToString(sum[:]); computed != digest {
+		return nil, fmt.Errorf("blob digest %v does not match the expected digest %v", computed, digest)
+	}
+
+	return blob, nil
+}
+
+// listTags returns the tags of the repository, following the pagination links of the registry
+func (r *ociRegistryClient) listTags() ([]string, error) {
+	tags := []string{}
+
+	next := fmt.Sprintf("https://%s/v2/%s/tags/list", r.host, r.repository)
+	for next != "" {
+		resp, err := r.do(http.MethodGet, next, "application/json")
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := readLimited(resp.Body, maxManifestSize)
+		link := resp.Header.Get("Link")
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		page := struct {
+			Tags []string `json:"tags"`
+		}{}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse tags of repository %v/%v: %w", r.host, r.repository, err)
+		}
+		tags = append(tags, page.Tags...)
+
+		next = ""
+		// Link: </v2/<repository>/tags/list?last=<tag>&n=<count>>; rel="next"
+		if start, end := strings.Index(link, "<"), strings.Index(link, ">"); start >= 0 && end > start && strings.Contains(link, `rel="next"`) {
+			nextURL, err := url.Parse(fmt.Sprintf("https://%s/", r.host))
+			if err != nil {
+				return nil, err
+			}
+			nextURL, err = nextURL.Parse(link[start+1 : end])
+			if err != nil {
+				return nil, err
+			}
+			next = nextURL.String()
+		}
+	}
+
+	return tags, nil
+}
+
+// do sends the request, answering a Bearer or Basic authentication challenge of the registry
+func (r *ociRegistryClient) do(method, requestURL, accept string) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		} else if r.username != "" {
+			req.SetBasicAuth(r.username, r.password)
+		}
+
+		return r.httpClient.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		if strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			if err := r.getToken(challenge); err != nil {
+				return nil, err
+			}
+		} else if r.username == "" {
+			return nil, fmt.Errorf("registry %v requires authentication", r.host)
+		}
+
+		resp, err = send()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to get %v: %v", requestURL, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// getToken gets a bearer token from the token service named in the registry challenge
+func (r *ociRegistryClient) getToken(challenge string) error {
+	params := parseAuthChallenge(challenge[len("bearer "):])
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid authentication challenge from registry %v: %v", r.host, challenge)
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", r.repository)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get token for registry %v: %v", r.host, resp.Status)
+	}
+
+	body, err := readLimited(resp.Body, maxManifestSize)
+	if err != nil {
+		return err
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("failed to parse token for registry %v: %w", r.host, err)
+	}
+
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+
+	if r.token == "" {
+		return fmt.Errorf("no token returned for registry %v", r.host)
+	}
+
+	return nil
+}
+
+// parseAuthChallenge returns the parameters of a WWW-Authenticate challenge, like
+// realm="https://auth.example.com/token",service="registry.example.com"
+func parseAuthChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+
+	for challenge != "" {
+		challenge = strings.TrimLeft(challenge, " ,")
+
+		eq := strings.Index(challenge, "=")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(challenge[:eq]))
+		challenge = challenge[eq+1:]
+
+		var value string
+		if strings.HasPrefix(challenge, `"`) {
+			end := strings.Index(challenge[1:], `"`)
+			if end < 0 {
+				value, challenge = challenge[1:], ""
+			} else {
+				value, challenge = challenge[1:end+1], challenge[end+2:]
+			}
+		} else {
+			end := strings.Index(challenge, ",")
+			if end < 0 {
+				value, challenge = challenge, ""
+			} else {
+				value, challenge = challenge[:end], challenge[end:]
+			}
+		}
+
+		params[key] = value
+	}
+
+	return params
+}
+
+// parseOCIReference splits an artifact reference like registry.example.com:5000/releases/imagesets:v1
+// or registry.example.com/releases/imagesets@sha256:... into the registry host, the repository
+// and the tag or digest. The tag defaults to latest.
+func parseOCIReference(ref string) (string, string, string, error) {
+	slash := strings.Index(ref, "/")
+	if slash <= 0 {
+		return "", "", "", fmt.Errorf("invalid OCI artifact reference %q, the registry host is required", ref)
+	}
+
+	host, repository := ref[:slash], ref[slash+1:]
+	reference := "latest"
+
+	if at := strings.Index(repository, "@"); at >= 0 {
+		repository, reference = repository[:at], repository[at+1:]
+		if !isOCIDigest(reference) {
+			return "", "", "", fmt.Errorf("invalid digest in OCI artifact reference %q", ref)
+		}
+	} else if colon := strings.LastIndex(repository, ":"); colon >= 0 {
+		repository, reference = repository[:colon], repository[colon+1:]
+	}
+
+	if repository == "" || reference == "" {
+		return "", "", "", fmt.Errorf("invalid OCI artifact reference %q", ref)
+	}
+
+	return host, repository, reference, nil
+}
+
+func isOCIDigest(reference string) bool {
+	hexPart := strings.TrimPrefix(reference, "sha256:")
+	if hexPart == reference || len(hexPart) != 64 {
+		return false
+	}
+
+	_, err := hex.DecodeString(hexPart)
+	return err == nil
+}
+
+// getDockerCredentials returns the username and password for the registry host from the
+// content of a kubernetes.io/dockerconfigjson secret.
+func getDockerCredentials(data []byte, host string) (string, string, error) {
+	config := struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}{}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("failed to parse the dockerconfigjson secret: %w", err)
+	}
+
+	for server, entry := range config.Auths {
+		// keys can be a bare host or a URL like https://registry.example.com/v1/
+		server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+		if i := strings.Index(server, "/"); i >= 0 {
+			server = server[:i]
+		}
+
+		if server != host {
+			continue
+		}
+
+		if entry.Auth == "" {
+			return entry.Username, entry.Password, nil
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth for registry %v in the dockerconfigjson secret: %w", host, err)
+		}
+
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", "", fmt.Errorf("invalid auth for registry %v in the dockerconfigjson secret", host)
+		}
+
+		return username, password, nil
+	}
+
+	return "", "", nil
+}
+
+// readLimited reads at most limit bytes, it fails if the content is larger
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("content is larger than %d bytes", limit)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,371 @@
+package clusterimageset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ociRegistry is a minimal registry stand-in that serves the artifacts pushed to it, with
+// token authentication like most registries.
+type ociRegistry struct {
+	mutex     sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	server    *httptest.Server
+}
+
+func newOCIRegistry(t *testing.T) *ociRegistry {
+	registry := &ociRegistry{
+		manifests: map[string][]byte{},
+		blobs:     map[string][]byte{},
+	}
+
+	registry.server = httptest.NewTLSServer(http.HandlerFunc(registry.serveHTTP))
+	t.Cleanup(registry.server.Close)
+
+	return registry
+}
+
+func (r *ociRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "https://")
+}
+
+func (r *ociRegistry) caCerts() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.server.Certificate().Raw}))
+}
+
+// push stores an artifact with a single gzipped tar layer and returns the manifest digest
+func (r *ociRegistry) push(t *testing.T, repository, tag string, files map[string]string) string {
+	layer := getTarball(t, files)
+	layerDigest := getDigest(layer)
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.empty.v1+json",
+			"digest":    getDigest([]byte("{}")),
+			"size":      2,
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+			"digest":    layerDigest,
+			"size":      len(layer),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	digest := getDigest(manifest)
+	r.blobs[layerDigest] = layer
+	r.manifests[repository+":"+tag] = manifest
+	r.manifests[repository+"@"+digest] = manifest
+
+	return digest
+}
+
+func (r *ociRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if user, password, ok := req.BasicAuth(); !ok || user != "puller" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("scope") != "repository:releases/imagesets:pull" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token":"pull-token"}`))
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if strings.HasSuffix(path, "/tags/list") {
+		r.serveTags(w, req, strings.TrimSuffix(path, "/tags/list"))
+		return
+	}
+
+	if i := strings.Index(path, "/manifests/"); i >= 0 {
+		reference := path[i+len("/manifests/"):]
+		separator := ":"
+		if strings.HasPrefix(reference, "sha256:") {
+			separator = "@"
+		}
+
+		manifest, ok := r.manifests[path[:i]+separator+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", ociManifestMediaType)
+		w.Header().Set("Docker-Content-Digest", getDigest(manifest))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(manifest)
+		}
+		return
+	}
+
+	if i := strings.Index(path, "/blobs/"); i >= 0 {
+		blob, ok := r.blobs[path[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// serveTags lists the tags of the repository in pages of two tags
+func (r *ociRegistry) serveTags(w http.ResponseWriter, req *http.Request, repository string) {
+	tags := []string{}
+	for reference := range r.manifests {
+		if tag := strings.TrimPrefix(reference, repository+":"); tag != reference {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	last := req.URL.Query().Get("last")
+	start := sort.SearchStrings(tags, last)
+	if start < len(tags) && tags[start] == last {
+		start++
+	}
+
+	end := start + 2
+	if end < len(tags) {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?last=%s&n=2>; rel="next"`, repository, tags[end-1]))
+	} else {
+		end = len(tags)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"name": repository, "tags": tags[start:end]})
+	_, _ = w.Write(body)
+}
+
+func getDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestOCISource(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	registry := newOCIRegistry(t)
+	firstDigest := registry.push(t, "releases/imagesets", "fast", map[string]string{
+		"fast/img4.11.0-x86-64.yaml":   getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+		"stable/img4.10.0-x86-64.yaml": getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+	})
+
+	dockerConfig := fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`,
+		registry.host(), base64.StdEncoding.EncodeToString([]byte("puller:secret")))
+
+	tests := []struct {
+		name          string
+		data          map[string]string
+		dockerConfig  string
+		wantManifests []string
+		wantErr       bool
+	}{
+		{
+			name: "tag with CA",
+			data: map[string]string{
+				OCIArtifact: registry.host() + "/releases/imagesets:fast",
+				OCIPath:     "fast",
+				CaCerts:     registry.caCerts(),
+			},
+			dockerConfig:  dockerConfig,
+			wantManifests: []string{"img4.11.0-x86-64.yaml"},
+		},
+		{
+			name: "digest with insecureSkipVerify",
+			data: map[string]string{
+				OCIArtifact:        registry.host() + "/releases/imagesets@" + firstDigest,
+				InsecureSkipVerify: "true",
+			},
+			dockerConfig:  dockerConfig,
+			wantManifests: []string{"fast/img4.11.0-x86-64.yaml", "stable/img4.10.0-x86-64.yaml"},
+		},
+		{
+			name: "unknown CA",
+			data: map[string]string{
+				OCIArtifact: registry.host() + "/releases/imagesets:fast",
+			},
+			dockerConfig: dockerConfig,
+			wantErr:      true,
+		},
+		{
+			name: "no credentials",
+			data: map[string]string{
+				OCIArtifact: registry.host() + "/releases/imagesets:fast",
+				CaCerts:     registry.caCerts(),
+			},
+			dockerConfig: `{"auths":{}}`,
+			wantErr:      true,
+		},
+		{
+			name: "tag not found",
+			data: map[string]string{
+				OCIArtifact: registry.host() + "/releases/imagesets:candidate",
+				CaCerts:     registry.caCerts(),
+			},
+			dockerConfig: dockerConfig,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			tt.data[SourceType] = SourceTypeOCI
+			g.Expect(c.Create(context.TODO(), getSourceConfigMap("oci", tt.data))).To(gomega.Succeed())
+			g.Expect(c.Create(context.TODO(), getDockerConfigSecret("pull-secret", tt.dockerConfig))).To(gomega.Succeed())
+
+			s := newOCISource(c, log, "oci", "pull-secret")
+
+			revision, err := s.Revision()
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(revision).To(gomega.Equal(firstDigest))
+
+			content, err := s.Fetch()
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(content.Revision).To(gomega.Equal(firstDigest))
+
+			paths := []string{}
+			for _, manifest := range content.Manifests {
+				paths = append(paths, manifest.Path)
+			}
+			g.Expect(paths).To(gomega.ConsistOf(tt.wantManifests))
+		})
+	}
+
+	// Pushing a new artifact to the tag changes the revision
+	g := gomega.NewGomegaWithT(t)
+
+	c := initClient()
+	g.Expect(c.Create(context.TODO(), getSourceConfigMap("oci", map[string]string{
+		SourceType:  SourceTypeOCI,
+		OCIArtifact: registry.host() + "/releases/imagesets:fast",
+		CaCerts:     registry.caCerts(),
+	}))).To(gomega.Succeed())
+	g.Expect(c.Create(context.TODO(), getDockerConfigSecret("pull-secret", dockerConfig))).To(gomega.Succeed())
+
+	secondDigest := registry.push(t, "releases/imagesets", "fast", map[string]string{
+		"fast/img4.11.1-x86-64.yaml": getClusterImageSetYAML("img4.11.1-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.1-x86_64"),
+	})
+
+	revision, err := newOCISource(c, log, "oci", "pull-secret").Revision()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(revision).To(gomega.Equal(secondDigest))
+}
+
+func TestParseOCIReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		ref            string
+		wantHost       string
+		wantRepository string
+		wantReference  string
+		wantErr        bool
+	}{
+		{ref: "registry.example.com:5000/releases/imagesets:v1", wantHost: "registry.example.com:5000", wantRepository: "releases/imagesets", wantReference: "v1"},
+		{ref: "registry.example.com/imagesets", wantHost: "registry.example.com", wantRepository: "imagesets", wantReference: "latest"},
+		{ref: "registry.example.com/imagesets@" + digest, wantHost: "registry.example.com", wantRepository: "imagesets", wantReference: digest},
+		{ref: "registry.example.com/imagesets@sha256:abc", wantErr: true},
+		{ref: "imagesets", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			host, repository, reference, err := parseOCIReference(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOCIReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || repository != tt.wantRepository || reference != tt.wantReference {
+				t.Errorf("parseOCIReference() = %v, %v, %v, want %v, %v, %v",
+					host, repository, reference, tt.wantHost, tt.wantRepository, tt.wantReference)
+			}
+		})
+	}
+}
+
+func TestGetDockerCredentials(t *testing.T) {
+	dockerConfig := `{"auths":{
+		"https://registry.example.com/v1/":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("user1:pass:word")) + `"},
+		"mirror.example.com:5000":{"username":"user2","password":"pass2"},
+		"bad.example.com":{"auth":"bm90LWEtcGFpcg=="}}}`
+
+	tests := []struct {
+		host         string
+		wantUsername string
+		wantPassword string
+		wantErr      bool
+	}{
+		{host: "registry.example.com", wantUsername: "user1", wantPassword: "pass:word"},
+		{host: "mirror.example.com:5000", wantUsername: "user2", wantPassword: "pass2"},
+		{host: "other.example.com"},
+		{host: "bad.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			username, password, err := getDockerCredentials([]byte(dockerConfig), tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getDockerCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if username != tt.wantUsername || password != tt.wantPassword {
+				t.Errorf("getDockerCredentials() = %v, %v, want %v, %v", username, password, tt.wantUsername, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func getDockerConfigSecret(name, dockerConfig string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "multicluster-engine",
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(dockerConfig),
+		},
+	}
+}
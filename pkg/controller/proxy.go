@@ -0,0 +1,101 @@
+package clusterimageset
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-logr/logr"
+	configv1 "github.com/openshift/api/config/v1"
+	"golang.org/x/net/http/httpproxy"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Proxy configurations (in configmap)
+	HTTPProxy       = "httpProxy"
+	HTTPSProxy      = "httpsProxy"
+	NoProxy         = "noProxy"
+	UseClusterProxy = "useClusterProxy"
+
+	// ClusterProxyName is the name of the cluster-wide OpenShift proxy configuration
+	ClusterProxyName = "cluster"
+	// ClusterProxyCANamespace is the namespace of the trusted CA bundle configmap of the cluster proxy
+	ClusterProxyCANamespace = "openshift-config"
+	// ClusterProxyCAKey is the key of the trusted CA bundle in its configmap
+	ClusterProxyCAKey = "ca-bundle.crt"
+)
+
+// proxyConfig is the proxy configuration of a source
+type proxyConfig struct {
+	httpProxy  string
+	httpsProxy string
+	noProxy    string
+	// caCerts is the trusted CA bundle of the cluster proxy, it is trusted in addition to the
+	// system and caCerts certificates
+	caCerts string
+}
+
+// isSet returns true if any proxy is configured
+func (p *proxyConfig) isSet() bool {
+	return p.httpProxy != "" || p.httpsProxy != "" || p.noProxy != ""
+}
+
+// getClusterProxy reads the proxy configuration of the OpenShift cluster, from the status of the
+// config.openshift.io/v1 Proxy object, and its trusted CA bundle.
+func getClusterProxy(c client.Client, log logr.Logger) (*proxyConfig, error) {
+	proxy := &configv1.Proxy{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Name: ClusterProxyName}, proxy); err != nil {
+		log.Info(fmt.Sprintf("unable to get cluster proxy %v: %v", ClusterProxyName, err.Error()))
+		return nil, err
+	}
+
+	// The status holds the effective configuration, with the cluster networks added to noProxy
+	config := &proxyConfig{
+		httpProxy:  proxy.Status.HTTPProxy,
+		httpsProxy: proxy.Status.HTTPSProxy,
+		noProxy:    proxy.Status.NoProxy,
+	}
+
+	if name := proxy.Spec.TrustedCA.Name; name != "" {
+		configMap := &corev1.ConfigMap{}
+		err := c.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: ClusterProxyCANamespace}, configMap)
+		if err != nil {
+			log.Info(fmt.Sprintf("unable to get trusted CA bundle %v of the cluster proxy: %v", name, err.Error()))
+			return nil, err
+		}
+
+		config.caCerts = configMap.Data[ClusterProxyCAKey]
+	}
+
+	return config, nil
+}
+
+// getProxyFunc returns the proxy function of the HTTP transport. The configured proxy is used
+// when set, otherwise the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply.
+func getProxyFunc(log logr.Logger, proxy *proxyConfig) func(*http.Request) (*url.URL, error) {
+	if proxy == nil || !proxy.isSet() {
+		env := httpproxy.FromEnvironment()
+		if env.HTTPProxy == "" && env.HTTPSProxy == "" && env.NoProxy == "" {
+			return nil
+		}
+
+		log.Info(fmt.Sprintf("HTTP_PROXY=%s, HTTPS_PROXY=%s, NO_PROXY=%s", env.HTTPProxy, env.HTTPSProxy, env.NoProxy))
+		return http.ProxyFromEnvironment
+	}
+
+	log.Info(fmt.Sprintf("httpProxy=%s, httpsProxy=%s, noProxy=%s", proxy.httpProxy, proxy.httpsProxy, proxy.noProxy))
+
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  proxy.httpProxy,
+		HTTPSProxy: proxy.httpsProxy,
+		NoProxy:    proxy.noProxy,
+	}).ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
@@ -0,0 +1,223 @@
+package clusterimageset
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProxy(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	tarball := getTarball(t, map[string]string{"fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0"})
+
+	// The tarball server is only reachable through the proxy. Its certificate is valid for example.com.
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(tarball)
+	}))
+	defer tlsServer.Close()
+
+	caCerts := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw}))
+
+	proxy := newTestProxy(t, map[string]http.Handler{
+		"tarballs.example.com": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(tarball)
+		}),
+	}, map[string]string{"example.com:443": tlsServer.Listener.Addr().String()})
+
+	clusterProxy := &configv1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: ClusterProxyName},
+		Spec: configv1.ProxySpec{
+			TrustedCA: configv1.ConfigMapNameReference{Name: "user-ca-bundle"},
+		},
+		Status: configv1.ProxyStatus{
+			HTTPSProxy: proxy.URL,
+			NoProxy:    ".cluster.local,.svc",
+		},
+	}
+	trustedCA := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "user-ca-bundle", Namespace: ClusterProxyCANamespace},
+		Data:       map[string]string{ClusterProxyCAKey: caCerts},
+	}
+
+	tests := []struct {
+		name         string
+		data         map[string]string
+		clusterProxy *configv1.Proxy
+		wantErr      bool
+	}{
+		{
+			name: "http proxy",
+			data: map[string]string{TarballUrl: "http://tarballs.example.com/imagesets.tar.gz", HTTPProxy: proxy.URL},
+		},
+		{
+			name:    "no proxy",
+			data:    map[string]string{TarballUrl: "http://tarballs.example.com/imagesets.tar.gz"},
+			wantErr: true,
+		},
+		{
+			name: "host excluded by noProxy",
+			data: map[string]string{
+				TarballUrl: "http://tarballs.example.com/imagesets.tar.gz",
+				HTTPProxy:  proxy.URL,
+				NoProxy:    ".example.com",
+			},
+			wantErr: true,
+		},
+		{
+			name: "https proxy with caCerts",
+			data: map[string]string{TarballUrl: "https://example.com/imagesets.tar.gz", HTTPSProxy: proxy.URL, CaCerts: caCerts},
+		},
+		{
+			name:         "cluster proxy and its trusted CA",
+			data:         map[string]string{TarballUrl: "https://example.com/imagesets.tar.gz", UseClusterProxy: "true"},
+			clusterProxy: clusterProxy,
+		},
+		{
+			name: "cluster proxy overridden by the configmap",
+			data: map[string]string{
+				TarballUrl:      "https://example.com/imagesets.tar.gz",
+				UseClusterProxy: "true",
+				HTTPSProxy:      proxy.URL,
+			},
+			clusterProxy: &configv1.Proxy{
+				ObjectMeta: metav1.ObjectMeta{Name: ClusterProxyName},
+				Spec:       clusterProxy.Spec,
+				Status:     configv1.ProxyStatus{HTTPSProxy: "http://127.0.0.1:1"},
+			},
+		},
+		{
+			name: "cluster proxy without trusted CA",
+			data: map[string]string{TarballUrl: "https://example.com/imagesets.tar.gz", UseClusterProxy: "true"},
+			clusterProxy: &configv1.Proxy{
+				ObjectMeta: metav1.ObjectMeta{Name: ClusterProxyName},
+				Status:     clusterProxy.Status,
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing cluster proxy",
+			data:    map[string]string{TarballUrl: "https://example.com/imagesets.tar.gz", UseClusterProxy: "true"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			tt.data[SourceType] = SourceTypeTarball
+			g.Expect(c.Create(context.TODO(), getSourceConfigMap("tarball", tt.data))).To(gomega.Succeed())
+			g.Expect(c.Create(context.TODO(), trustedCA.DeepCopy())).To(gomega.Succeed())
+			if tt.clusterProxy != nil {
+				g.Expect(c.Create(context.TODO(), tt.clusterProxy.DeepCopy())).To(gomega.Succeed())
+			}
+
+			content, err := newTarballSource(c, log, "tarball", "secret").Fetch()
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(content.Manifests).To(gomega.HaveLen(1))
+		})
+	}
+}
+
+func TestGitProxy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is required to serve the test Git repository")
+	}
+
+	gitRoot := t.TempDir()
+	commit := commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": "img4.11.0",
+	})
+
+	// The Git server is only reachable through the proxy, without any custom CA
+	proxy := newTestProxy(t, map[string]http.Handler{
+		"git.example.com": &cgi.Handler{
+			Path: gitPath,
+			Args: []string{"http-backend"},
+			Env:  []string{"GIT_PROJECT_ROOT=" + gitRoot, "GIT_HTTP_EXPORT_ALL=1"},
+		},
+	}, nil)
+
+	c := initClient()
+	configMap := getConfigMap("http://git.example.com/releases.git", "master", "clusterImageSets", "fast")
+	configMap.Data[HTTPProxy] = proxy.URL
+	g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+
+	zapLog, _ := zap.NewDevelopment()
+	s := newGitSource(c, zapr.NewLogger(zapLog), configMap.Name, "secret", t.TempDir())
+
+	content, err := s.Fetch()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(content.Revision).To(gomega.Equal(commit))
+}
+
+// newTestProxy starts an HTTP proxy that serves the plain HTTP requests of the hosts with their
+// handlers, and tunnels the CONNECT requests of the addresses to the given listen addresses.
+func newTestProxy(t *testing.T, hosts map[string]http.Handler, tunnels map[string]string) *httptest.Server {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			handler, ok := hosts[r.URL.Host]
+			if !ok {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		addr, ok := tunnels[r.Host]
+		if !ok {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(conn, upstream)
+			conn.Close()
+		}()
+	}))
+
+	t.Cleanup(proxy.Close)
+
+	return proxy
+}
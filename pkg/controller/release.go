@@ -0,0 +1,353 @@
+package clusterimageset
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-logr/logr"
+	hivev1 "github.com/openshift/hive/apis/hive/v1"
+	"github.com/stolostron/cluster-imageset-controller/test/integration/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Release source configurations (in configmap)
+	ReleaseRepository        = "releaseRepository"
+	ReleaseTagPattern        = "releaseTagPattern"
+	ReleaseVersionRange      = "releaseVersionRange"
+	ReleaseArchitectures     = "releaseArchitectures"
+	ReleaseIncludePrerelease = "releaseIncludePrerelease"
+
+	// Default values
+	DefaultReleaseRepository    = "quay.io/openshift-release-dev/ocp-release"
+	DefaultReleaseArchitectures = "x86_64"
+
+	// VisibleLabel shows or hides the clusterImageSet in the console
+	VisibleLabel = "visible"
+)
+
+// releaseArchitectures are the architecture suffixes of the release image tags
+var releaseArchitectures = []string{"x86_64", "aarch64", "arm64", "ppc64le", "s390x", "multi"}
+
+// releaseSource lists the tags of an OpenShift release image repository, like a mirror of
+// quay.io/openshift-release-dev/ocp-release, and generates a clusterImageSet for each release.
+type releaseSource struct {
+	client    client.Client
+	log       logr.Logger
+	configMap string
+	secret    string
+}
+
+func newReleaseSource(c client.Client, log logr.Logger, configMap, secret string) *releaseSource {
+	return &releaseSource{
+		client:    c,
+		log:       log.WithValues("source", configMap),
+		configMap: configMap,
+		secret:    secret,
+	}
+}
+
+func (s *releaseSource) Name() string {
+	return s.configMap
+}
+
+// Revision returns the digest of the generated clusterImageSets, listing the tags is a single
+// request for most repositories.
+func (s *releaseSource) Revision() (string, error) {
+	content, err := s.Fetch()
+	if err != nil {
+		return "", err
+	}
+
+	return content.Revision, nil
+}
+
+func (s *releaseSource) Fetch() (*SourceContent, error) {
+	config, err := getSourceConfig(s.client, s.log, s.configMap, s.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := newReleaseFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	host, repository, _, err := parseOCIReference(config.releaseRepository)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := getSourceAuth(s.client, s.log, config.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := newOCIRegistryClient(s.log, config, auth, host, repository, "")
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := registry.listTags()
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Info(fmt.Sprintf("generating clusterImageSets from %d tags of release repository: %v", len(tags), config.releaseRepository))
+
+	releases := []*releaseTag{}
+	for _, tag := range tags {
+		if release := parseReleaseTag(tag); release != nil && filter.matches(release) {
+			releases = append(releases, release)
+		}
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		if c := compareSemver(releases[i].version, releases[j].version); c != 0 {
+			return c < 0
+		}
+		return releases[i].arch < releases[j].arch
+	})
+
+	manifests := []Manifest{}
+	for _, release := range releases {
+		imageset := newReleaseClusterImageSet(release.version.String(), release.arch,
+			host+"/"+repository+":"+release.tag, config.channel)
+
+		data, err := yaml.Marshal(imageset)
+		if err != nil {
+			return nil, err
+		}
+
+		manifests = append(manifests, Manifest{Path: release.tag + ".yaml", Data: data})
+	}
+
+	return &SourceContent{Revision: getManifestsDigest(manifests), Manifests: manifests}, nil
+}
+
+// newReleaseClusterImageSet returns the clusterImageSet of a release, named like the ones of the
+// acm-hive-openshift-releases Git repository, for example img4.11.0-x86-64-appsub.
+func newReleaseClusterImageSet(version, arch, releaseImage, channel string) *hivev1.ClusterImageSet {
+	return &hivev1.ClusterImageSet{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: hivev1.SchemeGroupVersion.String(),
+			Kind:       "ClusterImageSet",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("img%s-%s-appsub", version, strings.ReplaceAll(arch, "_", "-")),
+			Labels: map[string]string{
+				util.ChannelLabel: channel,
+				VisibleLabel:      "true",
+			},
+		},
+		Spec: hivev1.ClusterImageSetSpec{
+			ReleaseImage: releaseImage,
+		},
+	}
+}
+
+// releaseTag is a release image tag like 4.11.0-x86_64 or 4.12.0-rc.1-aarch64
+type releaseTag struct {
+	tag     string
+	version *semver
+	arch    string
+}
+
+func parseReleaseTag(tag string) *releaseTag {
+	for _, arch := range releaseArchitectures {
+		if !strings.HasSuffix(tag, "-"+arch) {
+			continue
+		}
+
+		version := parseSemver(strings.TrimSuffix(tag, "-"+arch))
+		if version == nil {
+			return nil
+		}
+
+		return &releaseTag{tag: tag, version: version, arch: arch}
+	}
+
+	return nil
+}
+
+// releaseFilter selects the release tags to generate clusterImageSets for
+type releaseFilter struct {
+	pattern           *regexp.Regexp
+	versionRange      []semverConstraint
+	architectures     map[string]bool
+	includePrerelease bool
+}
+
+func newReleaseFilter(config *sourceConfig) (*releaseFilter, error) {
+	filter := &releaseFilter{
+		architectures:     map[string]bool{},
+		includePrerelease: config.releaseIncludePrerelease,
+	}
+
+	if config.releaseTagPattern != "" {
+		pattern, err := regexp.Compile(config.releaseTagPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", ReleaseTagPattern, config.releaseTagPattern, err)
+		}
+		filter.pattern = pattern
+	}
+
+	versionRange, err := parseSemverRange(config.releaseVersionRange)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", ReleaseVersionRange, config.releaseVersionRange, err)
+	}
+	filter.versionRange = versionRange
+
+	for _, arch := range strings.Split(config.releaseArchitectures, ",") {
+		if arch = strings.TrimSpace(arch); arch != "" {
+			filter.architectures[arch] = true
+		}
+	}
+
+	return filter, nil
+}
+
+func (f *releaseFilter) matches(release *releaseTag) bool {
+	if !f.architectures[release.arch] {
+		return false
+	}
+
+	if release.version.prerelease != "" && !f.includePrerelease {
+		return false
+	}
+
+	if f.pattern != nil && !f.pattern.MatchString(release.tag) {
+		return false
+	}
+
+	for _, constraint := range f.versionRange {
+		if !constraint.matches(release.version) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// semver is a semantic version, build metadata is not supported
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+// parseSemver parses a version like 4.11.0 or 4.12.0-rc.1, it returns nil if it is invalid
+func parseSemver(version string) *semver {
+	core, prerelease, _ := strings.Cut(version, "-")
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 || part == "" || (len(part) > 1 && part[0] == '0') {
+			return nil
+		}
+		numbers[i] = number
+	}
+
+	return &semver{major: numbers[0], minor: numbers[1], patch: numbers[2], prerelease: prerelease}
+}
+
+func (v *semver) String() string {
+	version := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.prerelease != "" {
+		version += "-" + v.prerelease
+	}
+
+	return version
+}
+
+// compareSemver compares the versions, a prerelease is older than its release
+func compareSemver(a, b *semver) int {
+	for _, c := range [][2]int{{a.major, b.major}, {a.minor, b.minor}, {a.patch, b.patch}} {
+		if c[0] != c[1] {
+			if c[0] < c[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case a.prerelease == b.prerelease:
+		return 0
+	case a.prerelease == "":
+		return 1
+	case b.prerelease == "":
+		return -1
+	}
+
+	return compareVersions(a.prerelease, b.prerelease)
+}
+
+// semverConstraint is a comparison like >=4.12
+type semverConstraint struct {
+	operator string
+	version  *semver
+}
+
+func (c semverConstraint) matches(version *semver) bool {
+	result := compareSemver(version, c.version)
+
+	switch c.operator {
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case "!=":
+		return result != 0
+	default:
+		return result == 0
+	}
+}
+
+// parseSemverRange parses comparisons separated by spaces or commas, like ">=4.12 <4.15".
+// Missing minor and patch numbers are 0.
+func parseSemverRange(versionRange string) ([]semverConstraint, error) {
+	constraints := []semverConstraint{}
+
+	for _, field := range strings.FieldsFunc(versionRange, func(r rune) bool { return r == ' ' || r == ',' }) {
+		constraint := semverConstraint{operator: "="}
+		for _, operator := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(field, operator) {
+				constraint.operator = operator
+				field = strings.TrimPrefix(field, operator)
+				break
+			}
+		}
+
+		core, prerelease, _ := strings.Cut(field, "-")
+		for strings.Count(core, ".") < 2 {
+			core += ".0"
+		}
+		if prerelease != "" {
+			core += "-" + prerelease
+		}
+
+		constraint.version = parseSemver(core)
+		if constraint.version == nil {
+			return nil, fmt.Errorf("invalid version %q", field)
+		}
+
+		constraints = append(constraints, constraint)
+	}
+
+	return constraints, nil
+}
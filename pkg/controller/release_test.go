@@ -0,0 +1,207 @@
+package clusterimageset
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	hivev1 "github.com/openshift/hive/apis/hive/v1"
+	"github.com/stolostron/cluster-imageset-controller/test/integration/util"
+	"go.uber.org/zap"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestReleaseSource(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	registry := newOCIRegistry(t)
+	for _, tag := range []string{
+		"4.11.0-x86_64", "4.11.0-aarch64", "4.11.1-x86_64", "4.12.0-rc.1-x86_64",
+		"4.12.0-x86_64", "4.12.0-multi", "4.13.0-x86_64", "latest", "4.13-x86_64",
+	} {
+		registry.push(t, "releases/imagesets", tag, map[string]string{})
+	}
+
+	dockerConfig := fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`,
+		registry.host(), base64.StdEncoding.EncodeToString([]byte("puller:secret")))
+
+	tests := []struct {
+		name      string
+		data      map[string]string
+		wantNames []string
+		wantErr   bool
+	}{
+		{
+			name: "default architecture",
+			data: map[string]string{},
+			wantNames: []string{
+				"img4.11.0-x86-64-appsub", "img4.11.1-x86-64-appsub", "img4.12.0-x86-64-appsub", "img4.13.0-x86-64-appsub",
+			},
+		},
+		{
+			name: "version range and architectures",
+			data: map[string]string{
+				ReleaseVersionRange:      ">=4.11.1, <4.13",
+				ReleaseArchitectures:     "x86_64, multi",
+				ReleaseIncludePrerelease: "true",
+			},
+			wantNames: []string{
+				"img4.11.1-x86-64-appsub", "img4.12.0-rc.1-x86-64-appsub", "img4.12.0-multi-appsub", "img4.12.0-x86-64-appsub",
+			},
+		},
+		{
+			name: "tag pattern",
+			data: map[string]string{
+				ReleaseTagPattern:    `^4\.11\.`,
+				ReleaseArchitectures: "aarch64,x86_64",
+			},
+			wantNames: []string{"img4.11.0-aarch64-appsub", "img4.11.0-x86-64-appsub", "img4.11.1-x86-64-appsub"},
+		},
+		{
+			name:    "invalid tag pattern",
+			data:    map[string]string{ReleaseTagPattern: `4.11(`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid version range",
+			data:    map[string]string{ReleaseVersionRange: ">=four"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			tt.data[SourceType] = SourceTypeRelease
+			tt.data[ReleaseRepository] = registry.host() + "/releases/imagesets"
+			tt.data[CaCerts] = registry.caCerts()
+			tt.data[Channel] = "stable"
+			g.Expect(c.Create(context.TODO(), getSourceConfigMap("release", tt.data))).To(gomega.Succeed())
+			g.Expect(c.Create(context.TODO(), getDockerConfigSecret("pull-secret", dockerConfig))).To(gomega.Succeed())
+
+			s := newReleaseSource(c, log, "release", "pull-secret")
+
+			content, err := s.Fetch()
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			iCtrl := &ClusterImageSetController{client: c, log: log}
+			imagesets, _, err := iCtrl.loadImageSets(content)
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			names := []string{}
+			for _, imageset := range imagesets {
+				names = append(names, imageset.GetName())
+				g.Expect(imageset.GetLabels()).To(gomega.Equal(map[string]string{util.ChannelLabel: "stable", VisibleLabel: "true"}))
+			}
+			g.Expect(names).To(gomega.ConsistOf(tt.wantNames))
+
+			revision, err := s.Revision()
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(revision).To(gomega.Equal(content.Revision))
+		})
+	}
+
+	// The generated clusterImageSets are applied like the ones from Git
+	g := gomega.NewGomegaWithT(t)
+
+	c := initClient()
+	g.Expect(c.Create(context.TODO(), getSourceConfigMap("release", map[string]string{
+		SourceType:          SourceTypeRelease,
+		ReleaseRepository:   registry.host() + "/releases/imagesets",
+		ReleaseVersionRange: "4.11.0",
+		CaCerts:             registry.caCerts(),
+	}))).To(gomega.Succeed())
+	g.Expect(c.Create(context.TODO(), getDockerConfigSecret("pull-secret", dockerConfig))).To(gomega.Succeed())
+
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:       log,
+		Interval:  60,
+		ConfigMap: "release",
+		Secret:    "pull-secret",
+	})
+	g.Expect(iCtrl.syncClusterImageSet(true)).To(gomega.Succeed())
+
+	imageset := &hivev1.ClusterImageSet{}
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.0-x86-64-appsub"}, imageset)).To(gomega.Succeed())
+	g.Expect(imageset.Spec.ReleaseImage).To(gomega.Equal(registry.host() + "/releases/imagesets:4.11.0-x86_64"))
+	g.Expect(imageset.GetLabels()[util.ChannelLabel]).To(gomega.Equal(DefaultChannel))
+}
+
+func TestParseReleaseTag(t *testing.T) {
+	tests := []struct {
+		tag         string
+		wantVersion string
+		wantArch    string
+	}{
+		{tag: "4.11.0-x86_64", wantVersion: "4.11.0", wantArch: "x86_64"},
+		{tag: "4.12.0-rc.1-aarch64", wantVersion: "4.12.0-rc.1", wantArch: "aarch64"},
+		{tag: "4.12.0-ec.2-multi", wantVersion: "4.12.0-ec.2", wantArch: "multi"},
+		{tag: "4.12.0"},
+		{tag: "4.12-x86_64"},
+		{tag: "04.12.0-x86_64"},
+		{tag: "latest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			release := parseReleaseTag(tt.tag)
+			if tt.wantVersion == "" {
+				if release != nil {
+					t.Errorf("parseReleaseTag() = %v, want nil", release.version)
+				}
+				return
+			}
+
+			if release == nil || release.version.String() != tt.wantVersion || release.arch != tt.wantArch {
+				t.Errorf("parseReleaseTag() = %v, want %v %v", release, tt.wantVersion, tt.wantArch)
+			}
+		})
+	}
+}
+
+func TestParseSemverRange(t *testing.T) {
+	tests := []struct {
+		versionRange string
+		version      string
+		want         bool
+		wantErr      bool
+	}{
+		{versionRange: "", version: "4.11.0", want: true},
+		{versionRange: ">=4.12", version: "4.12.0", want: true},
+		{versionRange: ">=4.12", version: "4.12.0-rc.1", want: false},
+		{versionRange: ">=4.12.0-rc.2", version: "4.12.0-rc.10", want: true},
+		{versionRange: ">4.11 <4.13", version: "4.12.5", want: true},
+		{versionRange: ">4.11,<4.13", version: "4.13.0", want: false},
+		{versionRange: "4.11.2", version: "4.11.2", want: true},
+		{versionRange: "!=4.11.2", version: "4.11.2", want: false},
+		{versionRange: "<=4", version: "4.0.0", want: true},
+		{versionRange: ">=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.versionRange+" "+tt.version, func(t *testing.T) {
+			constraints, err := parseSemverRange(tt.versionRange)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSemverRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got := true
+			for _, constraint := range constraints {
+				got = got && constraint.matches(parseSemver(tt.version))
+			}
+			if got != tt.want {
+				t.Errorf("parseSemverRange(%v) matches %v = %v, want %v", tt.versionRange, tt.version, got, tt.want)
+			}
+		})
+	}
+}
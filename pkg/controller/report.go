@@ -0,0 +1,86 @@
+package clusterimageset
+
+import (
+	"fmt"
+
+	hivev1 "github.com/openshift/hive/apis/hive/v1"
+)
+
+const (
+	// DefaultMaxFailedFilesPercent is the percentage of the files of a source that may fail
+	// before the sync of the source is aborted, when the sync continues on errors
+	DefaultMaxFailedFilesPercent = 10
+)
+
+// fileFailure is a clusterImageSet file that failed to be read, loaded or applied
+type fileFailure struct {
+	// Path is the path of the file, relative to the root of the source content
+	Path string `json:"path"`
+	// Error is the reason the file failed
+	Error string `json:"error"`
+}
+
+// failedApply is a clusterImageSet that failed to be applied, it is retried at the next syncs
+// until the revision of its source changes
+type failedApply struct {
+	imageset *hivev1.ClusterImageSet
+	// source is the name of the source that provides the clusterImageSet
+	source string
+	// path is the file that holds the clusterImageSet
+	path string
+	// report is the report of the source, failure is the failure recorded in the report for the
+	// file, nil when the file failed for another reason first
+	report  *fileReport
+	failure *fileFailure
+}
+
+// fileReport collects the failed files of a source
+type fileReport struct {
+	// files is the number of clusterImageSet files of the source
+	files int
+	// failures are the failed files, in the order they failed
+	failures []fileFailure
+	// paths are the files that hold the clusterImageSets, by clusterImageSet name
+	paths map[string]string
+}
+
+func newFileReport(files int) *fileReport {
+	return &fileReport{files: files, paths: map[string]string{}}
+}
+
+// add records the failure of a file, a file that fails again is only recorded once. It returns
+// the recorded failure, or nil when the file already failed.
+func (f *fileReport) add(path string, err error) *fileFailure {
+	for _, failure := range f.failures {
+		if failure.Path == path {
+			return nil
+		}
+	}
+
+	failure := fileFailure{Path: path, Error: err.Error()}
+	f.failures = append(f.failures, failure)
+
+	return &failure
+}
+
+// remove removes a recorded failure
+func (f *fileReport) remove(failure *fileFailure) {
+	failures := []fileFailure{}
+	for _, failed := range f.failures {
+		if failed != *failure {
+			failures = append(failures, failed)
+		}
+	}
+
+	f.failures = failures
+}
+
+// exceeds returns an error when more than maxPercent of the files failed
+func (f *fileReport) exceeds(maxPercent int) error {
+	if f.files == 0 || len(f.failures)*100 <= f.files*maxPercent {
+		return nil
+	}
+
+	return fmt.Errorf("%d of %d clusterImageSet files failed, more than %d%%, first failure %s: %s",
+		len(f.failures), f.files, maxPercent, f.failures[0].Path, f.failures[0].Error)
+}
@@ -0,0 +1,36 @@
+package clusterimageset
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFileReportExceeds(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      int
+		failed     []string
+		maxPercent int
+		wantErr    bool
+	}{
+		{name: "no files", maxPercent: 10},
+		{name: "no failures", files: 10, maxPercent: 0},
+		{name: "at threshold", files: 10, failed: []string{"a.yaml"}, maxPercent: 10},
+		{name: "above threshold", files: 10, failed: []string{"a.yaml", "b.yaml"}, maxPercent: 10, wantErr: true},
+		{name: "file failed twice", files: 10, failed: []string{"a.yaml", "a.yaml"}, maxPercent: 10},
+		{name: "no failure allowed", files: 10, failed: []string{"a.yaml"}, maxPercent: 0, wantErr: true},
+		{name: "all files may fail", files: 2, failed: []string{"a.yaml", "b.yaml"}, maxPercent: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := newFileReport(tt.files)
+			for _, path := range tt.failed {
+				report.add(path, fmt.Errorf("invalid"))
+			}
+
+			if err := report.exceeds(tt.maxPercent); (err != nil) != tt.wantErr {
+				t.Errorf("fileReport.exceeds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
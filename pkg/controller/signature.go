@@ -0,0 +1,430 @@
+package clusterimageset
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/openpgp"                  //nolint:staticcheck // Git signatures are OpenPGP signatures
+	pgperrors "golang.org/x/crypto/openpgp/errors" //nolint:staticcheck
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Signature verification configurations (in configmap)
+	VerifySignature           = "verifySignature"
+	SignatureKeyringSecret    = "signatureKeyringSecret"
+	SignatureKeyringConfigMap = "signatureKeyringConfigMap"
+
+	// Values of verifySignature
+	VerifySignatureCommit = "commit"
+	VerifySignatureTag    = "tag"
+
+	pgpSignatureHeader = "-----BEGIN PGP SIGNATURE-----"
+	sshSignatureHeader = "-----BEGIN SSH SIGNATURE-----"
+	pgpPublicKeyHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+
+	// sshSignatureNamespace is the namespace of the SSH signatures made by Git
+	sshSignatureNamespace = "git"
+)
+
+// Reasons of signature verification failures, used as metric label values
+const (
+	signatureReasonNoKeyring = "no_keyring"
+	signatureReasonUnsigned  = "unsigned"
+	signatureReasonUntrusted = "untrusted"
+	signatureReasonInvalid   = "invalid"
+)
+
+// signatureError is returned when the Git revision to sync is not signed by a trusted key
+type signatureError struct {
+	reason  string
+	message string
+}
+
+func (e *signatureError) Error() string {
+	return e.message
+}
+
+func newSignatureError(reason, format string, args ...interface{}) *signatureError {
+	return &signatureError{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// signatureKeyring holds the keys trusted to sign the Git revision to sync
+type signatureKeyring struct {
+	pgp openpgp.EntityList
+	ssh []ssh.PublicKey
+}
+
+// getSignatureKeyring reads the trusted keys from the secret or configmap in the pod namespace.
+// Every key of the secret or configmap is read, it may contain armored PGP public keys, or SSH
+// public keys in allowed_signers or authorized_keys format.
+func getSignatureKeyring(c client.Client, log logr.Logger, config *sourceConfig) (*signatureKeyring, error) {
+	values := []string{}
+
+	switch {
+	case config.signatureKeyringSecret != "":
+		secret := &corev1.Secret{}
+		err := c.Get(context.TODO(), types.NamespacedName{Name: config.signatureKeyringSecret, Namespace: getPodNamespace()}, secret)
+		if err != nil {
+			return nil, newSignatureError(signatureReasonNoKeyring, "unable to get signature keyring secret %v: %v", config.signatureKeyringSecret, err)
+		}
+		for _, value := range secret.Data {
+			values = append(values, string(value))
+		}
+
+	case config.signatureKeyringConfigMap != "":
+		configMap := &corev1.ConfigMap{}
+		err := c.Get(context.TODO(), types.NamespacedName{Name: config.signatureKeyringConfigMap, Namespace: getPodNamespace()}, configMap)
+		if err != nil {
+			return nil, newSignatureError(signatureReasonNoKeyring, "unable to get signature keyring config map %v: %v", config.signatureKeyringConfigMap, err)
+		}
+		for _, value := range configMap.Data {
+			values = append(values, value)
+		}
+
+	default:
+		return nil, newSignatureError(signatureReasonNoKeyring, "%s or %s is required when %s is set",
+			SignatureKeyringSecret, SignatureKeyringConfigMap, VerifySignature)
+	}
+
+	keyring := &signatureKeyring{}
+	for _, value := range values {
+		if strings.Contains(value, pgpPublicKeyHeader) {
+			entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(value))
+			if err != nil {
+				return nil, newSignatureError(signatureReasonNoKeyring, "invalid PGP public key in the signature keyring: %v", err)
+			}
+			keyring.pgp = append(keyring.pgp, entities...)
+			continue
+		}
+
+		keyring.ssh = append(keyring.ssh, parseSSHAllowedSigners(log, value)...)
+	}
+
+	if len(keyring.pgp) == 0 && len(keyring.ssh) == 0 {
+		return nil, newSignatureError(signatureReasonNoKeyring, "no public key found in the signature keyring")
+	}
+
+	return keyring, nil
+}
+
+// parseSSHAllowedSigners returns the public keys of allowed_signers or authorized_keys lines. The
+// keys whose namespaces option does not allow Git signatures, and the certificate authorities,
+// are skipped. The lines that are skipped are logged.
+func parseSSHAllowedSigners(log logr.Logger, value string) []ssh.PublicKey {
+	keys := []ssh.PublicKey{}
+
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := parseSSHAllowedSigner(line)
+		if err != nil {
+			log.Info(fmt.Sprintf("skipping line %d of the SSH allowed signers: %v", i+1, err.Error()))
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// parseSSHAllowedSigner returns the public key of an allowed_signers line, which starts with the
+// principals followed by the options, such as namespaces="git", and the key. An authorized_keys
+// line starts with the options or the key.
+func parseSSHAllowedSigner(line string) (ssh.PublicKey, error) {
+	key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line[getSSHFieldEnd(line):]))
+	if err != nil {
+		key, _, options, _, err = ssh.ParseAuthorizedKey([]byte(line))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		switch strings.ToLower(name) {
+		case "cert-authority":
+			return nil, fmt.Errorf("certificate authorities are not supported")
+		case "namespaces":
+			if !matchSSHNamespaces(strings.Trim(value, `"`), sshSignatureNamespace) {
+				return nil, fmt.Errorf("the key is not allowed to sign in the %q namespace", sshSignatureNamespace)
+			}
+		}
+	}
+
+	return key, nil
+}
+
+// getSSHFieldEnd returns the end of the first field of the line, a quoted field may contain spaces
+func getSSHFieldEnd(line string) int {
+	quoted := false
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t'):
+			return i
+		}
+	}
+
+	return len(line)
+}
+
+// matchSSHNamespaces returns true when a pattern of the comma-separated namespaces list matches
+// the namespace
+func matchSSHNamespaces(patterns, namespace string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		if matched, err := path.Match(strings.TrimSpace(pattern), namespace); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyGitRepoSignature verifies the signature of the HEAD commit, or of the annotated tag, that
+// was synced. It returns the identity of the signing key.
+func verifyGitRepoSignature(c client.Client, log logr.Logger, config *sourceConfig, repo *git.Repository, ref *gitRepoRef) (string, error) {
+	keyring, err := getSignatureKeyring(c, log, config)
+	if err != nil {
+		return "", err
+	}
+
+	var objectType plumbing.ObjectType
+	var objectHash plumbing.Hash
+
+	switch config.verifySignature {
+	case VerifySignatureCommit:
+		commit, err := getGitRepoCommit(repo, ref)
+		if err != nil {
+			return "", err
+		}
+		objectType, objectHash = plumbing.CommitObject, commit.Hash
+
+	case VerifySignatureTag:
+		if !ref.name.IsTag() {
+			return "", newSignatureError(signatureReasonUnsigned, "reference %v is not a tag, a signed tag is required", ref)
+		}
+		if _, err := repo.TagObject(ref.hash); err != nil {
+			return "", newSignatureError(signatureReasonUnsigned, "tag %v is not an annotated tag, a signed tag is required", ref)
+		}
+		objectType, objectHash = plumbing.TagObject, ref.hash
+
+	default:
+		return "", fmt.Errorf("invalid %s %q, it must be %s or %s", VerifySignature, config.verifySignature,
+			VerifySignatureCommit, VerifySignatureTag)
+	}
+
+	obj, err := repo.Storer.EncodedObject(objectType, objectHash)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := obj.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	var payload, signature []byte
+	if objectType == plumbing.CommitObject {
+		payload, signature = splitCommitSignature(raw)
+	} else {
+		payload, signature = splitTagSignature(raw)
+	}
+
+	if len(signature) == 0 {
+		return "", newSignatureError(signatureReasonUnsigned, "%s %v is not signed", objectType, objectHash)
+	}
+
+	signer, err := keyring.verify(payload, signature)
+	if err != nil {
+		sigErr := err.(*signatureError)
+		sigErr.message = fmt.Sprintf("%s %v: %s", objectType, objectHash, sigErr.message)
+		return "", sigErr
+	}
+
+	return signer, nil
+}
+
+// splitCommitSignature removes the gpgsig header from a raw commit object, it returns the
+// signed payload and the signature.
+func splitCommitSignature(raw []byte) ([]byte, []byte) {
+	var payload, signature bytes.Buffer
+
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	inHeaders, inSignature := true, false
+
+	for _, line := range lines {
+		if inHeaders {
+			if inSignature {
+				if bytes.HasPrefix(line, []byte(" ")) {
+					signature.Write(line[1:])
+					continue
+				}
+				inSignature = false
+			}
+
+			if bytes.HasPrefix(line, []byte("gpgsig ")) {
+				signature.Write(line[len("gpgsig "):])
+				inSignature = true
+				continue
+			}
+
+			if len(bytes.TrimSpace(line)) == 0 {
+				inHeaders = false
+			}
+		}
+
+		payload.Write(line)
+	}
+
+	return payload.Bytes(), signature.Bytes()
+}
+
+// splitTagSignature splits the signature appended to the message of a raw tag object
+func splitTagSignature(raw []byte) ([]byte, []byte) {
+	for _, header := range []string{pgpSignatureHeader, sshSignatureHeader} {
+		if i := bytes.Index(raw, []byte("\n"+header)); i >= 0 {
+			return raw[:i+1], raw[i+1:]
+		}
+	}
+
+	return raw, nil
+}
+
+// verify checks the PGP or SSH signature of the payload, it returns the identity of the signing key
+func (k *signatureKeyring) verify(payload, signature []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(signature, []byte(pgpSignatureHeader)):
+		entity, err := openpgp.CheckArmoredDetachedSignature(k.pgp, bytes.NewReader(payload), bytes.NewReader(signature))
+		if err == pgperrors.ErrUnknownIssuer {
+			return "", newSignatureError(signatureReasonUntrusted, "signed with a PGP key which is not in the keyring")
+		}
+		if err != nil {
+			return "", newSignatureError(signatureReasonInvalid, "PGP signature verification failed: %v", err)
+		}
+
+		for name := range entity.Identities {
+			return name, nil
+		}
+		return fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint), nil
+
+	case bytes.HasPrefix(signature, []byte(sshSignatureHeader)):
+		key, err := verifySSHSignature(payload, signature, sshSignatureNamespace)
+		if err != nil {
+			return "", newSignatureError(signatureReasonInvalid, "SSH signature verification failed: %v", err)
+		}
+
+		for _, allowed := range k.ssh {
+			if bytes.Equal(allowed.Marshal(), key.Marshal()) {
+				return ssh.FingerprintSHA256(key), nil
+			}
+		}
+		return "", newSignatureError(signatureReasonUntrusted, "signed with SSH key %v which is not in the keyring", ssh.FingerprintSHA256(key))
+	}
+
+	return "", newSignatureError(signatureReasonInvalid, "unsupported signature format")
+}
+
+// verifySSHSignature verifies an armored SSH signature (the SSHSIG format of ssh-keygen -Y sign)
+// of the payload, it returns the public key that made the signature.
+func verifySSHSignature(payload, armored []byte, namespace string) (ssh.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, fmt.Errorf("invalid SSH signature armor")
+	}
+
+	blob := block.Bytes
+	if !bytes.HasPrefix(blob, []byte("SSHSIG")) {
+		return nil, fmt.Errorf("invalid SSH signature magic")
+	}
+	blob = blob[len("SSHSIG"):]
+
+	if len(blob) < 4 || binary.BigEndian.Uint32(blob) != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version")
+	}
+	blob = blob[4:]
+
+	fields := make([][]byte, 5)
+	for i := range fields {
+		if len(blob) < 4 {
+			return nil, fmt.Errorf("truncated SSH signature")
+		}
+		length := binary.BigEndian.Uint32(blob)
+		if uint64(len(blob)-4) < uint64(length) {
+			return nil, fmt.Errorf("truncated SSH signature")
+		}
+		fields[i], blob = blob[4:4+length], blob[4+length:]
+	}
+	publicKey, signedNamespace, reserved, hashAlgorithm, sigBlob := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	if string(signedNamespace) != namespace {
+		return nil, fmt.Errorf("SSH signature namespace is %q, expected %q", signedNamespace, namespace)
+	}
+
+	key, err := ssh.ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var h hash.Hash
+	switch string(hashAlgorithm) {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported SSH signature hash algorithm %q", hashAlgorithm)
+	}
+	h.Write(payload)
+
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(sigBlob, sig); err != nil {
+		return nil, err
+	}
+
+	signedData := ssh.Marshal(struct {
+		Magic         [6]byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          string
+	}{
+		Magic:         [6]byte{'S', 'S', 'H', 'S', 'I', 'G'},
+		Namespace:     string(signedNamespace),
+		Reserved:      string(reserved),
+		HashAlgorithm: string(hashAlgorithm),
+		Hash:          string(h.Sum(nil)),
+	})
+
+	if err := key.Verify(signedData, sig); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
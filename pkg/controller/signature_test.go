@@ -0,0 +1,528 @@
+package clusterimageset
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	hivev1 "github.com/openshift/hive/apis/hive/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/openpgp"       //nolint:staticcheck
+	"golang.org/x/crypto/openpgp/armor" //nolint:staticcheck
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestVerifyGitRepoSignature(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	trustedPGP := newPGPSigner(t, "trusted")
+	untrustedPGP := newPGPSigner(t, "untrusted")
+	trustedSSH := newSSHSigner(t)
+	untrustedSSH := newSSHSigner(t)
+
+	keyringSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "keyring", Namespace: "multicluster-engine"},
+		Data:       map[string][]byte{"trusted.asc": trustedPGP.publicKey},
+	}
+	keyringConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "keyring", Namespace: "multicluster-engine"},
+		Data:       map[string]string{"allowed_signers": "test@example.com " + trustedSSH.authorizedKey},
+	}
+
+	tests := []struct {
+		name           string
+		data           map[string]string
+		sign           func(t *testing.T, repoDir string)
+		wantVerifiedBy string
+		wantReason     string
+	}{
+		{
+			name: "PGP signed commit",
+			data: map[string]string{VerifySignature: "commit", SignatureKeyringSecret: "keyring"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, trustedPGP.sign)
+			},
+			wantVerifiedBy: "trusted <trusted@example.com>",
+		},
+		{
+			name: "SSH signed commit",
+			data: map[string]string{VerifySignature: "commit", SignatureKeyringConfigMap: "keyring"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, trustedSSH.sign)
+			},
+			wantVerifiedBy: trustedSSH.fingerprint,
+		},
+		{
+			name: "PGP signed tag",
+			data: map[string]string{VerifySignature: "tag", SignatureKeyringSecret: "keyring", GitRepoRef: "v1"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoTag(t, repoDir, "v1", trustedPGP.sign)
+			},
+			wantVerifiedBy: "trusted <trusted@example.com>",
+		},
+		{
+			name: "SSH signed tag",
+			data: map[string]string{VerifySignature: "tag", SignatureKeyringConfigMap: "keyring", GitRepoRef: "v1"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoTag(t, repoDir, "v1", trustedSSH.sign)
+			},
+			wantVerifiedBy: trustedSSH.fingerprint,
+		},
+		{
+			name:       "unsigned commit",
+			data:       map[string]string{VerifySignature: "commit", SignatureKeyringSecret: "keyring"},
+			sign:       func(t *testing.T, repoDir string) {},
+			wantReason: signatureReasonUnsigned,
+		},
+		{
+			name: "signed commit, tag required",
+			data: map[string]string{VerifySignature: "tag", SignatureKeyringSecret: "keyring"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, trustedPGP.sign)
+			},
+			wantReason: signatureReasonUnsigned,
+		},
+		{
+			name: "lightweight tag",
+			data: map[string]string{VerifySignature: "tag", SignatureKeyringSecret: "keyring", GitRepoRef: "v1"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, trustedPGP.sign)
+				tagGitRepo(t, repoDir, "v1", false)
+			},
+			wantReason: signatureReasonUnsigned,
+		},
+		{
+			name: "untrusted PGP key",
+			data: map[string]string{VerifySignature: "commit", SignatureKeyringSecret: "keyring"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, untrustedPGP.sign)
+			},
+			wantReason: signatureReasonUntrusted,
+		},
+		{
+			name: "untrusted SSH key",
+			data: map[string]string{VerifySignature: "commit", SignatureKeyringConfigMap: "keyring"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, untrustedSSH.sign)
+			},
+			wantReason: signatureReasonUntrusted,
+		},
+		{
+			name: "SSH signed commit, PGP keyring",
+			data: map[string]string{VerifySignature: "commit", SignatureKeyringSecret: "keyring"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, trustedSSH.sign)
+			},
+			wantReason: signatureReasonUntrusted,
+		},
+		{
+			name: "tampered signature",
+			data: map[string]string{VerifySignature: "commit", SignatureKeyringConfigMap: "keyring"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, func(payload []byte) string {
+					return trustedSSH.sign(append(payload, "tampered"...))
+				})
+			},
+			wantReason: signatureReasonInvalid,
+		},
+		{
+			name: "no keyring",
+			data: map[string]string{VerifySignature: "commit"},
+			sign: func(t *testing.T, repoDir string) {
+				signGitRepoHead(t, repoDir, trustedPGP.sign)
+			},
+			wantReason: signatureReasonNoKeyring,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			gitRoot := t.TempDir()
+			repoDir := filepath.Join(gitRoot, "releases.git")
+			commitGitRepoFiles(t, repoDir, map[string]string{
+				"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": getImageSetFile("img4.11.0-x86-64-appsub", "fast"),
+			})
+			tt.sign(t, repoDir)
+
+			server := newGitHTTPServer(t, gitRoot)
+
+			c := initClient()
+			configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+			for key, value := range tt.data {
+				configMap.Data[key] = value
+			}
+			g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+			g.Expect(c.Create(context.TODO(), keyringSecret.DeepCopy())).To(gomega.Succeed())
+			g.Expect(c.Create(context.TODO(), keyringConfigMap.DeepCopy())).To(gomega.Succeed())
+
+			s := newGitSource(c, log, configMap.Name, "secret", t.TempDir())
+
+			failures := testutil.ToFloat64(signatureVerificationFailures.WithLabelValues(configMap.Name, tt.wantReason))
+
+			content, err := s.Fetch()
+			if tt.wantReason != "" {
+				g.Expect(err).To(gomega.HaveOccurred())
+				g.Expect(err.(*signatureError).reason).To(gomega.Equal(tt.wantReason))
+				g.Expect(testutil.ToFloat64(signatureVerificationFailures.WithLabelValues(configMap.Name, tt.wantReason))).
+					To(gomega.Equal(failures + 1))
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(content.VerifiedBy).To(gomega.Equal(tt.wantVerifiedBy))
+			g.Expect(content.Manifests).To(gomega.HaveLen(1))
+		})
+	}
+}
+
+func TestSyncImageSetSignature(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	signer := newPGPSigner(t, "trusted")
+
+	gitRoot := t.TempDir()
+	repoDir := filepath.Join(gitRoot, "releases.git")
+	commitGitRepoFiles(t, repoDir, map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml": getImageSetFile("img4.11.0-x86-64-appsub", "fast"),
+	})
+	signedCommit := signGitRepoHead(t, repoDir, signer.sign)
+
+	server := newGitHTTPServer(t, gitRoot)
+
+	c := initClient()
+	configMap := getConfigMap(server.URL+"/releases.git", "master", "clusterImageSets", "fast")
+	configMap.Data[VerifySignature] = VerifySignatureCommit
+	configMap.Data[SignatureKeyringConfigMap] = "keyring"
+	g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+	g.Expect(c.Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "keyring", Namespace: "multicluster-engine"},
+		Data:       map[string]string{"trusted.asc": string(signer.publicKey)},
+	})).To(gomega.Succeed())
+
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:             log,
+		Interval:        60,
+		ConfigMap:       configMap.Name,
+		Secret:          "secret",
+		CacheDir:        t.TempDir(),
+		StatusConfigMap: DefaultStatusConfigMap,
+	})
+
+	// The signed commit is applied
+	g.Expect(iCtrl.syncClusterImageSet(true)).To(gomega.Succeed())
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.0-x86-64-appsub"}, &hivev1.ClusterImageSet{})).To(gomega.Succeed())
+
+	status := getStatus(t, c, configMap.Name)
+	g.Expect(status.Revision).To(gomega.Equal(signedCommit))
+	g.Expect(status.VerifiedBy).To(gomega.Equal("trusted <trusted@example.com>"))
+	g.Expect(status.LastError).To(gomega.BeEmpty())
+
+	// The unsigned commit is refused, the previous state is kept
+	commitGitRepoFiles(t, repoDir, map[string]string{
+		"clusterImageSets/fast/img4.11.1-x86-64-appsub.yaml": getImageSetFile("img4.11.1-x86-64-appsub", "fast"),
+	})
+
+	g.Expect(iCtrl.syncClusterImageSet(true)).NotTo(gomega.Succeed())
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.1-x86-64-appsub"}, &hivev1.ClusterImageSet{})).NotTo(gomega.Succeed())
+	g.Expect(iCtrl.lastRevision).To(gomega.Equal(signedCommit))
+
+	status = getStatus(t, c, configMap.Name)
+	g.Expect(status.Revision).To(gomega.Equal(signedCommit))
+	g.Expect(status.LastError).To(gomega.ContainSubstring("is not signed"))
+
+	// Signing the commit resumes the sync
+	signGitRepoHead(t, repoDir, signer.sign)
+
+	g.Expect(iCtrl.syncClusterImageSet(true)).To(gomega.Succeed())
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.1-x86-64-appsub"}, &hivev1.ClusterImageSet{})).To(gomega.Succeed())
+	g.Expect(getStatus(t, c, configMap.Name).LastError).To(gomega.BeEmpty())
+}
+
+func TestSplitCommitSignature(t *testing.T) {
+	raw := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"author test <test@example.com> 1600000000 +0000\n" +
+		"committer test <test@example.com> 1600000000 +0000\n" +
+		"gpgsig -----BEGIN SSH SIGNATURE-----\n" +
+		" U1NIU0lH\n" +
+		" -----END SSH SIGNATURE-----\n" +
+		"\n" +
+		"message\n" +
+		" indented message line\n"
+
+	payload, signature := splitCommitSignature([]byte(raw))
+
+	wantPayload := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"author test <test@example.com> 1600000000 +0000\n" +
+		"committer test <test@example.com> 1600000000 +0000\n" +
+		"\n" +
+		"message\n" +
+		" indented message line\n"
+	wantSignature := "-----BEGIN SSH SIGNATURE-----\nU1NIU0lH\n-----END SSH SIGNATURE-----\n"
+
+	if string(payload) != wantPayload {
+		t.Errorf("splitCommitSignature() payload = %q, want %q", payload, wantPayload)
+	}
+	if string(signature) != wantSignature {
+		t.Errorf("splitCommitSignature() signature = %q, want %q", signature, wantSignature)
+	}
+}
+
+func TestParseSSHAllowedSigners(t *testing.T) {
+	key := newSSHSigner(t).authorizedKey
+
+	tests := []struct {
+		name     string
+		value    string
+		wantKeys int
+	}{
+		{"authorized_keys line", key, 1},
+		{"allowed_signers line", "test@example.com " + key, 1},
+		{"allowed_signers line with quoted principals", `"test@example.com,other@example.com" ` + key, 1},
+		{"allowed_signers line with Git namespace", `test@example.com namespaces="git" ` + key, 1},
+		{"allowed_signers line with namespace patterns", `test@example.com namespaces="file,g*" ` + key, 1},
+		{"allowed_signers line with other namespace", `test@example.com namespaces="file" ` + key, 0},
+		{"allowed_signers line with certificate authority", "*@example.com cert-authority " + key, 0},
+		{"comments and invalid lines", "# comment\n\ninvalid line\ntest@example.com " + key, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := parseSSHAllowedSigners(zapr.NewLogger(zap.NewNop()), tt.value)
+			if len(keys) != tt.wantKeys {
+				t.Errorf("parseSSHAllowedSigners() returned %d keys, want %d", len(keys), tt.wantKeys)
+			}
+		})
+	}
+}
+
+func getImageSetFile(name, channel string) string {
+	return "apiVersion: hive.openshift.io/v1\nkind: ClusterImageSet\nmetadata:\n  name: " + name +
+		"\n  labels:\n    channel: " + channel + "\nspec:\n  releaseImage: quay.io/openshift-release-dev/ocp-release:" +
+		strings.TrimSuffix(strings.TrimPrefix(name, "img"), "-appsub") + "\n"
+}
+
+func getStatus(t *testing.T, c client.Client, name string) *sourceStatus {
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(context.TODO(), client.ObjectKey{Name: DefaultStatusConfigMap, Namespace: "multicluster-engine"}, configMap); err != nil {
+		t.Fatalf("failed to get status config map: %v", err)
+	}
+
+	status := &sourceStatus{}
+	if err := yaml.Unmarshal([]byte(configMap.Data[name]), status); err != nil {
+		t.Fatalf("failed to parse status: %v", err)
+	}
+
+	return status
+}
+
+// signGitRepoHead replaces the HEAD commit of the Git repository in repoDir by the same commit
+// signed by sign, and returns the ID of the signed commit.
+func signGitRepoHead(t *testing.T, repoDir string, sign func(payload []byte) string) string {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		t.Fatalf("failed to open Git repository: %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("failed to get HEAD: %v", err)
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("failed to get HEAD commit: %v", err)
+	}
+
+	unsigned := repo.Storer.NewEncodedObject()
+	if err := commit.EncodeWithoutSignature(unsigned); err != nil {
+		t.Fatalf("failed to encode commit: %v", err)
+	}
+	commit.PGPSignature = sign(readEncodedObject(t, unsigned))
+
+	hash := storeEncodedObject(t, repo, commit.Encode)
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), hash)); err != nil {
+		t.Fatalf("failed to update %v: %v", head.Name(), err)
+	}
+
+	return hash.String()
+}
+
+// signGitRepoTag creates an annotated tag of the HEAD commit of the Git repository in repoDir,
+// signed by sign.
+func signGitRepoTag(t *testing.T, repoDir, name string, sign func(payload []byte) string) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		t.Fatalf("failed to open Git repository: %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("failed to get HEAD: %v", err)
+	}
+
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		Message:    name + "\n",
+		TargetType: plumbing.CommitObject,
+		Target:     head.Hash(),
+	}
+
+	unsigned := repo.Storer.NewEncodedObject()
+	if err := tag.Encode(unsigned); err != nil {
+		t.Fatalf("failed to encode tag: %v", err)
+	}
+
+	// The signature is appended to the message of the tag
+	tag.Message += sign(readEncodedObject(t, unsigned))
+
+	hash := storeEncodedObject(t, repo, tag.Encode)
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewTagReferenceName(name), hash)); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+}
+
+func readEncodedObject(t *testing.T, obj plumbing.EncodedObject) []byte {
+	reader, err := obj.Reader()
+	if err != nil {
+		t.Fatalf("failed to read object: %v", err)
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read object: %v", err)
+	}
+
+	return data
+}
+
+func storeEncodedObject(t *testing.T, repo *git.Repository, encode func(plumbing.EncodedObject) error) plumbing.Hash {
+	obj := repo.Storer.NewEncodedObject()
+	if err := encode(obj); err != nil {
+		t.Fatalf("failed to encode object: %v", err)
+	}
+
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatalf("failed to store object: %v", err)
+	}
+
+	return hash
+}
+
+// pgpSigner signs Git objects like git commit -S with a PGP key
+type pgpSigner struct {
+	entity    *openpgp.Entity
+	publicKey []byte
+}
+
+func newPGPSigner(t *testing.T, name string) *pgpSigner {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("failed to create PGP key: %v", err)
+	}
+
+	publicKey := &bytes.Buffer{}
+	writer, err := armor.Encode(publicKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("failed to armor PGP key: %v", err)
+	}
+	if err := entity.Serialize(writer); err != nil {
+		t.Fatalf("failed to serialize PGP key: %v", err)
+	}
+	writer.Close()
+
+	return &pgpSigner{entity: entity, publicKey: publicKey.Bytes()}
+}
+
+func (s *pgpSigner) sign(payload []byte) string {
+	signature := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(signature, s.entity, bytes.NewReader(payload), nil); err != nil {
+		panic(err)
+	}
+
+	return signature.String() + "\n"
+}
+
+// sshSigner signs Git objects like git commit -S with gpg.format=ssh
+type sshSigner struct {
+	signer        ssh.Signer
+	authorizedKey string
+	fingerprint   string
+}
+
+func newSSHSigner(t *testing.T) *sshSigner {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to create SSH key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("failed to create SSH signer: %v", err)
+	}
+
+	return &sshSigner{
+		signer:        signer,
+		authorizedKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		fingerprint:   ssh.FingerprintSHA256(signer.PublicKey()),
+	}
+}
+
+// sign returns the armored SSHSIG signature of the payload, like ssh-keygen -Y sign -n git
+func (s *sshSigner) sign(payload []byte) string {
+	hash := sha512.Sum512(payload)
+
+	signedData := ssh.Marshal(struct {
+		Magic         [6]byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          string
+	}{[6]byte{'S', 'S', 'H', 'S', 'I', 'G'}, sshSignatureNamespace, "", "sha512", string(hash[:])})
+
+	signature, err := s.signer.Sign(rand.Reader, signedData)
+	if err != nil {
+		panic(err)
+	}
+
+	blob := ssh.Marshal(struct {
+		Magic         [6]byte
+		Version       uint32
+		PublicKey     string
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     string
+	}{
+		[6]byte{'S', 'S', 'H', 'S', 'I', 'G'}, 1, string(s.signer.PublicKey().Marshal()),
+		sshSignatureNamespace, "", "sha512", string(ssh.Marshal(signature)),
+	})
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob}))
+}
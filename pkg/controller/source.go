@@ -0,0 +1,867 @@
+package clusterimageset
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/go-logr/logr"
+	"gopkg.in/src-d/go-git.v4"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Source configurations (in configmap)
+	SourceType    = "sourceType"
+	DirectoryPath = "directoryPath"
+	TarballUrl    = "tarballUrl"
+	TarballPath   = "tarballPath"
+	OCIArtifact   = "ociArtifact"
+	OCIPath       = "ociPath"
+
+	// File filters (in configmap)
+	IncludePatterns = "includePatterns"
+	ExcludePatterns = "excludePatterns"
+
+	// Source types
+	SourceTypeGit       = "git"
+	SourceTypeDirectory = "directory"
+	SourceTypeTarball   = "tarball"
+	SourceTypeOCI       = "oci"
+	SourceTypeRelease   = "release"
+	SourceTypeGraph     = "graph"
+)
+
+// maxRedirects is the number of redirects followed by a request, as the default HTTP client does
+const maxRedirects = 10
+
+// DefaultIncludePatterns select the YAML files at any depth
+var DefaultIncludePatterns = []string{"**/*.yaml", "**/*.yml"}
+
+// Source provides the clusterImageSet manifests to sync. The controller only fetches the
+// content of a source when its revision changed since the previous sync.
+type Source interface {
+	// Name identifies the source, it is recorded in the source annotation of the clusterImageSets
+	Name() string
+	// Revision returns the current revision of the source content, as cheaply as possible
+	Revision() (string, error)
+	// Fetch returns the source content at its current revision
+	Fetch() (*SourceContent, error)
+}
+
+// SourceContent is the content of a source at a given revision
+type SourceContent struct {
+	Revision  string
+	Manifests []Manifest
+	// VerifiedBy is the identity of the key that signed the revision, it is empty when the
+	// signature is not verified
+	VerifiedBy string
+	// URL is the URL the revision was fetched from, when the source has several URLs
+	URL string
+}
+
+// Manifest is a clusterImageSet file of the source content
+type Manifest struct {
+	// Path is the path of the file, relative to the root of the source content
+	Path string
+	Data []byte
+	// Err is the reason the file could not be read, the other files of the source are still read
+	Err error
+}
+
+// sourceConfig holds the source configuration read from the configmap
+type sourceConfig struct {
+	sourceType   string
+	url          string
+	fallbackUrls []string
+	// includePatterns and excludePatterns select the files of the source by their relative path
+	includePatterns          []string
+	excludePatterns          []string
+	branch                   string
+	ref                      string
+	tagPattern               string
+	path                     string
+	channel                  string
+	depth                    int
+	submodules               git.SubmoduleRescursivity
+	directoryPath            string
+	tarballUrl               string
+	tarballPath              string
+	ociArtifact              string
+	ociPath                  string
+	releaseRepository        string
+	releaseTagPattern        string
+	releaseVersionRange      string
+	releaseArchitectures     string
+	releaseIncludePrerelease bool
+	graphUrl                 string
+	graphChannels            string
+	graphArch                string
+	caCerts                  string
+	// caBundle is the trusted CA bundle of the caBundleConfigMap configmap
+	caBundle                  string
+	caBundleConfigMap         string
+	caBundleConfigMapKey      string
+	insecureSkipVerify        bool
+	sshKnownHosts             string
+	sshStrictHostKeyChecking  bool
+	verifySignature           string
+	signatureKeyringSecret    string
+	signatureKeyringConfigMap string
+	proxy                     proxyConfig
+	githubApiUrl              string
+	connectTimeout            time.Duration
+	timeout                   time.Duration
+	retries                   int
+	retryBackoff              time.Duration
+	secret                    string
+}
+
+// gitRepoURLs returns the URL of the Git repository, followed by its fallback URLs
+func (config *sourceConfig) gitRepoURLs() []string {
+	return append([]string{config.url}, config.fallbackUrls...)
+}
+
+// isGitRepoURL returns true if the URL is one of the URLs of the Git repository
+func (config *sourceConfig) isGitRepoURL(repoURL string) bool {
+	for _, url := range config.gitRepoURLs() {
+		if url == repoURL {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sourceAuth holds the source authentication read from the secret
+type sourceAuth struct {
+	user          string
+	accessToken   string
+	clientKey     []byte
+	clientCert    []byte
+	sshPrivateKey []byte
+	sshPassphrase string
+	bearerToken   string
+	// githubAppID, githubAppInstallationID and githubAppPrivateKey mint GitHub App installation tokens
+	githubAppID             string
+	githubAppInstallationID string
+	githubAppPrivateKey     []byte
+	// dockerConfigJSON is the content of a kubernetes.io/dockerconfigjson secret
+	dockerConfigJSON []byte
+}
+
+// newSource returns the source configured by the configmap, based on its sourceType
+func newSource(c client.Client, log logr.Logger, config *sourceConfig, configMap, secret, cacheDir string) (Source, error) {
+	switch config.sourceType {
+	case SourceTypeGit:
+		return newGitSource(c, log, configMap, secret, cacheDir), nil
+	case SourceTypeDirectory:
+		return newDirectorySource(c, log, configMap, secret), nil
+	case SourceTypeTarball:
+		return newTarballSource(c, log, configMap, secret), nil
+	case SourceTypeOCI:
+		return newOCISource(c, log, configMap, secret), nil
+	case SourceTypeRelease:
+		return newReleaseSource(c, log, configMap, secret), nil
+	case SourceTypeGraph:
+		return newGraphSource(c, log, configMap, secret), nil
+	}
+
+	return nil, fmt.Errorf("unsupported %s %q in config map %v", SourceType, config.sourceType, configMap)
+}
+
+// directorySource is a local directory that provides clusterImageSets, for example a mounted volume
+type directorySource struct {
+	client    client.Client
+	log       logr.Logger
+	configMap string
+	secret    string
+}
+
+func newDirectorySource(c client.Client, log logr.Logger, configMap, secret string) *directorySource {
+	return &directorySource{
+		client:    c,
+		log:       log.WithValues("source", configMap),
+		configMap: configMap,
+		secret:    secret,
+	}
+}
+
+func (s *directorySource) Name() string {
+	return s.configMap
+}
+
+// Revision returns the digest of the directory content, reading local files is cheap enough
+// to do on every sync.
+func (s *directorySource) Revision() (string, error) {
+	content, err := s.Fetch()
+	if err != nil {
+		return "", err
+	}
+
+	return content.Revision, nil
+}
+
+func (s *directorySource) Fetch() (*SourceContent, error) {
+	config, err := getSourceConfig(s.client, s.log, s.configMap, s.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.directoryPath == "" {
+		return nil, fmt.Errorf("%s is required in config map %v for %s source", DirectoryPath, s.configMap, SourceTypeDirectory)
+	}
+
+	s.log.Info(fmt.Sprintf("loading clusterImageSets from directory: %v", config.directoryPath))
+
+	manifests, err := readManifests(config.directoryPath, newManifestFilter(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SourceContent{Revision: getManifestsDigest(manifests), Manifests: manifests}, nil
+}
+
+// manifestFilter selects the files of a source that hold clusterImageSets, by their path relative
+// to the source directory. Hidden files and the files of hidden directories are never selected.
+type manifestFilter struct {
+	include []string
+	exclude []string
+}
+
+func newManifestFilter(config *sourceConfig) *manifestFilter {
+	filter := &manifestFilter{include: DefaultIncludePatterns, exclude: config.excludePatterns}
+	if len(config.includePatterns) > 0 {
+		filter.include = config.includePatterns
+	}
+
+	return filter
+}
+
+// matches returns true when the file is not hidden, matches an include pattern and does not
+// match any exclude pattern
+func (f *manifestFilter) matches(name string) bool {
+	name = strings.Trim(name, "/")
+	if isHiddenPath(name) {
+		return false
+	}
+
+	return matchAnyGlob(f.include, name) && !matchAnyGlob(f.exclude, name)
+}
+
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, err := doublestar.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isHiddenPath returns true when a segment of the slash-separated path starts with a dot
+func isHiddenPath(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." && segment != ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseGlobs splits a comma or white space separated list of doublestar glob patterns, and checks
+// their syntax. The commas of the {a,b} groups do not separate patterns.
+func parseGlobs(value string) ([]string, error) {
+	fields := []string{}
+	depth, start := 0, 0
+	for i, r := range value + " " {
+		switch {
+		case r == '{':
+			depth++
+		case r == '}':
+			depth--
+		case unicode.IsSpace(r) || (r == ',' && depth <= 0):
+			if field := value[start:i]; field != "" {
+				fields = append(fields, field)
+			}
+			start = i + utf8.RuneLen(r)
+		}
+	}
+
+	patterns := []string{}
+	for _, pattern := range fields {
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, doublestar.ErrBadPattern)
+		}
+		patterns = append(patterns, strings.Trim(pattern, "/"))
+	}
+
+	return patterns, nil
+}
+
+// readManifests returns the files under the root directory that the filter selects, in lexical
+// order. A file that cannot be read is returned with its error.
+func readManifests(root string, filter *manifestFilter) ([]Manifest, error) {
+	manifests := []Manifest{}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(root,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			relPath = filepath.ToSlash(relPath)
+
+			if info.IsDir() {
+				if relPath != "." && isHiddenPath(relPath) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !filter.matches(relPath) {
+				return nil
+			}
+
+			// A symbolic link of a Git repository must not expose the files of the controller,
+			// such as its service account token
+			if info.Mode()&os.ModeSymlink != 0 {
+				if err := checkSymlinkTarget(realRoot, path); err != nil {
+					manifests = append(manifests, Manifest{Path: relPath, Err: err})
+					return nil
+				}
+			}
+
+			file, err := ioutil.ReadFile(filepath.Clean(path))
+			if err != nil {
+				err = fmt.Errorf("failed to read clusterImageSet file %v: %w", path, err)
+			}
+
+			manifests = append(manifests, Manifest{Path: relPath, Data: file, Err: err})
+
+			return nil
+		})
+
+	return manifests, err
+}
+
+// checkSymlinkTarget returns an error when the symbolic link does not resolve to a file under the
+// root directory, root has its symbolic links resolved
+func checkSymlinkTarget(root, link string) error {
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return fmt.Errorf("failed to resolve symbolic link %v: %w", link, err)
+	}
+
+	if relPath, err := filepath.Rel(root, target); err != nil || relPath == ".." ||
+		strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("symbolic link %v points outside of the source directory", link)
+	}
+
+	return nil
+}
+
+// getManifestsDigest returns a sha256 digest of the manifest paths and content
+func getManifestsDigest(manifests []Manifest) string {
+	hash := sha256.New()
+
+	for _, manifest := range manifests {
+		fmt.Fprintf(hash, "%s\x00%d\x00", manifest.Path, len(manifest.Data))
+		hash.Write(manifest.Data)
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// getTLSClientConfig returns the TLS configuration for the source server, built from the
+// current configuration
+func getTLSClientConfig(log logr.Logger, config *sourceConfig, auth *sourceAuth) (*tls.Config, error) {
+	clientConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// skip TLS certificate verification for servers with custom or self-signed certs
+	if config.insecureSkipVerify {
+		log.Info("insecureSkipVerify = true, skipping Git server's certificate verification.")
+
+		clientConfig.InsecureSkipVerify = true
+	} else if !strings.EqualFold(config.caCerts, "") || config.caBundle != "" || config.proxy.caCerts != "" {
+		log.Info("adding Git server's CA certificate to trust certificate pool")
+
+		// Load the host's trusted certs into memory
+		certPool, _ := x509.SystemCertPool()
+		if certPool == nil {
+			certPool = x509.NewCertPool()
+		}
+
+		// The CA bundle of the referenced configmap and the trusted CA bundle of the cluster proxy
+		// are trusted too
+		for _, bundle := range []struct {
+			name  string
+			certs string
+		}{
+			{name: CaCerts, certs: config.caCerts},
+			{name: fmt.Sprintf("%s of config map %s", config.caBundleConfigMapKey, config.caBundleConfigMap), certs: config.caBundle},
+			{name: "trusted CA bundle of the cluster proxy", certs: config.proxy.caCerts},
+		} {
+			if bundle.certs == "" {
+				continue
+			}
+
+			certChain, err := getCertChain(bundle.certs)
+			if err != nil {
+				log.Info(fmt.Sprintf("invalid %s: %v", bundle.name, err.Error()))
+				return clientConfig, fmt.Errorf("invalid %s: %w", bundle.name, err)
+			}
+
+			// Add CA certs from the config map to the cert pool
+			// It will not add duplicate certs
+			for _, cert := range certChain.Certificate {
+				x509Cert, err := x509.ParseCertificate(cert)
+				if err != nil {
+					return clientConfig, err
+				}
+				log.V(4).Info("adding certificate -->" + x509Cert.Subject.String())
+				certPool.AddCert(x509Cert)
+			}
+		}
+
+		clientConfig.RootCAs = certPool
+	}
+
+	// If client key pair is provided, make mTLS connection
+	if len(auth.clientKey) > 0 && len(auth.clientCert) > 0 {
+		log.Info("client certificate key pair is provided. Making mTLS connection.")
+
+		clientCertificate, err := tls.X509KeyPair(auth.clientCert, auth.clientKey)
+		if err != nil {
+			log.Info(fmt.Sprintf("failed to get key pair: %v", err.Error()))
+			return clientConfig, err
+		}
+
+		// Add the client certificate in the connection
+		clientConfig.Certificates = []tls.Certificate{clientCertificate}
+
+		log.Info("client certificate key pair added successfully")
+	}
+
+	return clientConfig, nil
+}
+
+// newHTTPClient returns an HTTP client with the TLS configuration, using the proxy of the source
+// configuration or of the environment
+func newHTTPClient(log logr.Logger, config *sourceConfig, clientConfig *tls.Config) *http.Client {
+	transportConfig := &http.Transport{
+		TLSClientConfig:     clientConfig, // #nosec G402
+		Proxy:               getProxyFunc(log, &config.proxy),
+		DialContext:         newDialer(config).DialContext,
+		TLSHandshakeTimeout: config.connectTimeout,
+	}
+
+	return &http.Client{
+		Transport: transportConfig, // #nosec G402
+		Timeout:   config.timeout,
+
+		CheckRedirect: checkSameHostRedirect,
+	}
+}
+
+// checkSameHostRedirect follows the redirects within the same host, such as the ones of a renamed
+// Git repository, and stops at a redirect to another host so that the credentials of the source
+// are not sent there.
+func checkSameHostRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if req.URL.Host != via[0].URL.Host {
+		return http.ErrUseLastResponse
+	}
+
+	return nil
+}
+
+func getSourceAuth(c client.Client, log logr.Logger, secretName string) (*sourceAuth, error) {
+	auth := &sourceAuth{
+		clientKey:  []byte(""),
+		clientCert: []byte(""),
+	}
+
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: getPodNamespace()}, secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return auth, nil
+		}
+
+		log.Info("unable to get secret for cluster image set Git repo")
+		return auth, err
+	}
+
+	// The keys of the typed secrets are read as well as the legacy keys, the typed keys first
+	userKey, user := getSecretData(secret, corev1.BasicAuthUsernameKey, UserID)
+	accessTokenKey, accessToken := getSecretData(secret, corev1.BasicAuthPasswordKey, AccessToken)
+	clientKeyKey, clientKey := getSecretData(secret, corev1.TLSPrivateKeyKey, ClientKey)
+	clientCertKey, clientCert := getSecretData(secret, corev1.TLSCertKey, ClientCert)
+	sshPrivateKeyKey, sshPrivateKey := getSecretData(secret, corev1.SSHAuthPrivateKey, SSHPrivateKey)
+
+	if err := validateSecretType(secret, user, accessToken, clientKey, clientCert, sshPrivateKey); err != nil {
+		log.Info(err.Error())
+		return auth, err
+	}
+
+	auth.user = string(user)
+	auth.accessToken = string(accessToken)
+
+	if (auth.user == "") != (auth.accessToken == "") {
+		log.Info("for basic authentication, both the user name and the password are required in the secret")
+		return auth, fmt.Errorf("for basic authentication, both %s and %s are required in secret %s",
+			userKey, accessTokenKey, secretName)
+	}
+
+	if strings.ContainsAny(auth.user, ": \t\r\n") {
+		log.Info(fmt.Sprintf("invalid %s in the secret, it must not contain colons, spaces or line breaks", userKey))
+		return auth, fmt.Errorf("invalid %s in secret %s: it must not contain colons, spaces or line breaks", userKey, secretName)
+	}
+
+	if strings.ContainsAny(auth.accessToken, "\r\n") {
+		log.Info(fmt.Sprintf("invalid %s in the secret, it must not contain line breaks", accessTokenKey))
+		return auth, fmt.Errorf("invalid %s in secret %s: it must not contain line breaks", accessTokenKey, secretName)
+	}
+
+	auth.clientKey = clientKey
+	auth.clientCert = clientCert
+
+	if (len(auth.clientKey) == 0 && len(auth.clientCert) > 0) || (len(auth.clientKey) > 0 && len(auth.clientCert) == 0) {
+		log.Info("for mTLS connection to Git, both clientKey (private key) and clientCert (certificate) are required in the channel secret")
+		return auth, fmt.Errorf("for mTLS connection, both %s (private key) and %s (certificate) are required in secret %s",
+			clientKeyKey, clientCertKey, secretName)
+	}
+
+	auth.sshPrivateKey = sshPrivateKey
+	if len(auth.sshPrivateKey) > 0 {
+		if block, _ := pem.Decode(auth.sshPrivateKey); block == nil {
+			log.Info(fmt.Sprintf("invalid %s in the secret, it is not a PEM encoded private key", sshPrivateKeyKey))
+			return auth, fmt.Errorf("invalid %s in secret %s: it is not a PEM encoded private key", sshPrivateKeyKey, secretName)
+		}
+	}
+
+	auth.sshPassphrase = string(bytes.TrimSpace(secret.Data[SSHPassphrase]))
+	auth.dockerConfigJSON = secret.Data[corev1.DockerConfigJsonKey]
+	auth.bearerToken = string(bytes.TrimSpace(secret.Data[BearerToken]))
+
+	if strings.ContainsAny(auth.bearerToken, " \t\r\n") {
+		log.Info("invalid bearerToken in the secret, it must not contain spaces or line breaks")
+		return auth, fmt.Errorf("invalid %s in secret %s: it must not contain spaces or line breaks", BearerToken, secretName)
+	}
+
+	auth.githubAppID = string(bytes.TrimSpace(secret.Data[GitHubAppID]))
+	auth.githubAppInstallationID = string(bytes.TrimSpace(secret.Data[GitHubAppInstallationID]))
+	auth.githubAppPrivateKey = bytes.TrimSpace(secret.Data[GitHubAppPrivateKey])
+
+	if auth.githubAppID != "" || auth.githubAppInstallationID != "" || len(auth.githubAppPrivateKey) > 0 {
+		if auth.githubAppID == "" || auth.githubAppInstallationID == "" || len(auth.githubAppPrivateKey) == 0 {
+			log.Info("for GitHub App authentication, githubAppID, githubAppInstallationID and githubAppPrivateKey are required in the secret")
+			return auth, fmt.Errorf("for GitHub App authentication, %s, %s and %s are required in secret %s",
+				GitHubAppID, GitHubAppInstallationID, GitHubAppPrivateKey, secretName)
+		}
+
+		if _, err := strconv.ParseInt(auth.githubAppInstallationID, 10, 64); err != nil {
+			return auth, fmt.Errorf("invalid %s %q in secret %s", GitHubAppInstallationID, auth.githubAppInstallationID, secretName)
+		}
+	}
+
+	return auth, nil
+}
+
+// getSecretData returns the first of the keys that is set in the secret, and its trimmed value
+func getSecretData(secret *corev1.Secret, keys ...string) (string, []byte) {
+	for _, key := range keys {
+		if value := bytes.TrimSpace(secret.Data[key]); len(value) > 0 {
+			return key, value
+		}
+	}
+
+	return keys[0], []byte("")
+}
+
+// validateSecretType checks that a typed secret holds the keys its type requires
+func validateSecretType(secret *corev1.Secret, user, password, tlsKey, tlsCert, sshPrivateKey []byte) error {
+	switch secret.Type {
+	case corev1.SecretTypeBasicAuth:
+		if len(user) == 0 || len(password) == 0 {
+			return fmt.Errorf("secret %s of type %s requires both %s and %s",
+				secret.Name, secret.Type, corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)
+		}
+	case corev1.SecretTypeSSHAuth:
+		if len(sshPrivateKey) == 0 {
+			return fmt.Errorf("secret %s of type %s requires %s", secret.Name, secret.Type, corev1.SSHAuthPrivateKey)
+		}
+	case corev1.SecretTypeTLS:
+		if len(tlsKey) == 0 || len(tlsCert) == 0 {
+			return fmt.Errorf("secret %s of type %s requires both %s and %s",
+				secret.Name, secret.Type, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		}
+	}
+
+	return nil
+}
+
+func getSourceConfig(c client.Client, log logr.Logger, configMapName, secret string) (*sourceConfig, error) {
+	config := &sourceConfig{
+		sourceType:               SourceTypeGit,
+		url:                      DefaultGitRepoUrl,
+		branch:                   DefaultGitRepoBranch,
+		path:                     DefaultGitRepoPath,
+		channel:                  DefaultChannel,
+		depth:                    DefaultGitRepoDepth,
+		submodules:               git.DefaultSubmoduleRecursionDepth,
+		sshStrictHostKeyChecking: true,
+		releaseRepository:        DefaultReleaseRepository,
+		releaseArchitectures:     DefaultReleaseArchitectures,
+		graphUrl:                 DefaultGraphUrl,
+		graphArch:                DefaultGraphArch,
+		connectTimeout:           DefaultConnectTimeout,
+		timeout:                  DefaultTimeout,
+		retries:                  DefaultRetries,
+		retryBackoff:             DefaultRetryBackoff,
+		secret:                   secret,
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: configMapName, Namespace: getPodNamespace()}, configMap)
+	if err != nil {
+		// Only the legacy default configmap falls back to the default Git repository, a missing
+		// or unreadable source configmap must not turn into a copy of the default repository
+		if configMapName == DefaultGitConfigMap && errors.IsNotFound(err) {
+			log.Info(fmt.Sprintf("unable to get config map %v, use default values.", configMapName))
+			return config, nil
+		}
+
+		log.Info(fmt.Sprintf("unable to get config map %v: %v", configMapName, err.Error()))
+		return nil, fmt.Errorf("failed to get config map %v: %w", configMapName, err)
+	}
+
+	if sourceType := strings.TrimSpace(configMap.Data[SourceType]); sourceType != "" {
+		config.sourceType = strings.ToLower(sourceType)
+	}
+
+	if gitRepoUrl := configMap.Data[GitRepoUrl]; gitRepoUrl != "" {
+		config.url = gitRepoUrl
+	}
+
+	config.includePatterns, err = parseGlobs(configMap.Data[IncludePatterns])
+	if err != nil {
+		log.Info(fmt.Sprintf("invalid %s: %v", IncludePatterns, err.Error()))
+		return nil, fmt.Errorf("invalid %s in config map %v: %w", IncludePatterns, configMapName, err)
+	}
+
+	config.excludePatterns, err = parseGlobs(configMap.Data[ExcludePatterns])
+	if err != nil {
+		log.Info(fmt.Sprintf("invalid %s: %v", ExcludePatterns, err.Error()))
+		return nil, fmt.Errorf("invalid %s in config map %v: %w", ExcludePatterns, configMapName, err)
+	}
+
+	config.fallbackUrls = strings.FieldsFunc(configMap.Data[GitRepoFallbackUrls], func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+
+	if gitRepoBranch := configMap.Data[GitRepoBranch]; gitRepoBranch != "" {
+		config.branch = gitRepoBranch
+	}
+
+	config.ref = strings.TrimSpace(configMap.Data[GitRepoRef])
+	config.tagPattern = strings.TrimSpace(configMap.Data[GitRepoTagPattern])
+
+	if gitRepoPath := configMap.Data[GitRepoPath]; gitRepoPath != "" {
+		config.path = gitRepoPath
+	}
+
+	if channel := configMap.Data[Channel]; channel != "" {
+		config.channel = channel
+	}
+
+	if depth := strings.TrimSpace(configMap.Data[GitRepoDepth]); depth != "" {
+		value, err := strconv.Atoi(depth)
+		if err != nil || value < 0 {
+			log.Info(fmt.Sprintf("invalid value for gitRepoDepth: %v", depth))
+		} else {
+			config.depth = value
+		}
+	}
+
+	// gitRepoSubmodules is true, false or the submodule recursion depth
+	if submodules := strings.TrimSpace(configMap.Data[GitRepoSubmodules]); submodules != "" {
+		if recurse, err := strconv.ParseBool(submodules); err == nil {
+			config.submodules = git.NoRecurseSubmodules
+			if recurse {
+				config.submodules = git.DefaultSubmoduleRecursionDepth
+			}
+		} else if value, err := strconv.Atoi(submodules); err == nil && value >= 0 {
+			config.submodules = git.SubmoduleRescursivity(value)
+		} else {
+			log.Info(fmt.Sprintf("invalid value for gitRepoSubmodules: %v", submodules))
+		}
+	}
+
+	config.directoryPath = strings.TrimSpace(configMap.Data[DirectoryPath])
+	config.tarballUrl = strings.TrimSpace(configMap.Data[TarballUrl])
+	config.tarballPath = strings.TrimSpace(configMap.Data[TarballPath])
+	config.ociArtifact = strings.TrimSpace(configMap.Data[OCIArtifact])
+	config.ociPath = strings.TrimSpace(configMap.Data[OCIPath])
+
+	if releaseRepository := strings.TrimSpace(configMap.Data[ReleaseRepository]); releaseRepository != "" {
+		config.releaseRepository = releaseRepository
+	}
+
+	config.releaseTagPattern = strings.TrimSpace(configMap.Data[ReleaseTagPattern])
+	config.releaseVersionRange = strings.TrimSpace(configMap.Data[ReleaseVersionRange])
+
+	if releaseArchitectures := strings.TrimSpace(configMap.Data[ReleaseArchitectures]); releaseArchitectures != "" {
+		config.releaseArchitectures = releaseArchitectures
+	}
+
+	includePrerelease := configMap.Data[ReleaseIncludePrerelease]
+	if includePrerelease != "" {
+		config.releaseIncludePrerelease, err = strconv.ParseBool(includePrerelease)
+		if err != nil {
+			log.Info(fmt.Sprintf("invalid bool value for releaseIncludePrerelease: %v", err.Error()))
+		}
+	}
+
+	if graphUrl := strings.TrimSpace(configMap.Data[GraphUrl]); graphUrl != "" {
+		config.graphUrl = graphUrl
+	}
+
+	config.graphChannels = strings.TrimSpace(configMap.Data[GraphChannels])
+
+	if graphArch := strings.TrimSpace(configMap.Data[GraphArch]); graphArch != "" {
+		config.graphArch = graphArch
+	}
+
+	config.caCerts = configMap.Data[CaCerts]
+
+	config.caBundleConfigMap = strings.TrimSpace(configMap.Data[CaBundleConfigMapRef])
+	config.caBundleConfigMapKey = DefaultCaBundleConfigMapKey
+	if key := strings.TrimSpace(configMap.Data[CaBundleConfigMapKey]); key != "" {
+		config.caBundleConfigMapKey = key
+	}
+
+	if config.caBundleConfigMap != "" {
+		config.caBundle, err = getCABundle(c, log, config.caBundleConfigMap, config.caBundleConfigMapKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	skipCertVerify := configMap.Data[InsecureSkipVerify]
+	if skipCertVerify != "" {
+		config.insecureSkipVerify, err = strconv.ParseBool(skipCertVerify)
+		if err != nil {
+			log.Info(fmt.Sprintf("invalid bool value for insecureSkipVerify: %v", err.Error()))
+		}
+	}
+
+	config.sshKnownHosts = configMap.Data[SSHKnownHosts]
+
+	if secret := configMap.Data[GitSecret]; secret != "" {
+		config.secret = secret
+	}
+
+	// The proxy keys of the configmap override the cluster proxy
+	useClusterProxy := false
+	if value := strings.TrimSpace(configMap.Data[UseClusterProxy]); value != "" {
+		useClusterProxy, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Info(fmt.Sprintf("invalid bool value for useClusterProxy: %v", err.Error()))
+		}
+	}
+
+	if useClusterProxy {
+		clusterProxy, err := getClusterProxy(c, log)
+		if err != nil {
+			return nil, err
+		}
+		config.proxy = *clusterProxy
+	}
+
+	if httpProxy := strings.TrimSpace(configMap.Data[HTTPProxy]); httpProxy != "" {
+		config.proxy.httpProxy = httpProxy
+	}
+
+	if httpsProxy := strings.TrimSpace(configMap.Data[HTTPSProxy]); httpsProxy != "" {
+		config.proxy.httpsProxy = httpsProxy
+	}
+
+	if noProxy := strings.TrimSpace(configMap.Data[NoProxy]); noProxy != "" {
+		config.proxy.noProxy = noProxy
+	}
+
+	for key, value := range map[string]*time.Duration{
+		ConnectTimeout: &config.connectTimeout,
+		Timeout:        &config.timeout,
+		RetryBackoff:   &config.retryBackoff,
+	} {
+		if duration := strings.TrimSpace(configMap.Data[key]); duration != "" {
+			parsed, err := time.ParseDuration(duration)
+			if err != nil || parsed < 0 {
+				log.Info(fmt.Sprintf("invalid duration value for %s: %v", key, duration))
+			} else {
+				*value = parsed
+			}
+		}
+	}
+
+	if retries := strings.TrimSpace(configMap.Data[Retries]); retries != "" {
+		value, err := strconv.Atoi(retries)
+		if err != nil || value < 0 {
+			log.Info(fmt.Sprintf("invalid value for retries: %v", retries))
+		} else {
+			config.retries = value
+		}
+	}
+
+	config.githubApiUrl = strings.TrimSpace(configMap.Data[GitHubAPIUrl])
+
+	config.verifySignature = strings.ToLower(strings.TrimSpace(configMap.Data[VerifySignature]))
+	config.signatureKeyringSecret = strings.TrimSpace(configMap.Data[SignatureKeyringSecret])
+	config.signatureKeyringConfigMap = strings.TrimSpace(configMap.Data[SignatureKeyringConfigMap])
+
+	strictHostKeyChecking := configMap.Data[SSHStrictHostKeyChecking]
+	if strictHostKeyChecking != "" {
+		strict, err := strconv.ParseBool(strictHostKeyChecking)
+		if err != nil {
+			log.Info(fmt.Sprintf("invalid bool value for sshStrictHostKeyChecking: %v", err.Error()))
+		} else {
+			config.sshStrictHostKeyChecking = strict
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,389 @@
+package clusterimageset
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	hivev1 "github.com/openshift/hive/apis/hive/v1"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestNewSource(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	tests := []struct {
+		name       string
+		sourceType string
+		want       interface{}
+		wantErr    bool
+	}{
+		{
+			name:       "default to git",
+			sourceType: "",
+			want:       &gitSource{},
+		},
+		{
+			name:       "git",
+			sourceType: "git",
+			want:       &gitSource{},
+		},
+		{
+			name:       "directory",
+			sourceType: "Directory",
+			want:       &directorySource{},
+		},
+		{
+			name:       "tarball",
+			sourceType: "tarball",
+			want:       &tarballSource{},
+		},
+		{
+			name:       "oci",
+			sourceType: "oci",
+			want:       &ociSource{},
+		},
+		{
+			name:       "release",
+			sourceType: "release",
+			want:       &releaseSource{},
+		},
+		{
+			name:       "graph",
+			sourceType: "graph",
+			want:       &graphSource{},
+		},
+		{
+			name:       "unsupported",
+			sourceType: "svn",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			configMap := getSourceConfigMap("source", map[string]string{SourceType: tt.sourceType})
+			g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+
+			config, err := getSourceConfig(c, log, "source", "secret")
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			source, err := newSource(c, log, config, "source", "secret", t.TempDir())
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(source).To(gomega.BeAssignableToTypeOf(tt.want))
+			g.Expect(source.Name()).To(gomega.Equal("source"))
+		})
+	}
+}
+
+func TestGetSourceConfigMissingConfigMap(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	tests := []struct {
+		name      string
+		configMap string
+		getErr    error
+		wantErr   bool
+	}{
+		{
+			name:      "default configmap not found",
+			configMap: DefaultGitConfigMap,
+		},
+		{
+			name:      "configured configmap not found",
+			configMap: "internal-releases",
+			wantErr:   true,
+		},
+		{
+			name:      "default configmap unreadable",
+			configMap: DefaultGitConfigMap,
+			getErr:    errors.NewServiceUnavailable("etcd is unavailable"),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := interceptor.NewClient(initClient().(client.WithWatch), interceptor.Funcs{
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+					if tt.getErr != nil {
+						return tt.getErr
+					}
+					return c.Get(ctx, key, obj, opts...)
+				},
+			})
+
+			config, err := getSourceConfig(c, log, tt.configMap, "secret")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getSourceConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && config.url != DefaultGitRepoUrl {
+				t.Errorf("getSourceConfig() url = %v, want %v", config.url, DefaultGitRepoUrl)
+			}
+		})
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"img4.11.0-x86-64.yaml":       getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+		"4.12/img4.12.0-x86-64.yaml":  getClusterImageSetYAML("img4.12.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.12.0-x86_64"),
+		"4.12/img4.12.0-aarch64.yaml": getClusterImageSetYAML("img4.12.0-aarch64-appsub", "quay.io/openshift-release-dev/ocp-release:4.12.0-aarch64"),
+	})
+
+	c := initClient()
+	g.Expect(c.Create(context.TODO(), getSourceConfigMap("directory", map[string]string{
+		SourceType:    SourceTypeDirectory,
+		DirectoryPath: dir,
+	}))).To(gomega.Succeed())
+	g.Expect(c.Create(context.TODO(), getSourceConfigMap("nopath", map[string]string{
+		SourceType: SourceTypeDirectory,
+	}))).To(gomega.Succeed())
+
+	s := newDirectorySource(c, log, "directory", "secret")
+
+	content, err := s.Fetch()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(content.Manifests).To(gomega.HaveLen(3))
+	g.Expect(content.Manifests[0].Path).To(gomega.Equal("4.12/img4.12.0-aarch64.yaml"))
+
+	revision, err := s.Revision()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(revision).To(gomega.Equal(content.Revision))
+
+	// The revision changes with the content
+	writeFiles(t, dir, map[string]string{
+		"img4.11.0-x86-64.yaml": getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64-0"),
+	})
+	revision, err = s.Revision()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(revision).NotTo(gomega.Equal(content.Revision))
+
+	_, err = newDirectorySource(c, log, "nopath", "secret").Fetch()
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestDirectorySourceFilters(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"img4.11.0-x86-64.yaml":        "img4.11.0",
+		"4.12/img4.12.0-x86-64.yml":    "img4.12.0",
+		"4.12/img4.12.0-aarch64.yaml":  "img4.12.0-aarch64",
+		"old/img4.10.0-x86-64.yaml":    "img4.10.0",
+		"README.md":                    "# Releases",
+		"OWNERS":                       "approvers: []",
+		".gitkeep":                     "",
+		".hidden.yaml":                 "hidden",
+		".github/workflows/build.yaml": "workflow",
+		"4.12/.draft/img4.12.1.yaml":   "draft",
+	})
+
+	c := initClient()
+
+	tests := []struct {
+		name      string
+		data      map[string]string
+		wantPaths []string
+		wantErr   bool
+	}{
+		{
+			name:      "default patterns",
+			data:      map[string]string{},
+			wantPaths: []string{"4.12/img4.12.0-aarch64.yaml", "4.12/img4.12.0-x86-64.yml", "img4.11.0-x86-64.yaml", "old/img4.10.0-x86-64.yaml"},
+		},
+		{
+			name:      "include and exclude patterns",
+			data:      map[string]string{IncludePatterns: "**/*.{yaml,yml}", ExcludePatterns: "old/**, **/*aarch64*"},
+			wantPaths: []string{"4.12/img4.12.0-x86-64.yml", "img4.11.0-x86-64.yaml"},
+		},
+		{
+			name:      "include patterns of a directory",
+			data:      map[string]string{IncludePatterns: "4.12/*.yaml\n4.12/*.yml"},
+			wantPaths: []string{"4.12/img4.12.0-aarch64.yaml", "4.12/img4.12.0-x86-64.yml"},
+		},
+		{
+			name:      "hidden files are never included",
+			data:      map[string]string{IncludePatterns: "**"},
+			wantPaths: []string{"4.12/img4.12.0-aarch64.yaml", "4.12/img4.12.0-x86-64.yml", "OWNERS", "README.md", "img4.11.0-x86-64.yaml", "old/img4.10.0-x86-64.yaml"},
+		},
+		{
+			name:    "invalid pattern",
+			data:    map[string]string{ExcludePatterns: "old/[a-"},
+			wantErr: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{SourceType: SourceTypeDirectory, DirectoryPath: dir}
+			for key, value := range tt.data {
+				data[key] = value
+			}
+
+			name := fmt.Sprintf("directory-%d", i)
+			if err := c.Create(context.TODO(), getSourceConfigMap(name, data)); err != nil {
+				t.Fatalf("failed to create the configmap: %v", err)
+			}
+
+			content, err := newDirectorySource(c, log, name, "secret").Fetch()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("directorySource.Fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			paths := []string{}
+			for _, manifest := range content.Manifests {
+				paths = append(paths, manifest.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("directorySource.Fetch() paths = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestSyncImageSetDirectorySource(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"img4.11.0-x86-64.yaml": getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+	})
+
+	c := initClient()
+	g.Expect(c.Create(context.TODO(), getSourceConfigMap("local-releases", map[string]string{
+		SourceType:    SourceTypeDirectory,
+		DirectoryPath: dir,
+	}))).To(gomega.Succeed())
+
+	zapLog, _ := zap.NewDevelopment()
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:       zapr.NewLogger(zapLog),
+		Interval:  60,
+		ConfigMap: "local-releases",
+	})
+
+	g.Expect(iCtrl.syncClusterImageSet(true)).To(gomega.Succeed())
+	g.Expect(iCtrl.lastRevision).NotTo(gomega.BeEmpty())
+
+	imageset := &hivev1.ClusterImageSet{}
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.0-x86-64-appsub"}, imageset)).To(gomega.Succeed())
+	g.Expect(imageset.GetAnnotations()[SourceAnnotation]).To(gomega.Equal("local-releases"))
+
+	// A new file changes the revision, the sync is not skipped
+	writeFiles(t, dir, map[string]string{
+		"img4.11.1-x86-64.yaml": getClusterImageSetYAML("img4.11.1-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.1-x86_64"),
+	})
+	g.Expect(iCtrl.syncClusterImageSet(false)).To(gomega.Succeed())
+	g.Expect(c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.1-x86-64-appsub"}, imageset)).To(gomega.Succeed())
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func getSourceConfigMap(name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "multicluster-engine",
+		},
+		Data: data,
+	}
+}
+
+func TestManifestFilterMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "**/*.yaml", name: "img.yaml", want: true},
+		{pattern: "**/*.yaml", name: "4.14/img.yaml", want: true},
+		{pattern: "**/*.yaml", name: "4.14/x86_64/img.yaml", want: true},
+		{pattern: "**/*.yaml", name: "img.yml", want: false},
+		{pattern: "**/*.yaml", name: "4.14/.hidden/img.yaml", want: false},
+		{pattern: "*.yaml", name: "4.14/img.yaml", want: false},
+		{pattern: "4.14/**", name: "4.14/x86_64/img.yaml", want: true},
+		{pattern: "4.14/**", name: "4.15/img.yaml", want: false},
+		{pattern: "**/x86_64/*.yaml", name: "4.14/x86_64/img.yaml", want: true},
+		{pattern: "**/x86_64/*.yaml", name: "x86_64/img.yaml", want: true},
+		{pattern: "4.1?/img-[0-9].yaml", name: "4.14/img-1.yaml", want: true},
+		{pattern: "**/*.{yaml,yml}", name: "4.14/img.yml", want: true},
+		{pattern: "{4.14,4.15}/**/*.yaml", name: "4.15/img.yaml", want: true},
+		{pattern: "{4.14,4.15}/**/*.yaml", name: "4.16/img.yaml", want: false},
+		{pattern: "img-{a,{b,c}}.yaml", name: "img-c.yaml", want: true},
+		{pattern: "img-{a,b.yaml", name: "img-a", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			filter := newManifestFilter(&sourceConfig{includePatterns: []string{tt.pattern}})
+			if got := filter.matches(tt.name); got != tt.want {
+				t.Errorf("manifestFilter.matches(%q) with %q = %v, want %v", tt.name, tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGlobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: []string{}},
+		{name: "comma separated", value: "**/*.yaml, /4.14/**", want: []string{"**/*.yaml", "4.14/**"}},
+		{name: "new line separated", value: "**/*.yaml\n**/*.yml\n", want: []string{"**/*.yaml", "**/*.yml"}},
+		{name: "braces", value: "**/*.{yaml,yml},old/**", want: []string{"**/*.{yaml,yml}", "old/**"}},
+		{name: "invalid character class", value: "img-[a.yaml", wantErr: true},
+		{name: "unbalanced braces", value: "img-{a.yaml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGlobs(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGlobs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseGlobs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
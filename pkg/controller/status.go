@@ -0,0 +1,146 @@
+package clusterimageset
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DefaultStatusConfigMap is the configmap where the sync status of each source is recorded
+	DefaultStatusConfigMap = "cluster-image-set-status"
+)
+
+// sourceStatus is the sync status of a source, recorded in the status configmap under the
+// name of the source configmap.
+type sourceStatus struct {
+	// Revision is the revision of the source that was last applied
+	Revision string `json:"revision,omitempty"`
+	// LastSyncTime is the time the revision was applied
+	LastSyncTime string `json:"lastSyncTime,omitempty"`
+	// VerifiedBy is the identity of the key that signed the applied revision
+	VerifiedBy string `json:"verifiedBy,omitempty"`
+	// URL is the URL the applied revision was fetched from
+	URL string `json:"url,omitempty"`
+	// LastError is the reason the last sync failed, it is cleared by a successful sync
+	LastError string `json:"lastError,omitempty"`
+	// FailedFiles are the files that failed to be read, loaded or applied by the last sync, when
+	// the sync continues on errors
+	FailedFiles []fileFailure `json:"failedFiles,omitempty"`
+}
+
+// getSourceStatus returns the status of the source recorded in the status configmap
+func (r *ClusterImageSetController) getSourceStatus(name string) (*sourceStatus, error) {
+	status := &sourceStatus{}
+
+	if r.statusConfigMap == "" {
+		return status, nil
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.statusConfigMap, Namespace: getPodNamespace()}, configMap)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return status, nil
+		}
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal([]byte(configMap.Data[name]), status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// setSourceStatus records the status of the source in the status configmap, the status configmap
+// is created when it does not exist.
+func (r *ClusterImageSetController) setSourceStatus(name string, status *sourceStatus) error {
+	if r.statusConfigMap == "" {
+		return nil
+	}
+
+	data, err := yaml.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err = r.client.Get(context.TODO(), types.NamespacedName{Name: r.statusConfigMap, Namespace: getPodNamespace()}, configMap)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.statusConfigMap,
+				Namespace: getPodNamespace(),
+			},
+			Data: map[string]string{name: string(data)},
+		}
+		return r.client.Create(context.TODO(), configMap)
+	}
+
+	if configMap.Data[name] == string(data) {
+		return nil
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[name] = string(data)
+
+	return r.client.Update(context.TODO(), configMap)
+}
+
+// recordSyncError records the reason the sync of the source failed and its failed files, the
+// previously applied revision is kept.
+func (r *ClusterImageSetController) recordSyncError(name string, syncErr error, failures []fileFailure) {
+	status, err := r.getSourceStatus(name)
+	if err == nil {
+		status.LastError = syncErr.Error()
+		status.FailedFiles = failures
+		err = r.setSourceStatus(name, status)
+	}
+
+	if err != nil {
+		r.log.Info(fmt.Sprintf("failed to update status of source %v: %v", name, err.Error()))
+	}
+}
+
+// recordFailedFiles records the failed files of the source that remain after a retry, the
+// applied revision is kept.
+func (r *ClusterImageSetController) recordFailedFiles(name string, failures []fileFailure) {
+	status, err := r.getSourceStatus(name)
+	if err == nil {
+		status.FailedFiles = failures
+		err = r.setSourceStatus(name, status)
+	}
+
+	if err != nil {
+		r.log.Info(fmt.Sprintf("failed to update status of source %v: %v", name, err.Error()))
+	}
+}
+
+// recordSyncSuccess records the revision of the source that was applied, and the files that
+// failed when the sync continues on errors
+func (r *ClusterImageSetController) recordSyncSuccess(name string, content *SourceContent, failures []fileFailure) {
+	status := &sourceStatus{
+		Revision:     content.Revision,
+		LastSyncTime: time.Now().UTC().Format(time.RFC3339),
+		VerifiedBy:   content.VerifiedBy,
+		URL:          content.URL,
+		FailedFiles:  failures,
+	}
+
+	if err := r.setSourceStatus(name, status); err != nil {
+		r.log.Info(fmt.Sprintf("failed to update status of source %v: %v", name, err.Error()))
+	}
+}
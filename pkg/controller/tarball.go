@@ -0,0 +1,246 @@
+package clusterimageset
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// maxTarballSize limits the size of a downloaded tarball
+	maxTarballSize = 64 << 20
+	// maxUncompressedTarballSize limits the size of a gzipped tarball once decompressed
+	maxUncompressedTarballSize = 256 << 20
+)
+
+// errHeadNotSupported is returned when the tarball server rejects HEAD requests
+var errHeadNotSupported = errors.New("HEAD requests are not supported")
+
+// tarballSource is a tar or gzipped tar archive served over HTTP(S) that provides clusterImageSets
+type tarballSource struct {
+	client    client.Client
+	log       logr.Logger
+	configMap string
+	secret    string
+}
+
+func newTarballSource(c client.Client, log logr.Logger, configMap, secret string) *tarballSource {
+	return &tarballSource{
+		client:    c,
+		log:       log.WithValues("source", configMap),
+		configMap: configMap,
+		secret:    secret,
+	}
+}
+
+func (s *tarballSource) Name() string {
+	return s.configMap
+}
+
+// Revision returns the ETag or Last-Modified header of the tarball with a HEAD request. If the
+// server sets neither, or rejects HEAD requests, the tarball is downloaded and its revision is
+// returned.
+func (s *tarballSource) Revision() (string, error) {
+	config, err := getSourceConfig(s.client, s.log, s.configMap, s.secret)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.doRequest(config, http.MethodHead)
+	if err != nil && !errors.Is(err, errHeadNotSupported) {
+		return "", err
+	}
+
+	if err == nil {
+		resp.Body.Close()
+
+		if revision := getTarballRevision(resp.Header, nil); revision != "" {
+			return revision, nil
+		}
+	}
+
+	content, err := s.fetch(config)
+	if err != nil {
+		return "", err
+	}
+
+	return content.Revision, nil
+}
+
+func (s *tarballSource) Fetch() (*SourceContent, error) {
+	config, err := getSourceConfig(s.client, s.log, s.configMap, s.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.fetch(config)
+}
+
+// fetch downloads the tarball and returns its clusterImageSet files
+func (s *tarballSource) fetch(config *sourceConfig) (*SourceContent, error) {
+	resp, err := s.doRequest(config, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readLimited(resp.Body, maxTarballSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tarball %v: %w", config.tarballUrl, err)
+	}
+
+	s.log.Info(fmt.Sprintf("loading clusterImageSets from tarball: %v", config.tarballUrl))
+
+	manifests, err := readTarballManifests(data, config.tarballPath, newManifestFilter(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tarball %v: %w", config.tarballUrl, err)
+	}
+
+	return &SourceContent{Revision: getTarballRevision(resp.Header, data), Manifests: manifests}, nil
+}
+
+func (s *tarballSource) doRequest(config *sourceConfig, method string) (*http.Response, error) {
+	if config.tarballUrl == "" {
+		return nil, fmt.Errorf("%s is required in config map %v for %s source", TarballUrl, s.configMap, SourceTypeTarball)
+	}
+
+	auth, err := getSourceAuth(s.client, s.log, config.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig, err := getTLSClientConfig(s.log, config, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, config.tarballUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.user != "" && auth.accessToken != "" {
+		req.SetBasicAuth(auth.user, auth.accessToken)
+	}
+
+	httpClient := newHTTPClient(s.log, config, clientConfig)
+	// release assets and presigned object store URLs are served behind redirects, the
+	// Authorization header is not forwarded to other hosts
+	httpClient.CheckRedirect = nil
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+
+		if method == http.MethodHead &&
+			(resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+			return nil, fmt.Errorf("failed to get tarball %v: %v: %w", config.tarballUrl, resp.Status, errHeadNotSupported)
+		}
+
+		return nil, fmt.Errorf("failed to get tarball %v: %v", config.tarballUrl, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// getTarballRevision returns the ETag or Last-Modified header, or the digest of the tarball
+// when the server sets neither of them.
+func getTarballRevision(header http.Header, data []byte) string {
+	if etag := header.Get("ETag"); etag != "" {
+		return etag
+	}
+
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		return lastModified
+	}
+
+	if data == nil {
+		return ""
+	}
+
+	digest := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(digest[:])
+}
+
+// readTarballManifests returns the regular files of a tar or gzipped tar archive under the
+// given directory of the archive that the filter selects, with their path relative to that
+// directory.
+func readTarballManifests(data []byte, dir string, filter *manifestFilter) ([]Manifest, error) {
+	var reader io.Reader = bytes.NewReader(data)
+
+	buffered := bufio.NewReader(reader)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+
+		// A small gzipped tarball can decompress to much more data than it holds
+		tarball, err := readLimited(gzipReader, maxUncompressedTarballSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress tarball: %w", err)
+		}
+
+		reader = bytes.NewReader(tarball)
+	} else {
+		reader = buffered
+	}
+
+	prefix := strings.Trim(path.Clean("/"+dir), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	manifests := []Manifest{}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		if !filter.matches(strings.TrimPrefix(name, prefix)) {
+			continue
+		}
+
+		file, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+
+		manifests = append(manifests, Manifest{Path: strings.TrimPrefix(name, prefix), Data: file})
+	}
+
+	return manifests, nil
+}
@@ -0,0 +1,199 @@
+package clusterimageset
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	"go.uber.org/zap"
+)
+
+func TestTarballSource(t *testing.T) {
+	zapLog, _ := zap.NewDevelopment()
+	log := zapr.NewLogger(zapLog)
+
+	archive := getTarball(t, map[string]string{
+		"releases/clusterImageSets/fast/img4.11.0-x86-64.yaml":   getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+		"releases/clusterImageSets/stable/img4.10.0-x86-64.yaml": getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+	})
+
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user1" || password != "token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/etag.tar.gz":
+			w.Header().Set("ETag", etag)
+		case "/noetag.tar.gz":
+		case "/redirect.tar.gz":
+			http.Redirect(w, r, "/etag.tar.gz", http.StatusFound)
+			return
+		case "/nohead.tar.gz":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(archive)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		url           string
+		path          string
+		wantManifests []string
+		wantRevision  string
+		wantErr       bool
+	}{
+		{
+			name:          "etag revision",
+			url:           server.URL + "/etag.tar.gz",
+			path:          "releases/clusterImageSets/fast",
+			wantManifests: []string{"img4.11.0-x86-64.yaml"},
+			wantRevision:  etag,
+		},
+		{
+			name: "digest revision",
+			url:  server.URL + "/noetag.tar.gz",
+			path: "/releases/clusterImageSets/",
+			wantManifests: []string{
+				"fast/img4.11.0-x86-64.yaml",
+				"stable/img4.10.0-x86-64.yaml",
+			},
+		},
+		{
+			name:          "redirect",
+			url:           server.URL + "/redirect.tar.gz",
+			path:          "releases/clusterImageSets/fast",
+			wantManifests: []string{"img4.11.0-x86-64.yaml"},
+			wantRevision:  etag,
+		},
+		{
+			name:          "HEAD not allowed",
+			url:           server.URL + "/nohead.tar.gz",
+			path:          "releases/clusterImageSets/fast",
+			wantManifests: []string{"img4.11.0-x86-64.yaml"},
+			wantRevision:  etag,
+		},
+		{
+			name:    "not found",
+			url:     server.URL + "/missing.tar.gz",
+			wantErr: true,
+		},
+		{
+			name:    "no url",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			g.Expect(c.Create(context.TODO(), getSourceConfigMap("tarball", map[string]string{
+				SourceType:  SourceTypeTarball,
+				TarballUrl:  tt.url,
+				TarballPath: tt.path,
+			}))).To(gomega.Succeed())
+			g.Expect(c.Create(context.TODO(), getSecret("tarball", []byte("user1"), []byte("token1"), nil, nil))).To(gomega.Succeed())
+
+			s := newTarballSource(c, log, "tarball", "tarball")
+
+			revision, err := s.Revision()
+			if tt.wantErr {
+				g.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			content, err := s.Fetch()
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(content.Revision).To(gomega.Equal(revision))
+			if tt.wantRevision != "" {
+				g.Expect(revision).To(gomega.Equal(tt.wantRevision))
+			}
+
+			paths := []string{}
+			for _, manifest := range content.Manifests {
+				paths = append(paths, manifest.Path)
+			}
+			g.Expect(paths).To(gomega.ConsistOf(tt.wantManifests))
+		})
+	}
+}
+
+func TestReadTarballManifests(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// Uncompressed tar archives are supported too
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	g.Expect(tarWriter.WriteHeader(&tar.Header{Name: "fast/", Typeflag: tar.TypeDir, Mode: 0750})).To(gomega.Succeed())
+	g.Expect(tarWriter.WriteHeader(&tar.Header{Name: "fast/img.yaml", Typeflag: tar.TypeReg, Mode: 0600, Size: 4})).To(gomega.Succeed())
+	_, err := tarWriter.Write([]byte("data"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(tarWriter.Close()).To(gomega.Succeed())
+
+	manifests, err := readTarballManifests(buf.Bytes(), "fast", newManifestFilter(&sourceConfig{}))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(manifests).To(gomega.Equal([]Manifest{{Path: "img.yaml", Data: []byte("data")}}))
+
+	_, err = readTarballManifests([]byte("not a tarball"), "", newManifestFilter(&sourceConfig{}))
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	// A gzip bomb decompresses to more than the limit
+	buf.Reset()
+	gzipWriter, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	zeros := make([]byte, 1<<20)
+	for written := 0; written <= maxUncompressedTarballSize; written += len(zeros) {
+		_, err = gzipWriter.Write(zeros)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+	g.Expect(gzipWriter.Close()).To(gomega.Succeed())
+	g.Expect(buf.Len()).To(gomega.BeNumerically("<", maxTarballSize))
+
+	_, err = readTarballManifests(buf.Bytes(), "", newManifestFilter(&sourceConfig{}))
+	g.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("larger than")))
+}
+
+func getTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for name, content := range files {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,124 @@
+package clusterimageset
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// sourceConfigWatcher requests a full resync of the clusterImageSets when a configmap or secret
+// that configures a source changes, without waiting for a new revision of the source.
+type sourceConfigWatcher struct {
+	controller *ClusterImageSetController
+	// startTime is when the watcher started, truncated to the second precision of the creation
+	// timestamps. The objects created before were read by the first sync.
+	startTime time.Time
+}
+
+func newSourceConfigWatcher(controller *ClusterImageSetController) *sourceConfigWatcher {
+	return &sourceConfigWatcher{controller: controller, startTime: time.Now().Truncate(time.Second)}
+}
+
+// SetupWithManager watches the configmaps and secrets of the manager cache
+func (w *sourceConfigWatcher) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("source-config").
+		Watches(&corev1.ConfigMap{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(w.predicate())).
+		Watches(&corev1.Secret{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(w.predicate())).
+		Complete(w)
+}
+
+func (w *sourceConfigWatcher) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	w.controller.log.Info(fmt.Sprintf("source configuration %v changed, resyncing", req.Name))
+	w.controller.Resync()
+
+	return reconcile.Result{}, nil
+}
+
+// predicate filters the events of the source configmaps and secrets, whose data changed
+func (w *sourceConfigWatcher) predicate() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			// The cache lists the existing objects when it starts. An object created in the
+			// second the watcher started resyncs, it may have been missed by the first sync.
+			return !e.Object.GetCreationTimestamp().Time.Before(w.startTime) && w.isSourceConfig(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !reflect.DeepEqual(getObjectData(e.ObjectOld), getObjectData(e.ObjectNew)) && w.isSourceConfig(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return w.isSourceConfig(e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// isSourceConfig returns true when the object is a configmap or a secret used by a source. It
+// compares the names read by the last sync, without reading the source configmaps on every event.
+func (w *sourceConfigWatcher) isSourceConfig(obj client.Object) bool {
+	if obj.GetNamespace() != getPodNamespace() {
+		return false
+	}
+
+	r := w.controller
+	refs := r.sourceConfigRefs.Load()
+	if refs == nil {
+		refs = newSourceConfigRefs(r.configMaps)
+	}
+
+	if _, isSecret := obj.(*corev1.Secret); isSecret {
+		return obj.GetName() == r.secret || refs.secrets.Has(obj.GetName())
+	}
+
+	return refs.configMaps.Has(obj.GetName())
+}
+
+// sourceConfigRefs are the names of the configmaps and secrets that configure the sources
+type sourceConfigRefs struct {
+	configMaps sets.Set[string]
+	secrets    sets.Set[string]
+}
+
+func newSourceConfigRefs(configMaps []string) *sourceConfigRefs {
+	return &sourceConfigRefs{configMaps: sets.New(configMaps...), secrets: sets.New[string]()}
+}
+
+// add records the configmaps and secrets referenced by the configuration of a source
+func (refs *sourceConfigRefs) add(config *sourceConfig) {
+	for _, configMap := range []string{config.caBundleConfigMap, config.signatureKeyringConfigMap} {
+		if configMap != "" {
+			refs.configMaps.Insert(configMap)
+		}
+	}
+
+	for _, secret := range []string{config.secret, config.signatureKeyringSecret} {
+		if secret != "" {
+			refs.secrets.Insert(secret)
+		}
+	}
+}
+
+// getObjectData returns the data of a configmap or a secret
+func getObjectData(obj client.Object) interface{} {
+	switch o := obj.(type) {
+	case *corev1.ConfigMap:
+		return []interface{}{o.Data, o.BinaryData}
+	case *corev1.Secret:
+		return o.Data
+	}
+
+	return nil
+}
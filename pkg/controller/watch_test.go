@@ -0,0 +1,249 @@
+package clusterimageset
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	hivev1 "github.com/openshift/hive/apis/hive/v1"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestSourceConfigWatcherPredicate(t *testing.T) {
+	c := initClient()
+	configMap := getDefaultConfigMap()
+	configMap.Data[GitSecret] = "git-auth"
+	configMap.Data[SignatureKeyringConfigMap] = "signers"
+	configMap.Data[CaBundleConfigMapRef] = "trusted-ca-bundle"
+	if err := c.Create(context.TODO(), configMap); err != nil {
+		t.Fatalf("failed to create the configmap: %v", err)
+	}
+
+	caBundle := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "trusted-ca-bundle", Namespace: getPodNamespace()},
+		Data:       map[string]string{DefaultCaBundleConfigMapKey: "bundle"},
+	}
+	if err := c.Create(context.TODO(), caBundle); err != nil {
+		t.Fatalf("failed to create the configmap: %v", err)
+	}
+
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:       zapr.NewLogger(zap.NewNop()),
+		ConfigMap: "cluster-image-set-git-repo",
+		Secret:    "cluster-image-set-git-repo",
+	})
+	w := newSourceConfigWatcher(iCtrl)
+
+	// The watcher compares the names referenced by the configmaps at the last sync
+	if _, err := iCtrl.getSources(); err != nil {
+		t.Fatalf("failed to get the sources: %v", err)
+	}
+
+	newConfigMap := func(name string, created time.Time, data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: getPodNamespace(), CreationTimestamp: metav1.NewTime(created)},
+			Data:       data,
+		}
+	}
+	newSecret := func(name, namespace string, data map[string]string) *corev1.Secret {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       map[string][]byte{},
+		}
+		for key, value := range data {
+			secret.Data[key] = []byte(value)
+		}
+		return secret
+	}
+
+	before := w.startTime.Add(-time.Hour)
+	after := w.startTime.Add(time.Second)
+
+	tests := []struct {
+		name  string
+		event interface{}
+		want  bool
+	}{
+		{
+			name:  "configmap listed at startup",
+			event: event.CreateEvent{Object: newConfigMap("cluster-image-set-git-repo", before, nil)},
+			want:  false,
+		},
+		{
+			name:  "configmap created",
+			event: event.CreateEvent{Object: newConfigMap("cluster-image-set-git-repo", after, nil)},
+			want:  true,
+		},
+		{
+			name:  "configmap created in the second the watcher started",
+			event: event.CreateEvent{Object: newConfigMap("cluster-image-set-git-repo", w.startTime, nil)},
+			want:  true,
+		},
+		{
+			name: "configmap data changed",
+			event: event.UpdateEvent{
+				ObjectOld: newConfigMap("cluster-image-set-git-repo", before, map[string]string{Channel: "fast"}),
+				ObjectNew: newConfigMap("cluster-image-set-git-repo", before, map[string]string{Channel: "stable"}),
+			},
+			want: true,
+		},
+		{
+			name: "configmap metadata changed",
+			event: event.UpdateEvent{
+				ObjectOld: newConfigMap("cluster-image-set-git-repo", before, map[string]string{Channel: "fast"}),
+				ObjectNew: &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: "cluster-image-set-git-repo", Namespace: getPodNamespace(),
+						Labels: map[string]string{"app": "releases"}},
+					Data: map[string]string{Channel: "fast"},
+				},
+			},
+			want: false,
+		},
+		{
+			name: "status configmap changed",
+			event: event.UpdateEvent{
+				ObjectOld: newConfigMap(DefaultStatusConfigMap, before, nil),
+				ObjectNew: newConfigMap(DefaultStatusConfigMap, before, map[string]string{"cluster-image-set-git-repo": "{}"}),
+			},
+			want: false,
+		},
+		{
+			name: "signature keyring configmap changed",
+			event: event.UpdateEvent{
+				ObjectOld: newConfigMap("signers", before, nil),
+				ObjectNew: newConfigMap("signers", before, map[string]string{"key": "value"}),
+			},
+			want: true,
+		},
+		{
+			name: "CA bundle configmap rotated",
+			event: event.UpdateEvent{
+				ObjectOld: newConfigMap("trusted-ca-bundle", before, map[string]string{DefaultCaBundleConfigMapKey: "bundle"}),
+				ObjectNew: newConfigMap("trusted-ca-bundle", before, map[string]string{DefaultCaBundleConfigMapKey: "rotated"}),
+			},
+			want: true,
+		},
+		{
+			name: "git secret of the configmap changed",
+			event: event.UpdateEvent{
+				ObjectOld: newSecret("git-auth", getPodNamespace(), map[string]string{AccessToken: "old"}),
+				ObjectNew: newSecret("git-auth", getPodNamespace(), map[string]string{AccessToken: "new"}),
+			},
+			want: true,
+		},
+		{
+			name: "other secret changed",
+			event: event.UpdateEvent{
+				ObjectOld: newSecret("other", getPodNamespace(), map[string]string{AccessToken: "old"}),
+				ObjectNew: newSecret("other", getPodNamespace(), map[string]string{AccessToken: "new"}),
+			},
+			want: false,
+		},
+		{
+			name:  "default secret deleted",
+			event: event.DeleteEvent{Object: newSecret("cluster-image-set-git-repo", getPodNamespace(), nil)},
+			want:  true,
+		},
+		{
+			name:  "secret in another namespace deleted",
+			event: event.DeleteEvent{Object: newSecret("cluster-image-set-git-repo", "default", nil)},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bool
+			switch e := tt.event.(type) {
+			case event.CreateEvent:
+				got = w.predicate().Create(e)
+			case event.UpdateEvent:
+				got = w.predicate().Update(e)
+			case event.DeleteEvent:
+				got = w.predicate().Delete(e)
+			}
+			if got != tt.want {
+				t.Errorf("predicate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResync(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	gitRoot := t.TempDir()
+	commitGitRepoFiles(t, filepath.Join(gitRoot, "releases.git"), map[string]string{
+		"clusterImageSets/fast/img4.11.0-x86-64-appsub.yaml":   getClusterImageSetYAML("img4.11.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.11.0-x86_64"),
+		"clusterImageSets/stable/img4.10.0-x86-64-appsub.yaml": getClusterImageSetYAML("img4.10.0-x86-64-appsub", "quay.io/openshift-release-dev/ocp-release:4.10.0-x86_64"),
+	})
+	gitServer := newGitHTTPServer(t, gitRoot)
+
+	c := initClient()
+	g.Expect(c.Create(context.TODO(), getConfigMap(gitServer.URL+"/releases.git", "master", "clusterImageSets", "fast"))).To(gomega.Succeed())
+
+	zapLog, _ := zap.NewDevelopment()
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:       zapr.NewLogger(zapLog),
+		Interval:  3600,
+		ConfigMap: "cluster-image-set-git-repo",
+		Secret:    "cluster-image-set-git-repo",
+		CacheDir:  t.TempDir(),
+	})
+
+	iCtrl.Start()
+	defer iCtrl.Stop()
+
+	imagesetExists := func(name string) func() bool {
+		return func() bool {
+			return c.Get(context.TODO(), client.ObjectKey{Name: name}, &hivev1.ClusterImageSet{}) == nil
+		}
+	}
+	g.Eventually(imagesetExists("img4.11.0-x86-64-appsub"), 10*time.Second, 100*time.Millisecond).Should(gomega.BeTrue())
+
+	updateConfigMap(t, c, "cluster-image-set-git-repo", func(configMap *corev1.ConfigMap) {
+		configMap.Data[Channel] = "stable"
+	})
+
+	// The revision did not change, the clusterImageSets of the new channel are only synced on resync
+	iCtrl.Resync()
+
+	g.Eventually(imagesetExists("img4.10.0-x86-64-appsub"), 10*time.Second, 100*time.Millisecond).Should(gomega.BeTrue())
+	g.Eventually(func() bool {
+		err := c.Get(context.TODO(), client.ObjectKey{Name: "img4.11.0-x86-64-appsub"}, &hivev1.ClusterImageSet{})
+		return errors.IsNotFound(err)
+	}, 10*time.Second, 100*time.Millisecond).Should(gomega.BeTrue())
+}
+
+func TestSourceConfigWatcherMissingCABundle(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	c := initClient()
+	configMap := getDefaultConfigMap()
+	configMap.Data[CaBundleConfigMapRef] = "trusted-ca-bundle"
+	g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+
+	iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+		Log:       zapr.NewLogger(zap.NewNop()),
+		ConfigMap: "cluster-image-set-git-repo",
+		Secret:    "cluster-image-set-git-repo",
+	})
+	w := newSourceConfigWatcher(iCtrl)
+
+	// The sync fails until the CA bundle configmap is created, its creation resyncs
+	_, err := iCtrl.getSources()
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	caBundle := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "trusted-ca-bundle", Namespace: getPodNamespace(),
+			CreationTimestamp: metav1.NewTime(w.startTime.Add(time.Second))},
+	}
+	g.Expect(w.predicate().Create(event.CreateEvent{Object: caBundle})).To(gomega.BeTrue())
+}
@@ -0,0 +1,273 @@
+package clusterimageset
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// WebhookPath is the path of the push webhook receiver on the webhook server
+	WebhookPath = "/webhook"
+	// WebhookCertName and WebhookKeyName are the serving certificate files of the webhook server
+	WebhookCertName = "tls.crt"
+	WebhookKeyName  = "tls.key"
+	// WebhookSecretKey is the key of the webhook secret that holds the shared secret
+	WebhookSecretKey = "webhookSecret"
+
+	// maxWebhookPayloadSize bounds the size of a push event payload
+	maxWebhookPayloadSize = 10 << 20
+)
+
+// webhookPushEvent holds the fields of the GitHub, GitLab and Gitea push event payloads that
+// identify the pushed reference and repository.
+type webhookPushEvent struct {
+	Ref        string            `json:"ref"`
+	Repository webhookRepository `json:"repository"`
+	// Project is the repository in GitLab payloads
+	Project webhookRepository `json:"project"`
+}
+
+type webhookRepository struct {
+	CloneURL   string `json:"clone_url"`
+	SSHURL     string `json:"ssh_url"`
+	HTMLURL    string `json:"html_url"`
+	GitHTTPURL string `json:"git_http_url"`
+	GitSSHURL  string `json:"git_ssh_url"`
+	WebURL     string `json:"web_url"`
+}
+
+func (r *webhookRepository) urls() []string {
+	return []string{r.CloneURL, r.SSHURL, r.HTMLURL, r.GitHTTPURL, r.GitSSHURL, r.WebURL}
+}
+
+// webhookReceiver accepts the push webhooks of GitHub, GitLab and Gitea, and triggers a sync
+// when the pushed reference is synced by one of the Git sources of the controller.
+type webhookReceiver struct {
+	client     client.Client
+	log        logr.Logger
+	controller *ClusterImageSetController
+	// secret is the name of the secret that holds the shared secret of the webhooks
+	secret string
+}
+
+// checkWebhookCertDir checks that the serving certificate of the webhook receiver exists, the
+// manager fails to start without it
+func checkWebhookCertDir(certDir string) error {
+	if certDir == "" {
+		// The default directory of the controller-runtime webhook server
+		certDir = filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
+	}
+
+	for _, name := range []string{WebhookCertName, WebhookKeyName} {
+		if _, err := os.Stat(filepath.Join(certDir, name)); err != nil {
+			return fmt.Errorf("--webhook-secret requires the %s serving certificate file in --webhook-cert-dir %s: %w",
+				name, certDir, err)
+		}
+	}
+
+	return nil
+}
+
+func newWebhookReceiver(controller *ClusterImageSetController, secret string) *webhookReceiver {
+	return &webhookReceiver{
+		client:     controller.client,
+		log:        controller.log.WithName("webhook"),
+		controller: controller,
+		secret:     secret,
+	}
+}
+
+func (h *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookPayloadSize))
+	if err != nil {
+		http.Error(w, "unable to read the payload", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := h.getWebhookSecret()
+	if err != nil {
+		h.log.Info(fmt.Sprintf("unable to get the webhook secret: %v", err.Error()))
+		http.Error(w, "webhook secret is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Gitea also sends the GitHub headers, check its own headers first
+	var event string
+	var valid bool
+	switch {
+	case req.Header.Get("X-Gitea-Event") != "":
+		event = req.Header.Get("X-Gitea-Event")
+		valid = validateHMACSignature(payload, secret, req.Header.Get("X-Gitea-Signature"))
+	case req.Header.Get("X-Gitlab-Event") != "":
+		// GitLab does not sign the payload, it sends the secret token as is
+		event = req.Header.Get("X-Gitlab-Event")
+		valid = subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Gitlab-Token")), secret) == 1
+	case req.Header.Get("X-GitHub-Event") != "":
+		event = req.Header.Get("X-GitHub-Event")
+		valid = validateHMACSignature(payload, secret,
+			strings.TrimPrefix(req.Header.Get("X-Hub-Signature-256"), "sha256="))
+	default:
+		http.Error(w, "unsupported webhook", http.StatusBadRequest)
+		return
+	}
+
+	if !valid {
+		h.log.Info(fmt.Sprintf("rejected %s webhook from %s with an invalid signature", event, req.RemoteAddr))
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch event {
+	case "push", "Push Hook", "Tag Push Hook":
+	default:
+		// ping and other events are acknowledged, but do not trigger a sync
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	pushEvent := &webhookPushEvent{}
+	if err := json.Unmarshal(payload, pushEvent); err != nil {
+		http.Error(w, "invalid push event payload", http.StatusBadRequest)
+		return
+	}
+
+	source := h.getWatchingSource(pushEvent)
+	if source == "" {
+		h.log.Info(fmt.Sprintf("push of %s does not match any source, ignored", pushEvent.Ref))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	h.log.Info(fmt.Sprintf("push of %s to source %s, triggering a sync", pushEvent.Ref, source))
+	h.controller.Trigger()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getWebhookSecret returns the shared secret of the webhooks, it is read at every request so
+// that the secret can be rotated.
+func (h *webhookReceiver) getWebhookSecret() ([]byte, error) {
+	secret := &corev1.Secret{}
+	err := h.client.Get(context.TODO(), types.NamespacedName{Name: h.secret, Namespace: getPodNamespace()}, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	value := secret.Data[WebhookSecretKey]
+	if len(value) == 0 {
+		return nil, fmt.Errorf("%s is missing in secret %s", WebhookSecretKey, h.secret)
+	}
+
+	return value, nil
+}
+
+// getWatchingSource returns the first Git source that syncs the pushed reference of the pushed
+// repository, from any of its URLs, or an empty string.
+func (h *webhookReceiver) getWatchingSource(event *webhookPushEvent) string {
+	pushedURLs := map[string]bool{}
+	for _, repoURL := range append(event.Repository.urls(), event.Project.urls()...) {
+		if repoURL != "" {
+			pushedURLs[normalizeGitRepoURL(repoURL)] = true
+		}
+	}
+
+	for _, configMap := range h.controller.configMaps {
+		config, err := getSourceConfig(h.client, h.log, configMap, h.controller.secret)
+		if err != nil || config.sourceType != SourceTypeGit {
+			continue
+		}
+
+		if !isGitRepoRefSynced(config, event.Ref) {
+			continue
+		}
+
+		for _, repoURL := range config.gitRepoURLs() {
+			if pushedURLs[normalizeGitRepoURL(repoURL)] {
+				return configMap
+			}
+		}
+	}
+
+	return ""
+}
+
+// isGitRepoRefSynced returns true when the reference is the one that the configuration syncs
+func isGitRepoRefSynced(config *sourceConfig, ref string) bool {
+	name := plumbing.ReferenceName(ref)
+
+	switch {
+	case isCommitID(config.ref):
+		// A pinned commit never changes
+		return false
+	case strings.HasPrefix(config.ref, "refs/"):
+		return ref == config.ref
+	case config.ref != "":
+		return name == plumbing.NewBranchReferenceName(config.ref) || name == plumbing.NewTagReferenceName(config.ref)
+	case config.tagPattern != "":
+		if !name.IsTag() {
+			return false
+		}
+		matched, err := path.Match(config.tagPattern, name.Short())
+		return err == nil && matched
+	default:
+		return name == plumbing.NewBranchReferenceName(config.branch)
+	}
+}
+
+// normalizeGitRepoURL reduces the HTTP(S), SSH and scp-like URLs of a Git repository to the
+// same host and path, so that the URLs of the push events match the configured URL.
+func normalizeGitRepoURL(repoURL string) string {
+	host, repoPath := "", ""
+
+	if u, err := url.Parse(repoURL); err == nil && u.Host != "" {
+		host, repoPath = u.Hostname(), u.Path
+	} else if i := strings.Index(repoURL, ":"); i > 0 {
+		// scp-like syntax, user@host:path
+		host, repoPath = repoURL[:i], repoURL[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+	} else {
+		repoPath = repoURL
+	}
+
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+
+	return strings.ToLower(host + "/" + repoPath)
+}
+
+// validateHMACSignature returns true when signature is the hex HMAC-SHA256 of the payload
+func validateHMACSignature(payload, secret []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,256 @@
+package clusterimageset
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/onsi/gomega"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWebhookReceiver(t *testing.T) {
+	const webhookSecret = "s3cr3t"
+
+	githubPush := `{"ref":"refs/heads/release-2.6","repository":{` +
+		`"clone_url":"https://github.com/stolostron/acm-hive-openshift-releases.git",` +
+		`"ssh_url":"git@github.com:stolostron/acm-hive-openshift-releases.git"}}`
+	gitlabPush := `{"ref":"refs/heads/main","project":{` +
+		`"git_http_url":"https://gitlab.example.com/releases/imagesets.git",` +
+		`"git_ssh_url":"git@gitlab.example.com:releases/imagesets.git"}}`
+	giteaPush := `{"ref":"refs/tags/release-2.8.1","repository":{` +
+		`"clone_url":"https://gitea.example.com/releases/imagesets.git"}}`
+
+	tests := []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		payload    string
+		configMap  map[string]string
+		noSecret   bool
+		wantStatus int
+		wantSync   bool
+	}{
+		{
+			name:       "github push to the configured branch",
+			headers:    map[string]string{"X-GitHub-Event": "push"},
+			payload:    githubPush,
+			wantStatus: http.StatusAccepted,
+			wantSync:   true,
+		},
+		{
+			name:       "github push to an SSH repository URL",
+			headers:    map[string]string{"X-GitHub-Event": "push"},
+			payload:    githubPush,
+			configMap:  map[string]string{GitRepoUrl: "ssh://git@github.com/stolostron/acm-hive-openshift-releases"},
+			wantStatus: http.StatusAccepted,
+			wantSync:   true,
+		},
+		{
+			name:    "github push to a fallback URL",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			payload: githubPush,
+			configMap: map[string]string{
+				GitRepoUrl:          "https://git.example.com/mirrors/acm-hive-openshift-releases.git",
+				GitRepoFallbackUrls: "https://github.com/stolostron/acm-hive-openshift-releases.git",
+			},
+			wantStatus: http.StatusAccepted,
+			wantSync:   true,
+		},
+		{
+			name:       "github push to another branch",
+			headers:    map[string]string{"X-GitHub-Event": "push"},
+			payload:    githubPush,
+			configMap:  map[string]string{GitRepoBranch: "backplane-2.3"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "github push to another repository",
+			headers:    map[string]string{"X-GitHub-Event": "push"},
+			payload:    githubPush,
+			configMap:  map[string]string{GitRepoUrl: "https://github.com/stolostron/other.git"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "github push with a pinned commit",
+			headers:    map[string]string{"X-GitHub-Event": "push"},
+			payload:    githubPush,
+			configMap:  map[string]string{GitRepoRef: "0123456789abcdef0123456789abcdef01234567"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "github invalid signature",
+			headers:    map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=0123"},
+			payload:    githubPush,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "github ping",
+			headers:    map[string]string{"X-GitHub-Event": "ping"},
+			payload:    `{"zen":"Keep it logically awesome."}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "gitlab push",
+			headers:    map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": webhookSecret},
+			payload:    gitlabPush,
+			configMap:  map[string]string{GitRepoUrl: "https://gitlab.example.com/releases/imagesets", GitRepoBranch: "main"},
+			wantStatus: http.StatusAccepted,
+			wantSync:   true,
+		},
+		{
+			name:       "gitlab invalid token",
+			headers:    map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"},
+			payload:    gitlabPush,
+			configMap:  map[string]string{GitRepoUrl: "https://gitlab.example.com/releases/imagesets", GitRepoBranch: "main"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "gitea tag push matching the tag pattern",
+			headers:    map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push"},
+			payload:    giteaPush,
+			configMap:  map[string]string{GitRepoUrl: "git@gitea.example.com:releases/imagesets.git", GitRepoTagPattern: "release-2.8.*"},
+			wantStatus: http.StatusAccepted,
+			wantSync:   true,
+		},
+		{
+			name:       "gitea tag push not matching the tag pattern",
+			headers:    map[string]string{"X-Gitea-Event": "push"},
+			payload:    giteaPush,
+			configMap:  map[string]string{GitRepoUrl: "git@gitea.example.com:releases/imagesets.git", GitRepoTagPattern: "release-2.9.*"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unsupported webhook",
+			payload:    githubPush,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing webhook secret",
+			headers:    map[string]string{"X-GitHub-Event": "push"},
+			payload:    githubPush,
+			noSecret:   true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "GET is not allowed",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			c := initClient()
+			configMap := getDefaultConfigMap()
+			for key, value := range tt.configMap {
+				configMap.Data[key] = value
+			}
+			g.Expect(c.Create(context.TODO(), configMap)).To(gomega.Succeed())
+			if !tt.noSecret {
+				g.Expect(c.Create(context.TODO(), &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "webhook", Namespace: getPodNamespace()},
+					Data:       map[string][]byte{WebhookSecretKey: []byte(webhookSecret)},
+				})).To(gomega.Succeed())
+			}
+
+			iCtrl := NewClusterImageSetController(c, &ImagesetOptions{
+				Log:       zapr.NewLogger(zap.NewNop()),
+				Interval:  60,
+				ConfigMap: "cluster-image-set-git-repo",
+				Secret:    "cluster-image-set-git-repo",
+			})
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, WebhookPath, bytes.NewBufferString(tt.payload))
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if req.Header.Get("X-Hub-Signature-256") == "" {
+				mac := hmac.New(sha256.New, []byte(webhookSecret))
+				mac.Write([]byte(tt.payload))
+				signature := hex.EncodeToString(mac.Sum(nil))
+				req.Header.Set("X-Hub-Signature-256", "sha256="+signature)
+				req.Header.Set("X-Gitea-Signature", signature)
+			}
+
+			rec := httptest.NewRecorder()
+			newWebhookReceiver(iCtrl, "webhook").ServeHTTP(rec, req)
+
+			g.Expect(rec.Code).To(gomega.Equal(tt.wantStatus))
+			g.Expect(len(iCtrl.syncch) == 1).To(gomega.Equal(tt.wantSync))
+		})
+	}
+}
+
+func TestCheckWebhookCertDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		wantErr bool
+	}{
+		{name: "certificate and key", files: []string{WebhookCertName, WebhookKeyName}},
+		{name: "no key", files: []string{WebhookCertName}, wantErr: true},
+		{name: "empty directory", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certDir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(certDir, name), []byte("pem"), 0600); err != nil {
+					t.Fatalf("failed to write %v: %v", name, err)
+				}
+			}
+
+			if err := checkWebhookCertDir(certDir); (err != nil) != tt.wantErr {
+				t.Errorf("checkWebhookCertDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeGitRepoURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://github.com/stolostron/acm-hive-openshift-releases.git", want: "github.com/stolostron/acm-hive-openshift-releases"},
+		{url: "https://GitHub.com/stolostron/acm-hive-openshift-releases/", want: "github.com/stolostron/acm-hive-openshift-releases"},
+		{url: "https://user@git.example.com:8443/releases.git", want: "git.example.com/releases"},
+		{url: "ssh://git@github.com:22/stolostron/acm-hive-openshift-releases.git", want: "github.com/stolostron/acm-hive-openshift-releases"},
+		{url: "git@github.com:stolostron/acm-hive-openshift-releases.git", want: "github.com/stolostron/acm-hive-openshift-releases"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := normalizeGitRepoURL(tt.url); got != tt.want {
+				t.Errorf("normalizeGitRepoURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	iCtrl := NewClusterImageSetController(initClient(), &ImagesetOptions{Log: zapr.NewLogger(zap.NewNop())})
+
+	// Triggers are coalesced while a sync is pending, and never block
+	iCtrl.Trigger()
+	iCtrl.Trigger()
+
+	if len(iCtrl.syncch) != 1 {
+		t.Errorf("pending syncs = %v, want 1", len(iCtrl.syncch))
+	}
+}